@@ -0,0 +1,93 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// accessLog writes HTTP access log in Combined Log Format followed by request
+// duration in microseconds.
+type accessLog struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func (l *accessLog) log(r *http.Request, sw *statusWriter, start time.Time) {
+	user := "-"
+	if u, _, ok := r.BasicAuth(); ok && u != "" {
+		user = u
+	}
+	size := "-"
+	if sw.size > 0 {
+		size = strconv.FormatInt(sw.size, 10)
+	}
+
+	line := fmt.Sprintf("%s - %s [%s] %q %d %s %q %q %d\n",
+		trimPort(r.RemoteAddr),
+		user,
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.RequestURI+" "+r.Proto,
+		sw.code(),
+		size,
+		orDash(r.Referer()),
+		orDash(r.UserAgent()),
+		time.Since(start)/time.Microsecond,
+	)
+
+	l.mu.Lock()
+	io.WriteString(l.w, line)
+	l.mu.Unlock()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// statusWriter records status code and number of bytes of response body
+// written to the underlying http.ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= http.StatusOK {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// code returns the response status code.
+func (w *statusWriter) code() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
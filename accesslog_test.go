@@ -0,0 +1,38 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	l := &accessLog{w: &buf}
+
+	r := httptest.NewRequest(http.MethodGet, "/foo?bar=1", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.SetBasicAuth("user", "password")
+	r.Header.Set("User-Agent", "test")
+
+	sw := &statusWriter{ResponseWriter: httptest.NewRecorder()}
+	sw.WriteHeader(http.StatusNotFound)
+	sw.Write([]byte("not found"))
+
+	start := time.Date(2017, time.March, 1, 10, 0, 0, 0, time.UTC)
+	l.log(r, sw, start)
+
+	expected := `^10\.0\.0\.1 - user \[01/Mar/2017:10:00:00 \+0000\] "GET /foo\?bar=1 HTTP/1\.1" 404 9 "-" "test" \d+\n$`
+	if !regexp.MustCompile(expected).MatchString(buf.String()) {
+		t.Fatal("unexpected log line", buf.String())
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+// AuditEventType is type of AuditEvent.
+type AuditEventType string
+
+// Audit event types.
+const (
+	// AuditAccept is emitted when client control handshake succeeds or
+	// a connection joins connection pool of the client.
+	AuditAccept AuditEventType = "accept"
+	// AuditReject is emitted when client control handshake is rejected.
+	AuditReject AuditEventType = "reject"
+	// AuditRevoke is emitted when client is revoked with Server.Revoke.
+	AuditRevoke AuditEventType = "revoke"
+	// AuditUnsubscribe is emitted when client is removed with
+	// Server.Unsubscribe.
+	AuditUnsubscribe AuditEventType = "unsubscribe"
+)
+
+// AuditEvent describes authentication attempt or removal of a client, see
+// ServerConfig.AuditLog. Fields and their JSON names are stable.
+type AuditEvent struct {
+	// Time is the time of the event.
+	Time time.Time `json:"time"`
+	// Type is the event type.
+	Type AuditEventType `json:"type"`
+	// RemoteAddr is network address of the control connection, it's empty
+	// for revoke and unsubscribe events of clients that are not connected.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// ID is the presented client identifier, it's empty if client was
+	// rejected before it was identified.
+	ID string `json:"id,omitempty"`
+	// Name is AllowedClient.Name of the identified client.
+	Name string `json:"name,omitempty"`
+	// Labels are AllowedClient.Labels of the identified client.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Reason is RejectReason description of reject events.
+	Reason string `json:"reason,omitempty"`
+	// Err is the error that caused reject, if any.
+	Err string `json:"err,omitempty"`
+	// Cause is the error Err describes, it's *ProxyError with
+	// PhaseHandshake for reject events.
+	Cause error `json:"-"`
+	// TLSVersion is TLS version negotiated by the control connection i.e.
+	// "TLS 1.3", it's empty for connections without completed TLS
+	// handshake.
+	TLSVersion string `json:"tls_version,omitempty"`
+	// CipherSuite is cipher suite negotiated by the control connection, it's
+	// empty when TLSVersion is.
+	CipherSuite string `json:"cipher_suite,omitempty"`
+}
+
+// audit emits event of control connection conn to ServerConfig.AuditLog.
+func (s *Server) audit(typ AuditEventType, conn net.Conn, identifier id.ID, reason RejectReason, err error) {
+	if s.config.AuditLog == nil {
+		return
+	}
+
+	e := AuditEvent{
+		Time: time.Now(),
+		Type: typ,
+	}
+	if conn != nil {
+		e.RemoteAddr = conn.RemoteAddr().String()
+		if state := connectionState(conn); state != nil {
+			e.TLSVersion = tls.VersionName(state.Version)
+			e.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+		}
+	}
+	if identifier != (id.ID{}) {
+		e.ID = identifier.String()
+		e.Name, e.Labels = s.clientLabels(identifier)
+	}
+	if reason != 0 {
+		e.Reason = reason.String()
+	}
+	if err != nil {
+		e.Err = err.Error()
+		e.Cause = err
+	}
+
+	s.config.AuditLog(e)
+}
+
+// auditRemove emits event of type typ for client that is being removed, it
+// must be called before the client connections are closed.
+func (s *Server) auditRemove(typ AuditEventType, identifier id.ID) {
+	if s.config.AuditLog == nil {
+		return
+	}
+
+	s.audit(typ, s.connPool.Conn(identifier), identifier, 0, nil)
+}
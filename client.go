@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"sync"
@@ -25,19 +26,62 @@ type ClientConfig struct {
 	// ServerAddr specifies TCP address of the tunnel server.
 	ServerAddr string
 	// TLSClientConfig specifies the tls configuration to use with
-	// tls.Client.
+	// tls.Client. It may be nil if Token is set, then plain TCP is used.
 	TLSClientConfig *tls.Config
+	// Token specifies optional shared secret client authenticates with to
+	// server with ServerConfig.InsecureControl, it's sent after connection
+	// is established and TLS, if any, is done.
+	Token string
 	// DialTLS specifies an optional dial function that creates a tls
 	// connection to the server. If DialTLS is nil, tls.Dial is used.
 	DialTLS func(network, addr string, config *tls.Config) (net.Conn, error)
-	// Backoff specifies backoff policy on server connection retry. If nil
-	// when dial fails it will not be retried.
+	// Backoff specifies backoff policy on server connection retry, it's
+	// used when dial fails and when connection to the server drops
+	// repeatedly. If nil when dial fails it will not be retried.
 	Backoff Backoff
+	// OnRetry is optional callback invoked before each reconnection attempt
+	// with the attempt number, the time to sleep and the last error.
+	OnRetry func(attempt int, sleep time.Duration, err error)
+	// OnGiveUp is optional callback invoked when backoff policy gives up
+	// reconnecting.
+	OnGiveUp func(err error)
+	// PoolSize specifies number of control connections client keeps open
+	// to the server, server must allow that many with
+	// ServerConfig.ConnPoolSize. The first connection does the handshake,
+	// the other ones are opened once it's done and closed with it. If zero
+	// a single connection is used.
+	PoolSize int
 	// Tunnels specifies the tunnels client requests to be opened on server.
 	Tunnels map[string]*proto.Tunnel
 	// Proxy is ProxyFunc responsible for transferring data between server
 	// and local services.
 	Proxy ProxyFunc
+	// Forwards specifies reverse port forwarding, keys are local TCP
+	// addresses client listens on, values are addresses in form host:port
+	// the server dials for each accepted connection. Server must allow the
+	// targets with AllowedClient.ForwardTargets.
+	Forwards map[string]string
+	// LocalDialer is optional function used by TCPProxy, UDPProxy and
+	// HTTPProxy for connecting to local services. If nil net.Dial with
+	// DefaultTimeout is used, HTTPProxy with custom Transport does not use
+	// LocalDialer for HTTP requests.
+	LocalDialer func(network, addr string) (net.Conn, error)
+	// DisableNoDelay if enabled clears TCP_NODELAY of TCP connections to
+	// local services so that small writes are coalesced, it may help bulk
+	// transfers. By default TCP_NODELAY is set.
+	DisableNoDelay bool
+	// HealthCheck is optional function checking local service before each
+	// proxied session, target is ControlMessage.ForwardedHost. If it fails
+	// the session is rejected and server responds with 503 Service
+	// Unavailable or closes the connection.
+	HealthCheck func(target string) error
+	// Compression if enabled makes client gzip compress text based HTTP
+	// responses if server has compression enabled.
+	Compression bool
+	// CompressionMinSize specifies minimal size of HTTP response body of
+	// known length that is compressed. If zero DefaultCompressionMinSize is
+	// used.
+	CompressionMinSize int64
 	// Logger is optional logger. If nil logging is disabled.
 	Logger log.Logger
 }
@@ -49,10 +93,22 @@ type Client struct {
 	config *ClientConfig
 
 	conn           net.Conn
+	pool           []net.Conn          // connections opened by openPool
+	tokens         map[net.Conn]string // disconnect tokens of connections
 	connMu         sync.Mutex
+	stopped        bool
 	httpServer     *http2.Server
+	drainServer    *http.Server
 	serverErr      error
 	lastDisconnect time.Time
+	retries        int
+	draining       bool
+	sessions       sync.WaitGroup
+	activeSessions int64
+	totalSessions  int64
+	bytesIn        int64
+	bytesOut       int64
+	listeners      []net.Listener
 	logger         log.Logger
 }
 
@@ -62,7 +118,7 @@ func NewClient(config *ClientConfig) (*Client, error) {
 	if config.ServerAddr == "" {
 		return nil, errors.New("missing ServerAddr")
 	}
-	if config.TLSClientConfig == nil {
+	if config.TLSClientConfig == nil && config.Token == "" {
 		return nil, errors.New("missing TLSClientConfig")
 	}
 	if len(config.Tunnels) == 0 {
@@ -71,6 +127,14 @@ func NewClient(config *ClientConfig) (*Client, error) {
 	if config.Proxy == nil {
 		return nil, errors.New("missing Proxy")
 	}
+	if config.PoolSize < 0 {
+		return nil, errors.New("negative PoolSize")
+	}
+	for addr, target := range config.Forwards {
+		if _, _, err := splitTarget(target); err != nil {
+			return nil, fmt.Errorf("forward %s: invalid target %q: %s", addr, target, err)
+		}
+	}
 
 	logger := config.Logger
 	if logger == nil {
@@ -78,9 +142,14 @@ func NewClient(config *ClientConfig) (*Client, error) {
 	}
 
 	c := &Client{
-		config:     config,
-		httpServer: &http2.Server{},
-		logger:     logger,
+		config:      config,
+		httpServer:  &http2.Server{},
+		drainServer: &http.Server{},
+		logger:      logger,
+	}
+	// drainServer shutdown gracefully closes the control connection
+	if err := http2.ConfigureServer(c.drainServer, c.httpServer); err != nil {
+		return nil, err
 	}
 
 	return c, nil
@@ -96,14 +165,22 @@ func (c *Client) Start() error {
 		"action", "start",
 	)
 
+	if err := c.listenForwards(); err != nil {
+		return err
+	}
+
 	for {
 		conn, err := c.connect()
 		if err != nil {
 			return err
 		}
+		if conn == nil {
+			// stopped
+			return nil
+		}
 
 		c.httpServer.ServeConn(conn, &http2.ServeConnOpts{
-			Handler: http.HandlerFunc(c.serveHTTP),
+			Handler: c.connHandler(conn),
 		})
 
 		c.logger.Log(
@@ -112,29 +189,52 @@ func (c *Client) Start() error {
 		)
 
 		c.connMu.Lock()
+		c.closePool()
+		if c.stopped {
+			c.connMu.Unlock()
+			return nil
+		}
 		now := time.Now()
 		err = c.serverErr
 
 		// detect disconnect hiccup
+		hiccup := false
 		if err == nil && now.Sub(c.lastDisconnect).Seconds() < 5 {
 			err = fmt.Errorf("connection is being cut")
+			hiccup = true
 		}
 
 		c.conn = nil
+		c.tokens = nil
 		c.serverErr = nil
 		c.lastDisconnect = now
+		c.draining = false
 		c.connMu.Unlock()
 
-		if err != nil {
+		b := c.config.Backoff
+		switch {
+		case hiccup && b != nil:
+			if !c.backoff(err) {
+				return err
+			}
+		case err != nil:
 			return err
+		case b != nil:
+			// connection was stable, start over
+			b.Reset()
+			c.retries = 0
 		}
 	}
 }
 
+// connect dials the server, it returns nil connection if client was stopped.
 func (c *Client) connect() (net.Conn, error) {
 	c.connMu.Lock()
 	defer c.connMu.Unlock()
 
+	if c.stopped {
+		return nil, nil
+	}
 	if c.conn != nil {
 		return nil, fmt.Errorf("already connected")
 	}
@@ -149,85 +249,114 @@ func (c *Client) connect() (net.Conn, error) {
 }
 
 func (c *Client) dial() (net.Conn, error) {
+	b := c.config.Backoff
+	if b == nil {
+		return c.dialOnce()
+	}
+
+	for {
+		conn, err := c.dialOnce()
+
+		// success
+		if err == nil {
+			return conn, err
+		}
+
+		// failure
+		if !c.backoff(err) {
+			return conn, fmt.Errorf("backoff limit exeded: %s", err)
+		}
+	}
+}
+
+// dialOnce creates TLS connection to the server without retrying, if Token is
+// set connection is authenticated with it.
+func (c *Client) dialOnce() (conn net.Conn, err error) {
 	var (
 		network   = "tcp"
 		addr      = c.config.ServerAddr
 		tlsConfig = c.config.TLSClientConfig
 	)
 
-	doDial := func() (conn net.Conn, err error) {
-		c.logger.Log(
-			"level", 1,
-			"action", "dial",
-			"network", network,
-			"addr", addr,
-		)
-
-		if c.config.DialTLS != nil {
-			conn, err = c.config.DialTLS(network, addr, tlsConfig)
-		} else {
-			d := &net.Dialer{
-				Timeout: DefaultTimeout,
-			}
-			conn, err = d.Dial(network, addr)
+	c.logger.Log(
+		"level", 1,
+		"action", "dial",
+		"network", network,
+		"addr", addr,
+	)
 
-			if err == nil {
-				err = keepAlive(conn)
-			}
-			if err == nil {
-				conn = tls.Client(conn, tlsConfig)
-			}
-			if err == nil {
-				err = conn.(*tls.Conn).Handshake()
-			}
+	if c.config.DialTLS != nil {
+		conn, err = c.config.DialTLS(network, addr, tlsConfig)
+	} else {
+		d := &net.Dialer{
+			Timeout: DefaultTimeout,
 		}
+		conn, err = d.Dial(network, addr)
 
-		if err != nil {
-			if conn != nil {
-				conn.Close()
-				conn = nil
-			}
-
-			c.logger.Log(
-				"level", 0,
-				"msg", "dial failed",
-				"network", network,
-				"addr", addr,
-				"err", err,
-			)
+		if err == nil {
+			err = keepAlive(conn)
+		}
+		if err == nil && tlsConfig != nil {
+			conn = tls.Client(conn, tlsConfig)
+			err = conn.(*tls.Conn).Handshake()
 		}
-
-		return
 	}
-
-	b := c.config.Backoff
-	if b == nil {
-		return doDial()
+	if err == nil && c.config.Token != "" {
+		var uc net.Conn
+		if uc, err = c.upgrade(conn); err == nil {
+			conn = uc
+		}
 	}
 
-	for {
-		conn, err := doDial()
-
-		// success
-		if err == nil {
-			b.Reset()
-			return conn, err
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+			conn = nil
 		}
 
-		// failure
-		d := b.NextBackOff()
-		if d < 0 {
-			return conn, fmt.Errorf("backoff limit exeded: %s", err)
-		}
+		c.logger.Log(
+			"level", 0,
+			"msg", "dial failed",
+			"network", network,
+			"addr", addr,
+			"err", err,
+		)
+	}
+
+	return
+}
 
-		// backoff
+// backoff sleeps before next connection attempt according to backoff policy,
+// it returns false if the policy gives up.
+func (c *Client) backoff(err error) bool {
+	d := c.config.Backoff.NextBackOff()
+	if d < 0 {
 		c.logger.Log(
-			"level", 1,
-			"action", "backoff",
-			"sleep", d,
+			"level", 0,
+			"msg", "giving up reconnecting",
+			"attempts", c.retries,
+			"err", err,
 		)
-		time.Sleep(d)
+		if c.config.OnGiveUp != nil {
+			go c.config.OnGiveUp(err)
+		}
+		return false
 	}
+
+	c.retries++
+
+	c.logger.Log(
+		"level", 1,
+		"action", "backoff",
+		"attempt", c.retries,
+		"sleep", d,
+	)
+	if c.config.OnRetry != nil {
+		go c.config.OnRetry(c.retries, d, err)
+	}
+	time.Sleep(d)
+
+	return true
 }
 
 func (c *Client) serveHTTP(w http.ResponseWriter, r *http.Request) {
@@ -250,31 +379,75 @@ func (c *Client) serveHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	c.logger.Log(
+	logger := log.NewContext(c.logger).With("requestID", msg.RequestID)
+
+	logger.Log(
 		"level", 2,
 		"action", "handle",
 		"ctrlMsg", msg,
 	)
 	switch msg.Action {
 	case proto.ActionProxy:
-		c.config.Proxy(w, r.Body, msg)
+		if err := c.healthCheck(msg); err != nil {
+			logger.Log(
+				"level", 1,
+				"msg", "health check failed",
+				"ctrlMsg", msg,
+				"err", err,
+			)
+			w.Header().Set(proto.HeaderError, err.Error())
+			w.WriteHeader(http.StatusServiceUnavailable)
+			break
+		}
+		if !c.startSession() {
+			w.Header().Set(proto.HeaderError, errClientDraining.Error())
+			w.WriteHeader(http.StatusServiceUnavailable)
+			break
+		}
+		var body io.ReadCloser = countReadCloser{r.Body, &c.bytesIn}
+		if dial := c.localDialer(); dial != nil {
+			body = localBody{body, dial}
+		}
+		cnt := countResponseWriter{w, &c.bytesOut}
+		if c.config.Compression && msg.Compression == proto.CompressionGzip {
+			cw := newCompressResponseWriter(cnt, c.config.CompressionMinSize)
+			c.config.Proxy(cw, body, msg)
+			cw.Close()
+		} else {
+			c.config.Proxy(cnt, body, msg)
+		}
+		c.endSession()
+	case proto.ActionPing:
+		w.WriteHeader(http.StatusOK)
+	case proto.ActionDrain:
+		c.handleDrain(w)
+	case proto.ActionStats:
+		c.handleStats(w)
 	default:
-		c.logger.Log(
+		logger.Log(
 			"level", 0,
 			"msg", "unknown action",
 			"ctrlMsg", msg,
 		)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 	}
-	c.logger.Log(
+	logger.Log(
 		"level", 2,
 		"action", "done",
 		"ctrlMsg", msg,
 	)
 }
 
+// healthCheck runs HealthCheck for the local service of msg if configured.
+func (c *Client) healthCheck(msg *proto.ControlMessage) error {
+	if c.config.HealthCheck == nil {
+		return nil
+	}
+	return c.config.HealthCheck(msg.ForwardedHost)
+}
+
 func (c *Client) handleHandshakeError(w http.ResponseWriter, r *http.Request) {
-	err := fmt.Errorf(r.Header.Get(proto.HeaderError))
+	err := errors.New(r.Header.Get(proto.HeaderError))
 
 	c.logger.Log(
 		"level", 1,
@@ -307,20 +480,52 @@ func (c *Client) handleHandshake(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Write(b)
+
+	c.openPool()
 }
 
-// Stop disconnects client from server.
+// Stop disconnects client from server, server is told to deregister the
+// client right away.
 func (c *Client) Stop() {
 	c.connMu.Lock()
-	defer c.connMu.Unlock()
 
 	c.logger.Log(
 		"level", 1,
 		"action", "stop",
 	)
 
+	c.stopped = true
+	var (
+		conns  []net.Conn
+		tokens []string
+	)
 	if c.conn != nil {
-		c.conn.Close()
+		conns = append(conns, c.conn)
+		conns = append(conns, c.pool...)
+	}
+	for _, conn := range conns {
+		if token, ok := c.tokens[conn]; ok {
+			tokens = append(tokens, token)
+		}
 	}
 	c.conn = nil
+	c.pool = nil
+	c.tokens = nil
+
+	for _, l := range c.listeners {
+		l.Close()
+	}
+	c.listeners = nil
+
+	c.connMu.Unlock()
+
+	// disconnect is sent without connMu held so that sessions are not
+	// blocked while it's in progress
+	if len(tokens) > 0 {
+		c.disconnect(tokens)
+	}
+
+	for _, conn := range conns {
+		conn.Close()
+	}
 }
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"net"
 	"net/http/httptest"
+	"reflect"
 	"testing"
 	"time"
 
@@ -61,13 +62,22 @@ func TestClient_DialBackoff(t *testing.T) {
 		return nil, errors.New("foobar")
 	}
 
+	retries := make(chan int, 2)
+	gaveUp := make(chan error, 1)
+
 	c, err := NewClient(&ClientConfig{
 		ServerAddr:      "8.8.8.8",
 		TLSClientConfig: &tls.Config{},
 		DialTLS:         d,
 		Backoff:         b,
-		Tunnels:         map[string]*proto.Tunnel{"test": {}},
-		Proxy:           Proxy(ProxyFuncs{}),
+		OnRetry: func(attempt int, sleep time.Duration, err error) {
+			retries <- attempt
+		},
+		OnGiveUp: func(err error) {
+			gaveUp <- err
+		},
+		Tunnels: map[string]*proto.Tunnel{"test": {}},
+		Proxy:   Proxy(ProxyFuncs{}),
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -83,4 +93,42 @@ func TestClient_DialBackoff(t *testing.T) {
 	if err.Error() != "backoff limit exeded: foobar" {
 		t.Fatal("Error mismatch", err)
 	}
+
+	if err := <-gaveUp; err.Error() != "foobar" {
+		t.Fatal("Give up error mismatch", err)
+	}
+	if a, b := <-retries, <-retries; a+b != 3 {
+		t.Fatal("Unexpected retry attempts", a, b)
+	}
+}
+
+func TestClient_Services(t *testing.T) {
+	t.Parallel()
+
+	c, err := NewClient(&ClientConfig{
+		ServerAddr:      "8.8.8.8",
+		TLSClientConfig: &tls.Config{},
+		Tunnels: map[string]*proto.Tunnel{
+			"web": {Protocol: proto.HTTP, Host: "example.com"},
+			"db":  {Protocol: proto.TCP, Addr: ":5432"},
+		},
+		HealthCheck: func(target string) error {
+			if target == ":5432" {
+				return errors.New("down")
+			}
+			return nil
+		},
+		Proxy: Proxy(ProxyFuncs{}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []proto.ServiceStatus{
+		{Tunnel: "db", Target: ":5432", Err: "down"},
+		{Tunnel: "web", Target: "example.com", Up: true},
+	}
+	if actual := c.services(); !reflect.DeepEqual(actual, expected) {
+		t.Fatal("Unexpected services", actual)
+	}
 }
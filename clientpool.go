@@ -0,0 +1,93 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// poolRetryInterval is the time client waits before reopening a pool
+// connection that failed or was closed by server.
+const poolRetryInterval = time.Second
+
+// openPool opens PoolSize-1 connections joining the handshaked connection,
+// server sends requests over all of them.
+func (c *Client) openPool() {
+	c.connMu.Lock()
+	primary := c.conn
+	c.connMu.Unlock()
+
+	if primary == nil {
+		return
+	}
+	for i := 1; i < c.config.PoolSize; i++ {
+		go c.servePool(primary)
+	}
+}
+
+// servePool keeps a pool connection open as long as primary connection is.
+func (c *Client) servePool(primary net.Conn) {
+	for c.poolActive(primary) {
+		conn, err := c.dialOnce()
+		if err == nil && c.addPool(primary, conn) {
+			c.httpServer.ServeConn(conn, &http2.ServeConnOpts{
+				Handler: c.connHandler(conn),
+			})
+			c.removePool(conn)
+
+			c.logger.Log(
+				"level", 1,
+				"action", "pool connection closed",
+			)
+		}
+		time.Sleep(poolRetryInterval)
+	}
+}
+
+// poolActive returns true if pool connections of primary connection shall be
+// kept open.
+func (c *Client) poolActive(primary net.Conn) bool {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return !c.stopped && c.conn == primary
+}
+
+// addPool registers pool connection, if primary connection is gone conn is
+// closed and false is returned.
+func (c *Client) addPool(primary, conn net.Conn) bool {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	if c.stopped || c.conn != primary {
+		conn.Close()
+		return false
+	}
+	c.pool = append(c.pool, conn)
+	return true
+}
+
+func (c *Client) removePool(conn net.Conn) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	for i, v := range c.pool {
+		if v == conn {
+			c.pool = append(c.pool[:i], c.pool[i+1:]...)
+			break
+		}
+	}
+	delete(c.tokens, conn)
+}
+
+// closePool closes all pool connections, it must be called with connMu held.
+func (c *Client) closePool() {
+	for _, conn := range c.pool {
+		conn.Close()
+	}
+	c.pool = nil
+}
@@ -0,0 +1,152 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync/atomic"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// ClientStats describes state of a connected client as observed by the
+// client, see Server.ClientStats.
+type ClientStats struct {
+	// ActiveSessions is number of sessions being proxied by the client.
+	ActiveSessions int64
+	// TotalSessions is number of sessions proxied since the client started.
+	TotalSessions int64
+	// BytesIn is number of bytes the client received from servers.
+	BytesIn int64
+	// BytesOut is number of bytes the client sent to servers.
+	BytesOut int64
+	// Services is status of local services, it's reported only if client
+	// has ClientConfig.HealthCheck.
+	Services []proto.ServiceStatus
+}
+
+// ClientStats asks connected client for its stats, it waits up to
+// PingTimeout for the response.
+func (s *Server) ClientStats(identifier id.ID) (ClientStats, error) {
+	if !s.connPool.IsConnected(identifier) {
+		return ClientStats{}, errClientNotConnected
+	}
+
+	msg := &proto.ControlMessage{
+		Action: proto.ActionStats,
+	}
+
+	req, err := s.connectRequest(identifier, msg, nil)
+	if err != nil {
+		return ClientStats{}, fmt.Errorf("stats request error: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.pingTimeout)
+	defer cancel()
+
+	resp, err := s.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return ClientStats{}, fmt.Errorf("stats failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ClientStats{}, fmt.Errorf("stats failed: status %s", resp.Status)
+	}
+
+	var stats proto.Stats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return ClientStats{}, fmt.Errorf("stats failed: %s", err)
+	}
+
+	return ClientStats(stats), nil
+}
+
+// handleStats responds with client stats.
+func (c *Client) handleStats(w http.ResponseWriter) {
+	stats := proto.Stats{
+		ActiveSessions: atomic.LoadInt64(&c.activeSessions),
+		TotalSessions:  atomic.LoadInt64(&c.totalSessions),
+		BytesIn:        atomic.LoadInt64(&c.bytesIn),
+		BytesOut:       atomic.LoadInt64(&c.bytesOut),
+		Services:       c.services(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(stats)
+}
+
+// services runs HealthCheck for every tunnel, if there is no HealthCheck nil
+// is returned.
+func (c *Client) services() []proto.ServiceStatus {
+	if c.config.HealthCheck == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(c.config.Tunnels))
+	for name := range c.config.Tunnels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	services := make([]proto.ServiceStatus, 0, len(names))
+	for _, name := range names {
+		t := c.config.Tunnels[name]
+		target := t.Host
+		if target == "" {
+			target = t.Addr
+		}
+
+		st := proto.ServiceStatus{
+			Tunnel: name,
+			Target: target,
+			Up:     true,
+		}
+		if err := c.config.HealthCheck(target); err != nil {
+			st.Up = false
+			st.Err = err.Error()
+		}
+		services = append(services, st)
+	}
+
+	return services
+}
+
+// countReadCloser counts bytes read from ReadCloser in count.
+type countReadCloser struct {
+	io.ReadCloser
+	count *int64
+}
+
+func (r countReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+	return n, err
+}
+
+// countResponseWriter counts bytes written to ResponseWriter in count.
+type countResponseWriter struct {
+	http.ResponseWriter
+	count *int64
+}
+
+func (w countResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	atomic.AddInt64(w.count, int64(n))
+	return n, err
+}
+
+func (w countResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -33,21 +34,26 @@ type BackoffConfig struct {
 
 // Tunnel defines a tunnel.
 type Tunnel struct {
-	Protocol   string `yaml:"proto,omitempty"`
-	Addr       string `yaml:"addr,omitempty"`
-	Auth       string `yaml:"auth,omitempty"`
-	Host       string `yaml:"host,omitempty"`
-	RemoteAddr string `yaml:"remote_addr,omitempty"`
+	Protocol      string `yaml:"proto,omitempty"`
+	Addr          string `yaml:"addr,omitempty"`
+	Auth          string `yaml:"auth,omitempty"`
+	Host          string `yaml:"host,omitempty"`
+	RemoteAddr    string `yaml:"remote_addr,omitempty"`
+	ProxyProtocol string `yaml:"proxy_protocol,omitempty"`
+	AppProtocol   string `yaml:"app_proto,omitempty"`
 }
 
 // ClientConfig is a tunnel client configuration.
 type ClientConfig struct {
-	ServerAddr string             `yaml:"server_addr"`
-	TLSCrt     string             `yaml:"tls_crt"`
-	TLSKey     string             `yaml:"tls_key"`
-	RootCA     string             `yaml:"root_ca"`
-	Backoff    BackoffConfig      `yaml:"backoff"`
-	Tunnels    map[string]*Tunnel `yaml:"tunnels"`
+	ServerAddr  string             `yaml:"server_addr"`
+	TLSCrt      string             `yaml:"tls_crt"`
+	TLSKey      string             `yaml:"tls_key"`
+	RootCA      string             `yaml:"root_ca"`
+	Token       string             `yaml:"token"`
+	Backoff     BackoffConfig      `yaml:"backoff"`
+	Compression bool               `yaml:"compression"`
+	Tunnels     map[string]*Tunnel `yaml:"tunnels"`
+	Forwards    map[string]string  `yaml:"forwards"`
 }
 
 func loadClientConfigFromFile(file string) (*ClientConfig, error) {
@@ -84,15 +90,29 @@ func loadClientConfigFromFile(file string) (*ClientConfig, error) {
 			if err := validateHTTP(t); err != nil {
 				return nil, fmt.Errorf("%s %s", name, err)
 			}
-		case proto.TCP, proto.TCP4, proto.TCP6:
+		case proto.TCP, proto.TCP4, proto.TCP6, proto.UDP, proto.UNIX:
 			if err := validateTCP(t); err != nil {
 				return nil, fmt.Errorf("%s %s", name, err)
 			}
+		case proto.SNI:
+			if err := validateSNI(t); err != nil {
+				return nil, fmt.Errorf("%s %s", name, err)
+			}
 		default:
 			return nil, fmt.Errorf("%s invalid protocol %q", name, t.Protocol)
 		}
 	}
 
+	forwards := make(map[string]string, len(c.Forwards))
+	for addr, target := range c.Forwards {
+		local, err := normalizeAddress(addr)
+		if err != nil {
+			return nil, fmt.Errorf("forwards %s: %s", addr, err)
+		}
+		forwards[local] = target
+	}
+	c.Forwards = forwards
+
 	return &c, nil
 }
 
@@ -101,6 +121,9 @@ func validateHTTP(t *Tunnel) error {
 	if t.Host == "" {
 		return fmt.Errorf("host: missing")
 	}
+	if strings.Contains(strings.TrimPrefix(t.Host, "*."), "*") {
+		return fmt.Errorf("host: wildcard allowed only as the first label")
+	}
 	if t.Addr == "" {
 		return fmt.Errorf("addr: missing")
 	}
@@ -113,24 +136,98 @@ func validateHTTP(t *Tunnel) error {
 	if t.RemoteAddr != "" {
 		return fmt.Errorf("remote_addr: unexpected")
 	}
+	if t.ProxyProtocol != "" {
+		return fmt.Errorf("proxy_protocol: unexpected")
+	}
 
 	return nil
 }
 
-func validateTCP(t *Tunnel) error {
+func validateSNI(t *Tunnel) error {
 	var err error
+	if t.Host == "" {
+		return fmt.Errorf("host: missing")
+	}
+	if strings.Contains(strings.TrimPrefix(t.Host, "*."), "*") {
+		return fmt.Errorf("host: wildcard allowed only as the first label")
+	}
+	if t.RemoteAddr == "" {
+		return fmt.Errorf("remote_addr: missing")
+	}
 	if t.RemoteAddr, err = normalizeAddress(t.RemoteAddr); err != nil {
 		return fmt.Errorf("remote_addr: %s", err)
 	}
 	if t.Addr == "" {
 		return fmt.Errorf("addr: missing")
 	}
-	if t.Addr, err = normalizeAddress(t.Addr); err != nil {
+	if !isUnixAddr(t.Addr) {
+		if t.Addr, err = normalizeAddress(t.Addr); err != nil {
+			return fmt.Errorf("addr: %s", err)
+		}
+	}
+	switch t.ProxyProtocol {
+	case "", proto.ProxyProtocolV1, proto.ProxyProtocolV2:
+		// ok
+	default:
+		return fmt.Errorf("proxy_protocol: unknown version %q", t.ProxyProtocol)
+	}
+
+	// unexpected
+
+	if t.Auth != "" {
+		return fmt.Errorf("auth: unexpected")
+	}
+
+	return nil
+}
+
+func validateTCP(t *Tunnel) error {
+	var err error
+	if t.Protocol == proto.UNIX {
+		if t.RemoteAddr == "" {
+			return fmt.Errorf("remote_addr: missing")
+		}
+	} else if t.RemoteAddr, err = normalizeAddress(t.RemoteAddr); err != nil {
+		return fmt.Errorf("remote_addr: %s", err)
+	}
+	if t.Addr == "" {
+		return fmt.Errorf("addr: missing")
+	}
+	if isUnixAddr(t.Addr) {
+		if t.Protocol == proto.UDP {
+			return fmt.Errorf("addr: unix socket not supported for udp")
+		}
+	} else if t.Addr, err = normalizeAddress(t.Addr); err != nil {
 		return fmt.Errorf("addr: %s", err)
 	}
+	switch t.ProxyProtocol {
+	case "", proto.ProxyProtocolV1, proto.ProxyProtocolV2:
+		// ok
+	default:
+		return fmt.Errorf("proxy_protocol: unknown version %q", t.ProxyProtocol)
+	}
+
+	switch t.AppProtocol {
+	case "", proto.HTTP:
+		// ok
+	default:
+		return fmt.Errorf("app_proto: unsupported protocol %q", t.AppProtocol)
+	}
 
 	// unexpected
 
+	if t.Protocol == proto.UDP && t.ProxyProtocol != "" {
+		return fmt.Errorf("proxy_protocol: unexpected")
+	}
+	if t.Protocol == proto.UDP && t.AppProtocol != "" {
+		return fmt.Errorf("app_proto: unexpected")
+	}
+	if t.AppProtocol == proto.HTTP && t.ProxyProtocol != "" {
+		return fmt.Errorf("proxy_protocol: unexpected with app_proto http")
+	}
+	if t.AppProtocol == proto.HTTP && isUnixAddr(t.Addr) {
+		return fmt.Errorf("addr: unix socket not supported with app_proto http")
+	}
 	if t.Host != "" {
 		return fmt.Errorf("host: unexpected")
 	}
@@ -27,7 +27,13 @@ func normalizeAddress(addr string) (string, error) {
 		host = "127.0.0.1"
 	}
 
-	return fmt.Sprintf("%s:%s", host, port), nil
+	return net.JoinHostPort(host, port), nil
+}
+
+// isUnixAddr returns true if addr is a Unix domain socket address i.e.
+// "unix:/var/run/app.sock".
+func isUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, "unix:")
 }
 
 func normalizeURL(rawurl string) (string, error) {
@@ -29,6 +29,14 @@ func TestNormalizeAddress(t *testing.T) {
 			addr:     "0.0.0.0:22",
 			expected: "0.0.0.0:22",
 		},
+		{
+			addr:     "[::1]:22",
+			expected: "[::1]:22",
+		},
+		{
+			addr:     "[2001:db8::1]:22",
+			expected: "[2001:db8::1]:22",
+		},
 		{
 			addr:  "0.0.0.0",
 			error: "missing port",
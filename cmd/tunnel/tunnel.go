@@ -13,6 +13,7 @@ import (
 	"net/url"
 	"os"
 	"sort"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 
@@ -26,7 +27,7 @@ import (
 func main() {
 	opts, err := parseArgs()
 	if err != nil {
-		fatal(err.Error())
+		fatal("%s", err)
 	}
 
 	if opts.version {
@@ -89,7 +90,12 @@ func main() {
 		fatal("failed to configure tls: %s", err)
 	}
 
-	b, err := yaml.Marshal(config)
+	// don't log the secret
+	dump := *config
+	if dump.Token != "" {
+		dump.Token = "redacted"
+	}
+	b, err := yaml.Marshal(&dump)
 	if err != nil {
 		fatal("failed to dump config: %s", err)
 	}
@@ -98,9 +104,12 @@ func main() {
 	client, err := tunnel.NewClient(&tunnel.ClientConfig{
 		ServerAddr:      config.ServerAddr,
 		TLSClientConfig: tlsconf,
+		Token:           config.Token,
 		Backoff:         expBackoff(config.Backoff),
 		Tunnels:         tunnels(config.Tunnels),
 		Proxy:           proxy(config.Tunnels, logger),
+		Forwards:        config.Forwards,
+		Compression:     config.Compression,
 		Logger:          logger,
 	})
 	if err != nil {
@@ -158,10 +167,17 @@ func tunnels(m map[string]*Tunnel) map[string]*proto.Tunnel {
 
 	for name, t := range m {
 		p[name] = &proto.Tunnel{
-			Protocol: t.Protocol,
-			Host:     t.Host,
-			Auth:     t.Auth,
-			Addr:     t.RemoteAddr,
+			Protocol:    t.Protocol,
+			Host:        t.Host,
+			Auth:        t.Auth,
+			Addr:        t.RemoteAddr,
+			AppProtocol: t.AppProtocol,
+		}
+		switch t.Protocol {
+		case proto.TCP, proto.TCP4, proto.TCP6, proto.UNIX, proto.SNI:
+			if !isUnixAddr(t.Addr) {
+				p[name].Target = t.Addr
+			}
 		}
 	}
 
@@ -171,6 +187,8 @@ func tunnels(m map[string]*Tunnel) map[string]*proto.Tunnel {
 func proxy(m map[string]*Tunnel, logger log.Logger) tunnel.ProxyFunc {
 	httpURL := make(map[string]*url.URL)
 	tcpAddr := make(map[string]string)
+	tcpProxyProtocol := make(map[string]string)
+	udpAddr := make(map[string]string)
 
 	for _, t := range m {
 		switch t.Protocol {
@@ -179,15 +197,39 @@ func proxy(m map[string]*Tunnel, logger log.Logger) tunnel.ProxyFunc {
 			if err != nil {
 				fatal("invalid tunnel address: %s", err)
 			}
-			httpURL[t.Host] = u
-		case proto.TCP, proto.TCP4, proto.TCP6:
+			// server looks up IPv6 hosts without brackets
+			httpURL[strings.Trim(t.Host, "[]")] = u
+		case proto.TCP, proto.TCP4, proto.TCP6, proto.UNIX:
+			if t.AppProtocol == proto.HTTP {
+				// server sends listener address as the host
+				key := t.RemoteAddr
+				if _, port, err := net.SplitHostPort(t.RemoteAddr); err == nil {
+					key = port
+				}
+				httpURL[key] = &url.URL{Scheme: "http", Host: t.Addr}
+				continue
+			}
 			tcpAddr[t.RemoteAddr] = t.Addr
+			if t.ProxyProtocol != "" {
+				tcpProxyProtocol[t.Addr] = t.ProxyProtocol
+			}
+		case proto.SNI:
+			tcpAddr[strings.Trim(t.Host, "[]")] = t.Addr
+			if t.ProxyProtocol != "" {
+				tcpProxyProtocol[t.Addr] = t.ProxyProtocol
+			}
+		case proto.UDP:
+			udpAddr[t.RemoteAddr] = t.Addr
 		}
 	}
 
+	tcpProxy := tunnel.NewMultiTCPProxy(tcpAddr, log.NewContext(logger).WithPrefix("proxy", "TCP"))
+	tcpProxy.ProxyProtocol = tcpProxyProtocol
+
 	return tunnel.Proxy(tunnel.ProxyFuncs{
 		HTTP: tunnel.NewMultiHTTPProxy(httpURL, log.NewContext(logger).WithPrefix("proxy", "HTTP")).Proxy,
-		TCP:  tunnel.NewMultiTCPProxy(tcpAddr, log.NewContext(logger).WithPrefix("proxy", "TCP")).Proxy,
+		TCP:  tcpProxy.Proxy,
+		UDP:  tunnel.NewMultiUDPProxy(udpAddr, log.NewContext(logger).WithPrefix("proxy", "UDP")).Proxy,
 	})
 }
 
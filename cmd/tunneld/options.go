@@ -37,15 +37,21 @@ func init() {
 
 // options specify arguments read command line arguments.
 type options struct {
-	httpAddr   string
-	httpsAddr  string
-	tunnelAddr string
-	tlsCrt     string
-	tlsKey     string
-	rootCA     string
-	clients    string
-	logLevel   int
-	version    bool
+	httpAddr    string
+	httpsAddr   string
+	tunnelAddr  string
+	tlsCrt      string
+	tlsKey      string
+	rootCA      string
+	clients     string
+	insecure    bool
+	tokens      string
+	logLevel    int
+	logFormat   string
+	compression bool
+	accessLog   string
+	healthAddr  string
+	version     bool
 }
 
 func parseArgs() *options {
@@ -56,19 +62,31 @@ func parseArgs() *options {
 	tlsKey := flag.String("tlsKey", "server.key", "Path to a TLS key file")
 	rootCA := flag.String("rootCA", "", "Path to the trusted certificate chian used for client certificate authentication, if empty any client certificate is accepted")
 	clients := flag.String("clients", "", "Comma-separated list of tunnel client ids, if empty accept all clients")
+	insecure := flag.Bool("insecureControl", false, "Accept tunnel client connections over plain TCP authenticated with tokens, use only behind a TLS terminating load balancer in a trusted network")
+	tokens := flag.String("tokens", "", "Comma-separated list of tunnel client tokens accepted with -insecureControl, if empty and -clients is empty accept all clients")
 	logLevel := flag.Int("log-level", 1, "Level of messages to log, 0-3")
+	logFormat := flag.String("log-format", "text", "Format of log messages, text or json")
+	compression := flag.Bool("compression", false, "Accept gzip compressed HTTP responses from clients")
+	accessLog := flag.String("accessLog", "", "Path to HTTP access log file in Combined Log Format, - for stdout, if empty access log is disabled")
+	healthAddr := flag.String("healthAddr", "", "Address of HTTP health endpoint for orchestration, if empty health endpoint is disabled")
 	version := flag.Bool("version", false, "Prints tunneld version")
 	flag.Parse()
 
 	return &options{
-		httpAddr:   *httpAddr,
-		httpsAddr:  *httpsAddr,
-		tunnelAddr: *tunnelAddr,
-		tlsCrt:     *tlsCrt,
-		tlsKey:     *tlsKey,
-		rootCA:     *rootCA,
-		clients:    *clients,
-		logLevel:   *logLevel,
-		version:    *version,
+		httpAddr:    *httpAddr,
+		httpsAddr:   *httpsAddr,
+		tunnelAddr:  *tunnelAddr,
+		tlsCrt:      *tlsCrt,
+		tlsKey:      *tlsKey,
+		rootCA:      *rootCA,
+		clients:     *clients,
+		insecure:    *insecure,
+		tokens:      *tokens,
+		logLevel:    *logLevel,
+		logFormat:   *logFormat,
+		compression: *compression,
+		accessLog:   *accessLog,
+		healthAddr:  *healthAddr,
+		version:     *version,
 	}
 }
@@ -5,21 +5,28 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
-
-	"golang.org/x/net/http2"
+	"syscall"
+	"time"
 
 	"github.com/mmatczuk/go-http-tunnel"
 	"github.com/mmatczuk/go-http-tunnel/id"
 	"github.com/mmatczuk/go-http-tunnel/log"
 )
 
+// shutdownTimeout is how long running sessions are waited for on shutdown.
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	opts := parseArgs()
 
@@ -28,29 +35,58 @@ func main() {
 		return
 	}
 
-	fmt.Println(banner)
-
-	logger := log.NewFilterLogger(log.NewStdLogger(), opts.logLevel)
+	fmt.Print(banner)
+
+	var logger log.Logger
+	switch opts.logFormat {
+	case "text":
+		logger = log.NewStdLogger()
+	case "json":
+		// level filtering is done by filter logger, pass everything
+		logger = log.NewSlogLogger(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+			Level: slog.LevelDebug - 4,
+		})))
+	default:
+		fatal("unknown log format %q", opts.logFormat)
+	}
+	logger = log.NewFilterLogger(logger, opts.logLevel)
 
 	tlsconf, err := tlsConfig(opts)
 	if err != nil {
 		fatal("failed to configure tls: %s", err)
 	}
 
-	autoSubscribe := opts.clients == ""
+	autoSubscribe := opts.clients == "" && opts.tokens == ""
+
+	var accessLog io.Writer
+	switch opts.accessLog {
+	case "":
+	case "-":
+		accessLog = os.Stdout
+	default:
+		f, err := os.OpenFile(opts.accessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			fatal("failed to open access log: %s", err)
+		}
+		defer f.Close()
+		accessLog = f
+	}
 
 	// setup server
 	server, err := tunnel.NewServer(&tunnel.ServerConfig{
-		Addr:          opts.tunnelAddr,
-		AutoSubscribe: autoSubscribe,
-		TLSConfig:     tlsconf,
-		Logger:        logger,
+		Addr:            opts.tunnelAddr,
+		AutoSubscribe:   autoSubscribe,
+		TLSConfig:       tlsconf,
+		InsecureControl: opts.insecure,
+		Compression:     opts.compression,
+		AccessLog:       accessLog,
+		Logger:          logger,
 	})
 	if err != nil {
 		fatal("failed to create server: %s", err)
 	}
 
-	if !autoSubscribe {
+	if opts.clients != "" {
 		for _, c := range strings.Split(opts.clients, ",") {
 			if c == "" {
 				fatal("empty client id")
@@ -63,40 +99,65 @@ func main() {
 			server.Subscribe(identifier)
 		}
 	}
+	if opts.tokens != "" {
+		for _, t := range strings.Split(opts.tokens, ",") {
+			if t == "" {
+				fatal("empty client token")
+			}
+			server.Subscribe(tunnel.TokenID(t))
+		}
+	}
 
-	// start HTTP
-	if opts.httpAddr != "" {
+	// start health endpoint
+	if opts.healthAddr != "" {
 		go func() {
 			logger.Log(
 				"level", 1,
-				"action", "start http",
-				"addr", opts.httpAddr,
+				"action", "start health",
+				"addr", opts.healthAddr,
 			)
 
-			fatal("failed to start HTTP: %s", http.ListenAndServe(opts.httpAddr, server))
+			fatal("failed to start health endpoint: %s", http.ListenAndServe(opts.healthAddr, server.HealthHandler()))
+		}()
+	}
+
+	// start HTTP
+	if opts.httpAddr != "" {
+		go func() {
+			if err := server.ListenAndServeHTTP(opts.httpAddr, nil); err != nil {
+				fatal("failed to start HTTP: %s", err)
+			}
 		}()
 	}
 
 	// start HTTPS
 	if opts.httpsAddr != "" {
 		go func() {
-			logger.Log(
-				"level", 1,
-				"action", "start https",
-				"addr", opts.httpsAddr,
-			)
-
-			s := &http.Server{
-				Addr:    opts.httpsAddr,
-				Handler: server,
+			config := &tls.Config{
+				Certificates: tlsconf.Certificates,
+			}
+			if err := server.ListenAndServeHTTP(opts.httpsAddr, config); err != nil {
+				fatal("failed to start HTTPS: %s", err)
 			}
-			http2.ConfigureServer(s, nil)
-
-			fatal("failed to start HTTPS: %s", s.ListenAndServeTLS(opts.tlsCrt, opts.tlsKey))
 		}()
 	}
 
-	server.Start()
+	// shut down gracefully on signal
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	go server.Start()
+
+	if err := server.Wait(); err != nil {
+		fatal("shutdown failed: %s", err)
+	}
 }
 
 func tlsConfig(opts *options) (*tls.Config, error) {
@@ -0,0 +1,191 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// compressible returns true if HTTP response with header h is worth
+// compressing, it must be a text based content of unknown length or at least
+// minSize bytes long that is not already compressed.
+func compressible(h http.Header, minSize int64) bool {
+	if e := h.Get("Content-Encoding"); e != "" && e != "identity" {
+		return false
+	}
+	if v := h.Get("Content-Length"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n < minSize {
+			return false
+		}
+	}
+
+	ct, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(ct, "text/") || strings.HasSuffix(ct, "+json") || strings.HasSuffix(ct, "+xml") {
+		return true
+	}
+	switch ct {
+	case "application/json", "application/javascript", "application/xml", "application/x-www-form-urlencoded":
+		return true
+	}
+
+	return false
+}
+
+// compressResponseWriter compresses response body with gzip if response is
+// compressible, compression is signalled to the server with
+// proto.HeaderCompression header. Close must be called when response is
+// written.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	minSize     int64
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func newCompressResponseWriter(w http.ResponseWriter, minSize int64) *compressResponseWriter {
+	if minSize == 0 {
+		minSize = DefaultCompressionMinSize
+	}
+
+	return &compressResponseWriter{
+		ResponseWriter: w,
+		minSize:        minSize,
+	}
+}
+
+func (w *compressResponseWriter) WriteHeader(code int) {
+	// informational responses are followed by the final one
+	if code < http.StatusOK {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	if code != http.StatusNoContent && code != http.StatusNotModified && compressible(h, w.minSize) {
+		h.Set(proto.HeaderCompression, proto.CompressionGzip)
+		h.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.gz.Write(p)
+}
+
+func (w *compressResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close writes remaining compressed data.
+func (w *compressResponseWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
+
+// gzipReadCloser decompresses body, gzip header is read on first Read so that
+// response headers are not delayed until body is sent.
+type gzipReadCloser struct {
+	body io.ReadCloser
+	zr   *gzip.Reader
+	err  error
+}
+
+func (r *gzipReadCloser) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.zr == nil {
+		if r.zr, r.err = gzip.NewReader(r.body); r.err != nil {
+			return 0, r.err
+		}
+	}
+	return r.zr.Read(p)
+}
+
+func (r *gzipReadCloser) Close() error {
+	return r.body.Close()
+}
+
+// decompressResponse replaces body of gzip encoded resp with decompressed
+// body and removes Content-Encoding and Content-Length headers. It returns
+// false and leaves resp intact if resp has no body or is not encoded with
+// gzip alone.
+func decompressResponse(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified || resp.Body == http.NoBody {
+		return false
+	}
+	if e := resp.Header.Values("Content-Encoding"); len(e) != 1 || !strings.EqualFold(strings.TrimSpace(e[0]), "gzip") {
+		return false
+	}
+
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.Body = &gzipReadCloser{body: resp.Body}
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+
+	return true
+}
+
+// recompressResponse sets gzip Content-Encoding of resp decompressed with
+// decompressResponse, it returns false if ModifyResponse already set other
+// encoding.
+func recompressResponse(resp *http.Response) bool {
+	if resp.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+
+	return true
+}
+
+// gzipFlushWriter compresses writes to w, flushing it writes pending
+// compressed data to w and flushes w so that FlushInterval and event streams
+// work with recompressed responses.
+type gzipFlushWriter struct {
+	gz *gzip.Writer
+	w  io.Writer
+}
+
+func (gw gzipFlushWriter) Write(p []byte) (int, error) {
+	return gw.gz.Write(p)
+}
+
+func (gw gzipFlushWriter) Flush() {
+	gw.gz.Flush()
+	if f, ok := gw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
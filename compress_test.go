@@ -0,0 +1,136 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestCompressible(t *testing.T) {
+	t.Parallel()
+
+	table := []struct {
+		header http.Header
+		ok     bool
+	}{
+		{http.Header{"Content-Type": {"text/html; charset=utf-8"}}, true},
+		{http.Header{"Content-Type": {"application/json"}}, true},
+		{http.Header{"Content-Type": {"application/vnd.api+json"}}, true},
+		{http.Header{"Content-Type": {"image/png"}}, false},
+		{http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"gzip"}}, false},
+		{http.Header{"Content-Type": {"text/plain"}, "Content-Length": {"10"}}, false},
+		{http.Header{"Content-Type": {"text/plain"}, "Content-Length": {"2048"}}, true},
+		{http.Header{}, false},
+	}
+
+	for _, tt := range table {
+		if ok := compressible(tt.header, DefaultCompressionMinSize); ok != tt.ok {
+			t.Error(tt.header, "expected", tt.ok, "got", ok)
+		}
+	}
+}
+
+func TestCompressResponseWriter(t *testing.T) {
+	t.Parallel()
+
+	body := strings.Repeat("hello world ", 1000)
+
+	rec := httptest.NewRecorder()
+	w := newCompressResponseWriter(rec, 0)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(body))
+	w.Close()
+
+	if rec.Header().Get(proto.HeaderCompression) != proto.CompressionGzip {
+		t.Fatal("expected compressed response")
+	}
+	if rec.Body.Len() >= len(body) {
+		t.Fatal("expected compressed body to be smaller", rec.Body.Len())
+	}
+
+	r := &gzipReadCloser{body: ioutil.NopCloser(rec.Body)}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != body {
+		t.Fatal("body mismatch")
+	}
+
+	rec = httptest.NewRecorder()
+	w = newCompressResponseWriter(rec, 0)
+	w.Header().Set("Content-Type", "image/png")
+	w.Write([]byte(body))
+	w.Close()
+
+	if rec.Header().Get(proto.HeaderCompression) != "" || rec.Body.String() != body {
+		t.Fatal("expected uncompressed response")
+	}
+}
+
+func TestDecompressResponse(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("hello"))
+	zw.Close()
+
+	table := []struct {
+		status   int
+		encoding []string
+		ok       bool
+	}{
+		{http.StatusOK, []string{"gzip"}, true},
+		{http.StatusOK, []string{"GZIP"}, true},
+		{http.StatusOK, []string{"br"}, false},
+		{http.StatusOK, []string{"gzip", "br"}, false},
+		{http.StatusOK, nil, false},
+		{http.StatusNotModified, []string{"gzip"}, false},
+	}
+
+	for _, tt := range table {
+		resp := &http.Response{
+			StatusCode:    tt.status,
+			Header:        http.Header{"Content-Encoding": tt.encoding, "Content-Length": {strconv.Itoa(buf.Len())}},
+			Body:          ioutil.NopCloser(bytes.NewReader(buf.Bytes())),
+			ContentLength: int64(buf.Len()),
+		}
+		if ok := decompressResponse(resp); ok != tt.ok {
+			t.Errorf("%d %v: got %v, expected %v", tt.status, tt.encoding, ok, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			if len(resp.Header["Content-Encoding"]) != len(tt.encoding) {
+				t.Errorf("%d %v: encoding modified", tt.status, tt.encoding)
+			}
+			continue
+		}
+
+		if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Length") != "" || resp.ContentLength != -1 {
+			t.Errorf("%v: unexpected headers %v", tt.encoding, resp.Header)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "hello" {
+			t.Errorf("%v: unexpected body %q", tt.encoding, b)
+		}
+
+		if !recompressResponse(resp) || resp.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("%v: expected gzip encoding", tt.encoding)
+		}
+	}
+}
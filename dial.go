@@ -0,0 +1,93 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// localBody is body of a proxied session, it carries ClientConfig.LocalDialer
+// to ProxyFuncs.
+type localBody struct {
+	io.ReadCloser
+	dial func(network, addr string) (net.Conn, error)
+}
+
+// localDial connects to local service addr using ClientConfig.LocalDialer
+// carried by session body r, if there is none net.DialTimeout with
+// DefaultTimeout is used.
+func localDial(r io.Reader, network, addr string) (net.Conn, error) {
+	if b, ok := r.(localBody); ok && b.dial != nil {
+		return b.dial(network, addr)
+	}
+	return net.DialTimeout(network, addr, DefaultTimeout)
+}
+
+// localDialer returns dial function carried by session bodies, it's
+// ClientConfig.LocalDialer with TCP_NODELAY cleared if DisableNoDelay is set.
+// If it returns nil default dialing is used.
+func (c *Client) localDialer() func(network, addr string) (net.Conn, error) {
+	dial := c.config.LocalDialer
+	if !c.config.DisableNoDelay {
+		return dial
+	}
+	if dial == nil {
+		dial = func(network, addr string) (net.Conn, error) {
+			return net.DialTimeout(network, addr, DefaultTimeout)
+		}
+	}
+	return func(network, addr string) (net.Conn, error) {
+		conn, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := setNoDelay(conn, false); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+type localDialKey struct{}
+
+// localDialFrom returns dial function carried in ctx or nil, see
+// withLocalDial.
+func localDialFrom(ctx context.Context) func(network, addr string) (net.Conn, error) {
+	dial, _ := ctx.Value(localDialKey{}).(func(network, addr string) (net.Conn, error))
+	return dial
+}
+
+// withLocalDial returns copy of ctx carrying dial function from session body
+// r, if r has none ctx is returned.
+func withLocalDial(ctx context.Context, r io.Reader) context.Context {
+	if b, ok := r.(localBody); ok && b.dial != nil {
+		return context.WithValue(ctx, localDialKey{}, b.dial)
+	}
+	return ctx
+}
+
+// localTransport is http.DefaultTransport that dials local services with the
+// dial function carried in request context.
+var localTransport = newLocalTransport()
+
+func newLocalTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if dial := localDialFrom(ctx); dial != nil {
+			return dial(network, addr)
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+	return t
+}
@@ -0,0 +1,156 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// disconnectedResponse is written in response to ActionDisconnect.
+const disconnectedResponse = "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+
+// newConnToken returns a new disconnect token of a control connection. Client
+// lists tokens of its connections in ActionDisconnect, they identify the
+// connections regardless of addresses seen by either side, i.e. if client is
+// behind NAT or a proxy.
+func newConnToken() string {
+	return newRequestID() + newRequestID()
+}
+
+// sendConnToken sends disconnect token of connection that joined connection
+// pool of the client, it's sent with a ping over that connection. The first
+// connection of the client gets its token with the handshake request.
+func (s *Server) sendConnToken(identifier id.ID, token string) error {
+	c := s.connPool.ClientConnToken(identifier, token)
+	if c == nil {
+		return errClientNotConnected
+	}
+
+	req, err := s.connectRequest(identifier, &proto.ControlMessage{Action: proto.ActionPing}, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(proto.HeaderConnToken, token)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.handshakeTimeout)
+	defer cancel()
+
+	resp, err := c.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// serveDisconnect handles ActionDisconnect sent by stopping client, it closes
+// the control connections issued tokens listed in message Target so that the
+// client is deregistered right away. Other connections of the identifier, i.e.
+// of another client process sharing the certificate, are left intact. The
+// client may be already gone i.e. evicted as idle, that is not an error,
+// connection pool frees the client only once.
+func (s *Server) serveDisconnect(conn net.Conn, identifier id.ID, msg *proto.ControlMessage, logger log.Logger) {
+	logger.Log(
+		"level", 1,
+		"action", "client disconnect",
+	)
+
+	// client closes control connection when it gets the response, the
+	// response is sent first so that client does not see it as broken
+	io.WriteString(conn, disconnectedResponse)
+	if msg.Target != "" {
+		s.connPool.DeleteConnToken(identifier, strings.Split(msg.Target, ",")...)
+	}
+}
+
+// connHandler returns handler of requests sent over control connection conn,
+// it records disconnect token server issued for the connection.
+func (c *Client) connHandler(conn net.Conn) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := r.Header.Get(proto.HeaderConnToken); token != "" {
+			c.setConnToken(conn, token)
+		}
+		c.serveHTTP(w, r)
+	})
+}
+
+// setConnToken records disconnect token of conn if it's still open.
+func (c *Client) setConnToken(conn net.Conn, token string) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	open := conn == c.conn
+	for _, v := range c.pool {
+		open = open || v == conn
+	}
+	if !open {
+		return
+	}
+	if c.tokens == nil {
+		c.tokens = make(map[net.Conn]string)
+	}
+	c.tokens[conn] = token
+}
+
+// disconnectTimeout is the maximal time Stop waits for server to confirm
+// disconnect, server detects the closed connections anyway.
+const disconnectTimeout = time.Second
+
+// disconnect tells server that client is stopping, tokens are disconnect
+// tokens of the control connections to close. It must be called while the
+// connections are still open and without connMu held, it gives up after
+// disconnectTimeout.
+func (c *Client) disconnect(tokens []string) {
+	msg := &proto.ControlMessage{
+		Action:    proto.ActionDisconnect,
+		RequestID: newRequestID(),
+		Target:    strings.Join(tokens, ","),
+	}
+	logger := log.NewContext(c.logger).With("requestID", msg.RequestID)
+
+	done := make(chan error, 1)
+	go func() {
+		server, err := c.dialOnce()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer server.Close()
+
+		_, err = c.forwardHandshake(server, msg)
+		done <- err
+	}()
+
+	t := time.NewTimer(disconnectTimeout)
+	defer t.Stop()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-t.C:
+		err = errDisconnectTimeout
+	}
+	if err != nil {
+		logger.Log(
+			"level", 1,
+			"msg", "disconnect failed",
+			"err", err,
+		)
+	}
+}
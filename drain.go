@@ -0,0 +1,135 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// DrainClient asks client to stop accepting new sessions, finish the
+// in-flight ones and reconnect, it waits for the client to finish. The drain
+// request is sent over every control connection of the client so that all
+// client processes sharing the identifier drain. While the connections drain
+// new requests are routed to other connections and clients serving the host,
+// if there are none requests wait up to DialWait for the client to reconnect.
+func (s *Server) DrainClient(identifier id.ID) error {
+	if !s.connPool.IsConnected(identifier) {
+		return errClientNotConnected
+	}
+
+	return s.drain(identifier, s.connPool.Drain(identifier))
+}
+
+// drain sends drain request over conns marked as draining, if it fails the
+// draining marks are cleared. Connections that went away or were shut down
+// by client while draining over another connection count as drained.
+func (s *Server) drain(identifier id.ID, conns []*http2.ClientConn) error {
+	s.logger.Log(
+		"level", 1,
+		"action", "drain",
+		"identifier", identifier,
+		"conns", len(conns),
+	)
+
+	errs := make([]error, len(conns))
+	var wg sync.WaitGroup
+	for i, c := range conns {
+		wg.Add(1)
+		go func(i int, c *http2.ClientConn) {
+			defer wg.Done()
+			errs[i] = s.drainConn(identifier, c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			s.connPool.Undrain(conns)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) drainConn(identifier id.ID, c *http2.ClientConn) error {
+	msg := &proto.ControlMessage{
+		Action: proto.ActionDrain,
+	}
+	req, err := s.connectRequest(identifier, msg, nil)
+	if err != nil {
+		return fmt.Errorf("drain request error: %s", err)
+	}
+
+	resp, err := c.RoundTrip(req)
+	if err != nil {
+		if !c.CanTakeNewRequest() {
+			return nil
+		}
+		return fmt.Errorf("drain failed: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("drain failed: status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// routable returns true if client has a connection that is not draining, it's
+// used to select clients for new requests.
+func (s *Server) routable(identifier id.ID) bool {
+	return s.connPool.IsRoutable(identifier)
+}
+
+// startSession registers a new session unless client is draining.
+func (c *Client) startSession() bool {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	if c.draining {
+		return false
+	}
+	c.sessions.Add(1)
+	atomic.AddInt64(&c.activeSessions, 1)
+	atomic.AddInt64(&c.totalSessions, 1)
+	return true
+}
+
+// endSession marks end of a session registered with startSession.
+func (c *Client) endSession() {
+	atomic.AddInt64(&c.activeSessions, -1)
+	c.sessions.Done()
+}
+
+// handleDrain stops accepting new sessions, waits for the in-flight ones and
+// gracefully closes the connection so that the client reconnects.
+func (c *Client) handleDrain(w http.ResponseWriter) {
+	c.connMu.Lock()
+	c.draining = true
+	c.connMu.Unlock()
+
+	c.logger.Log(
+		"level", 1,
+		"action", "drain",
+	)
+
+	c.sessions.Wait()
+
+	w.WriteHeader(http.StatusOK)
+
+	// connection is closed once the drain response is sent
+	c.drainServer.Shutdown(context.Background())
+}
@@ -4,12 +4,137 @@
 
 package tunnel
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+)
 
 var (
 	errClientNotSubscribed    = errors.New("client not subscribed")
 	errClientNotConnected     = errors.New("client not connected")
 	errClientAlreadyConnected = errors.New("client already connected")
+	errServerShutdown         = errors.New("server is shutting down")
+	errTooManyConns           = errors.New("too many connections")
+	errUnhealthy              = errors.New("local service unhealthy")
+	errClientDraining         = errors.New("client draining")
+	errProxyTimeout           = fmt.Errorf("proxy timeout: %w", context.DeadlineExceeded)
+	errResponseHeaderTimeout  = fmt.Errorf("timeout awaiting response headers: %w", context.DeadlineExceeded)
+	errSlowConsumer           = errors.New("slow consumer, write stalled")
+	errDisconnectTimeout      = fmt.Errorf("disconnect timeout: %w", context.DeadlineExceeded)
+
+	errUnauthorised        = errors.New("unauthorised")
+	errTunnelNotFound      = errors.New("tunnel not found")
+	errRequestTooLarge     = errors.New("request too large")
+	errUpgradeNotSupported = errors.New("protocol upgrade not supported")
+	errConnectNotSupported = errors.New("CONNECT not supported")
+	errForwardNotAllowed   = errors.New("forward target not allowed")
+	errMissingToken        = errors.New("missing token")
+	errClientElsewhere     = errors.New("client connected to another instance")
+	errPeerLoop            = errors.New("request already proxied by another instance")
+
+	errMissingGetCertificate = errors.New("missing GetCertificate")
+	errEarlyData             = errors.New("TLS early data not supported")
+	errNilDataListener       = errors.New("DataListener returned nil")
+
+	errOverloaded = errors.New("server overloaded")
+)
+
+// Proxy error operations.
+const (
+	// OpRequest is creation of request sent to the client.
+	OpRequest = "request"
+	// OpDial is obtaining control connection of the client to send request
+	// over, it fails if client is not connected or none of its connections
+	// can take a new request.
+	OpDial = "dial"
+	// OpRoundTrip is sending request to the client and receiving response
+	// headers.
+	OpRoundTrip = "io"
+	// OpCopy is copying data between user and client.
+	OpCopy = "copy"
+	// OpHealthCheck is client health check of the local service.
+	OpHealthCheck = "health check"
+	// OpModifyResponse is ServerConfig.ModifyResponse call.
+	OpModifyResponse = "modify response"
+	// OpHandshake is control handshake of a connecting client.
+	OpHandshake = "handshake"
+)
 
-	errUnauthorised = errors.New("unauthorised")
+// Phase is the phase of proxying a ProxyError occurred in, it allows for
+// deciding whether to retry or which status to respond with without
+// inspecting Op and Dir. Local is the server side of the proxied session,
+// that is the user, remote is the client.
+type Phase int
+
+// Proxy phases.
+const (
+	// PhaseDial is obtaining control connection of the client, see OpDial.
+	PhaseDial Phase = iota + 1
+	// PhaseHandshake is control handshake of a connecting client, see
+	// OpHandshake.
+	PhaseHandshake
+	// PhaseRequestCreate is creation of request sent to the client, see
+	// OpRequest.
+	PhaseRequestCreate
+	// PhaseRoundTrip is sending request to the client and receiving response
+	// headers, see OpRoundTrip, OpHealthCheck and OpModifyResponse.
+	PhaseRoundTrip
+	// PhaseCopyLocalToRemote is copying data from user to client, see OpCopy
+	// with DirUserToClient.
+	PhaseCopyLocalToRemote
+	// PhaseCopyRemoteToLocal is copying data from client to user, see OpCopy
+	// with DirClientToUser.
+	PhaseCopyRemoteToLocal
 )
+
+var phaseText = map[Phase]string{
+	PhaseDial:              "dial",
+	PhaseHandshake:         "handshake",
+	PhaseRequestCreate:     "request create",
+	PhaseRoundTrip:         "round trip",
+	PhaseCopyLocalToRemote: "copy local to remote",
+	PhaseCopyRemoteToLocal: "copy remote to local",
+}
+
+func (p Phase) String() string {
+	if t, ok := phaseText[p]; ok {
+		return t
+	}
+	return fmt.Sprintf("Phase(%d)", int(p))
+}
+
+// ProxyError describes failure of proxying a connection or HTTP request.
+type ProxyError struct {
+	// Op is the failed operation, one of OpRequest, OpDial, OpRoundTrip,
+	// OpCopy, OpHealthCheck, OpModifyResponse, OpHandshake.
+	Op string
+	// Phase is the phase the operation belongs to.
+	Phase Phase
+	// Dir is transfer direction for OpCopy errors, DirUserToClient or
+	// DirClientToUser.
+	Dir string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *ProxyError) Error() string {
+	if e.Dir != "" {
+		return fmt.Sprintf("%s error (%s): %s", e.Op, e.Dir, e.Err)
+	}
+	return fmt.Sprintf("%s error: %s", e.Op, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// roundTripError wraps err of sending request to the client, failures to get
+// a control connection are reported as OpDial and other failures as
+// OpRoundTrip.
+func roundTripError(err error) error {
+	if errors.Is(err, errClientNotConnected) {
+		return &ProxyError{Op: OpDial, Phase: PhaseDial, Err: err}
+	}
+	return &ProxyError{Op: OpRoundTrip, Phase: PhaseRoundTrip, Err: err}
+}
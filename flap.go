@@ -0,0 +1,78 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+// recordConnect records connection of client, if the client starts flapping
+// OnClientFlapping is invoked.
+func (s *Server) recordConnect(identifier id.ID) {
+	if s.config.FlapThreshold <= 0 {
+		return
+	}
+
+	now := time.Now()
+	s.connectsMu.Lock()
+	ts := append(s.pruneConnects(identifier, now), now)
+	s.connects[identifier] = ts
+	s.connectsMu.Unlock()
+
+	n := len(ts)
+
+	if n != s.config.FlapThreshold {
+		return
+	}
+
+	s.logger.Log(
+		"level", 1,
+		"action", "flapping",
+		"identifier", identifier,
+		"connects", n,
+	)
+
+	if s.config.OnClientFlapping != nil {
+		go s.config.OnClientFlapping(identifier, n)
+	}
+}
+
+// ClientFlapping returns true if client connected FlapThreshold or more times
+// within FlapWindow, it's always false if FlapThreshold is not set.
+func (s *Server) ClientFlapping(identifier id.ID) bool {
+	if s.config.FlapThreshold <= 0 {
+		return false
+	}
+
+	s.connectsMu.Lock()
+	defer s.connectsMu.Unlock()
+
+	return len(s.pruneConnects(identifier, time.Now())) >= s.config.FlapThreshold
+}
+
+// pruneConnects removes connections of client older than FlapWindow and returns the
+// remaining ones, it must be called with connectsMu held.
+func (s *Server) pruneConnects(identifier id.ID, now time.Time) []time.Time {
+	window := s.config.FlapWindow
+	if window == 0 {
+		window = DefaultFlapWindow
+	}
+
+	ts := s.connects[identifier]
+	i := 0
+	for i < len(ts) && now.Sub(ts[i]) >= window {
+		i++
+	}
+	ts = ts[i:]
+
+	if len(ts) == 0 {
+		delete(s.connects, identifier)
+	} else {
+		s.connects[identifier] = ts
+	}
+	return ts
+}
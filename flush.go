@@ -0,0 +1,101 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// flushingWriter returns writer of resp body to w flushing according to
+// ServerConfig.FlushInterval, stop must be called when the copy is done.
+func (s *Server) flushingWriter(w io.Writer, resp *http.Response) (io.Writer, func()) {
+	interval := s.config.FlushInterval
+	if isEventStream(resp.Header) {
+		interval = -1
+	}
+
+	switch {
+	case interval == 0:
+		return w, func() {}
+	case interval < 0:
+		return flushWriter{w}, func() {}
+	}
+
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return w, func() {}
+	}
+	lw := &latencyWriter{
+		w:        w,
+		f:        f,
+		interval: interval,
+	}
+	return lw, lw.stop
+}
+
+// isEventStream returns true if h has Content-Type of server-sent events.
+func isEventStream(h http.Header) bool {
+	t, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return t == "text/event-stream"
+}
+
+// latencyWriter flushes data written to w at most interval after it's
+// written.
+type latencyWriter struct {
+	w        io.Writer
+	f        http.Flusher
+	interval time.Duration
+
+	mu      sync.Mutex
+	t       *time.Timer
+	pending bool
+}
+
+func (lw *latencyWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	n, err := lw.w.Write(p)
+	if lw.pending {
+		return n, err
+	}
+	lw.pending = true
+	if lw.t == nil {
+		lw.t = time.AfterFunc(lw.interval, lw.flush)
+	} else {
+		lw.t.Reset(lw.interval)
+	}
+	return n, err
+}
+
+func (lw *latencyWriter) flush() {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	// stopped or already flushed
+	if !lw.pending {
+		return
+	}
+	lw.f.Flush()
+	lw.pending = false
+}
+
+// stop stops the flush timer, pending data is flushed.
+func (lw *latencyWriter) stop() {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	if lw.t != nil {
+		lw.t.Stop()
+	}
+	if lw.pending {
+		lw.f.Flush()
+		lw.pending = false
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flushRecorder counts flushes, it's safe for concurrent use with writes.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes int32
+}
+
+func (r *flushRecorder) Flush() {
+	atomic.AddInt32(&r.flushes, 1)
+}
+
+func (r *flushRecorder) flushed() bool {
+	return atomic.LoadInt32(&r.flushes) > 0
+}
+
+func TestServer_FlushingWriter(t *testing.T) {
+	table := []struct {
+		interval    time.Duration
+		contentType string
+		flushed     bool
+	}{
+		{0, "text/plain", false},
+		{-1, "text/plain", true},
+		{0, "text/event-stream; charset=utf-8", true},
+		{time.Millisecond, "text/plain", true},
+	}
+
+	for _, tt := range table {
+		s, err := NewServer(&ServerConfig{
+			TLSConfig:     &tls.Config{},
+			FlushInterval: tt.interval,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp := &http.Response{
+			Header: http.Header{"Content-Type": {tt.contentType}},
+		}
+		w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		dst, stop := s.flushingWriter(w, resp)
+		dst.Write([]byte("data"))
+		time.Sleep(50 * time.Millisecond)
+
+		if w.flushed() != tt.flushed {
+			t.Errorf("%v %s: flushed %v, expected %v", tt.interval, tt.contentType, w.flushed(), tt.flushed)
+		}
+		stop()
+		s.Stop()
+	}
+}
+
+func TestLatencyWriter_Stop(t *testing.T) {
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	lw := &latencyWriter{
+		w:        w,
+		f:        w,
+		interval: time.Hour,
+	}
+	lw.Write([]byte("data"))
+	if w.flushed() {
+		t.Fatal("Unexpected flush")
+	}
+	lw.stop()
+	if !w.flushed() {
+		t.Fatal("Expected flush on stop")
+	}
+}
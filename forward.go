@@ -0,0 +1,289 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// Reverse port forwarding is the opposite of tunnels, connections accepted by
+// client side listeners are forwarded to addresses reachable from the server.
+// Control connections cannot carry such connections since client is HTTP/2
+// server there, instead client dials the server for every connection and
+// sends ActionForward control message in a HTTP/1.1 request. Server responds
+// 200 and from then on the connection carries raw data.
+
+// forwardRequestPrefix is the beginning of request sent by client on
+// forwarded connection, it distinguishes the connection from control
+// connections where client starts with HTTP/2 SETTINGS frame.
+const forwardRequestPrefix = "PUT "
+
+// serveForward handles connection forwarded from client side listener, it
+// dials control message target and copies data between the connections.
+// ActionDisconnect messages sent the same way are passed to serveDisconnect.
+func (s *Server) serveForward(conn net.Conn, br *bufio.Reader, identifier id.ID, logger *log.Context) {
+	defer conn.Close()
+
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		logger.Log(
+			"level", 2,
+			"msg", "reading forward request failed",
+			"err", err,
+		)
+		return
+	}
+	req.RemoteAddr = conn.RemoteAddr().String()
+
+	msg, err := proto.ReadControlMessage(req)
+	if err == nil && msg.Action == proto.ActionDisconnect {
+		s.serveDisconnect(conn, identifier, msg, logger)
+		return
+	}
+	if err == nil && msg.Action != proto.ActionForward {
+		err = fmt.Errorf("unexpected action %q", msg.Action)
+	}
+	if err != nil {
+		s.rejectForward(conn, http.StatusBadRequest, err, logger)
+		return
+	}
+
+	logger = logger.With("ctrlMsg", msg)
+
+	if !s.forwardAllowed(identifier, msg.Target) {
+		s.rejectForward(conn, http.StatusForbidden, errForwardNotAllowed, logger)
+		return
+	}
+	if s.shedLoad() {
+		s.rejectForward(conn, http.StatusServiceUnavailable, errOverloaded, logger)
+		return
+	}
+	if !s.startSession() {
+		s.rejectForward(conn, http.StatusServiceUnavailable, errServerShutdown, logger)
+		return
+	}
+	defer s.endSession()
+
+	target, err := net.DialTimeout("tcp", msg.Target, DefaultTimeout)
+	if err != nil {
+		s.rejectForward(conn, http.StatusBadGateway, err, logger)
+		return
+	}
+	defer target.Close()
+
+	if _, err := io.WriteString(conn, connectionEstablishedResponse); err != nil {
+		return
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		logger.Log(
+			"level", 2,
+			"msg", "setting infinite deadline failed",
+			"err", err,
+		)
+		return
+	}
+
+	logger.Log(
+		"level", 2,
+		"action", "forward conn",
+	)
+
+	// ctx is canceled when either side closes or server stops
+	ctx, cancel := s.sessionContext(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	go closeOnDone(ctx, conn)
+	go closeOnDone(ctx, target)
+
+	go func() {
+		s.transfer(target, br, logger.With(
+			"dst", msg.Target,
+			"src", conn.RemoteAddr(),
+		))
+		cancel()
+	}()
+
+	s.transfer(conn, target, logger.With(
+		"dst", conn.RemoteAddr(),
+		"src", msg.Target,
+	))
+	cancel()
+
+	logger.Log(
+		"level", 2,
+		"action", "forward conn done",
+	)
+}
+
+// rejectForward responds to forward request with error.
+func (s *Server) rejectForward(conn net.Conn, code int, err error, logger log.Logger) {
+	atomic.AddInt64(&s.failedSessions, 1)
+
+	logger.Log(
+		"level", 1,
+		"msg", "forward rejected",
+		"err", err,
+	)
+
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%s: %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+		code, http.StatusText(code), proto.HeaderError, err)
+}
+
+// listenForwards opens client side listeners of ClientConfig.Forwards, it
+// does nothing if they are already open.
+func (c *Client) listenForwards() error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	if c.listeners != nil || len(c.config.Forwards) == 0 {
+		return nil
+	}
+
+	for addr, target := range c.config.Forwards {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range c.listeners {
+				l.Close()
+			}
+			c.listeners = nil
+			return fmt.Errorf("forward listener failed: %s", err)
+		}
+
+		c.logger.Log(
+			"level", 1,
+			"action", "open forward listener",
+			"addr", l.Addr(),
+			"target", target,
+		)
+
+		c.listeners = append(c.listeners, l)
+		go c.forward(l, target)
+	}
+
+	return nil
+}
+
+// forward accepts connections on l and forwards them to server side target.
+func (c *Client) forward(l net.Listener, target string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				c.logger.Log(
+					"level", 0,
+					"msg", "accept of forwarded connection failed",
+					"addr", l.Addr(),
+					"err", err,
+				)
+			}
+			return
+		}
+		go c.forwardConn(conn, target)
+	}
+}
+
+func (c *Client) forwardConn(conn net.Conn, target string) {
+	defer conn.Close()
+
+	msg := &proto.ControlMessage{
+		Action:         proto.ActionForward,
+		ForwardedFor:   conn.RemoteAddr().String(),
+		ForwardedHost:  conn.LocalAddr().String(),
+		ForwardedProto: proto.TCP,
+		RequestID:      newRequestID(),
+		Target:         target,
+	}
+	logger := log.NewContext(c.logger).With("requestID", msg.RequestID, "ctrlMsg", msg)
+
+	server, err := c.dialOnce()
+	if err != nil {
+		return
+	}
+	defer server.Close()
+
+	br, err := c.forwardHandshake(server, msg)
+	if err != nil {
+		logger.Log(
+			"level", 0,
+			"msg", "forward failed",
+			"err", err,
+		)
+		return
+	}
+
+	logger.Log(
+		"level", 2,
+		"action", "forward conn",
+	)
+
+	done := make(chan struct{})
+	go func() {
+		transfer(server, conn, logger.With(
+			"dst", target,
+			"src", msg.ForwardedFor,
+		))
+		server.Close()
+		close(done)
+	}()
+
+	transfer(conn, br, logger.With(
+		"dst", msg.ForwardedFor,
+		"src", target,
+	))
+	conn.Close()
+
+	<-done
+
+	logger.Log(
+		"level", 2,
+		"action", "forward conn done",
+	)
+}
+
+// forwardHandshake sends forward request to server and reads the response, it
+// returns reader of data sent by server.
+func (c *Client) forwardHandshake(server net.Conn, msg *proto.ControlMessage) (*bufio.Reader, error) {
+	if err := server.SetDeadline(time.Now().Add(DefaultTimeout)); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprint("https://", c.config.ServerAddr, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	msg.WriteToHeader(req.Header)
+	if err := req.Write(server); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(server)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, resp.Header.Get(proto.HeaderError))
+	}
+
+	return br, server.SetDeadline(time.Time{})
+}
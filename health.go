@@ -0,0 +1,61 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Health is the body of HealthHandler response.
+type Health struct {
+	// Connected is number of connected clients.
+	Connected int `json:"connected"`
+	// TotalClients is number of subscribed clients.
+	TotalClients int `json:"total_clients"`
+}
+
+// HealthHandler returns handler reporting server health, it responds 200 with
+// Health encoded as JSON, during shutdown or after the server is stopped it
+// responds 503. The handler is meant to be served on a separate admin
+// listener.
+func (s *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var h Health
+		for _, c := range s.Clients() {
+			h.TotalClients++
+			if c.Connected {
+				h.Connected++
+			}
+		}
+
+		code := http.StatusOK
+		if !s.healthy() {
+			code = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(h)
+	})
+}
+
+// healthy returns false if server is shutting down or stopped.
+func (s *Server) healthy() bool {
+	s.sessionsMu.Lock()
+	shutdown := s.shutdown
+	s.sessionsMu.Unlock()
+	if shutdown {
+		return false
+	}
+
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
@@ -7,6 +7,7 @@ package tunnel
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"io"
 	"net"
 	"net/http"
@@ -29,6 +30,7 @@ type HTTPProxy struct {
 	// * host and port
 	// * port
 	// * host
+	// * wildcard host i.e. "*.example.com", the most specific first
 	localURLMap map[string]*url.URL
 	// logger is the proxy logger.
 	logger log.Logger
@@ -46,6 +48,8 @@ func NewHTTPProxy(localURL *url.URL, logger log.Logger) *HTTPProxy {
 		logger:   logger,
 	}
 	p.ReverseProxy.Director = p.Director
+	p.ReverseProxy.ErrorHandler = p.ErrorHandler
+	p.ReverseProxy.Transport = localTransport
 
 	return p
 }
@@ -62,6 +66,8 @@ func NewMultiHTTPProxy(localURLMap map[string]*url.URL, logger log.Logger) *HTTP
 		logger:      logger,
 	}
 	p.ReverseProxy.Director = p.Director
+	p.ReverseProxy.ErrorHandler = p.ErrorHandler
+	p.ReverseProxy.Transport = localTransport
 
 	return p
 }
@@ -87,9 +93,11 @@ func (p *HTTPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessag
 			"msg", "expected http.ResponseWriter",
 			"ctrlMsg", msg,
 		)
+		return
 	}
 
-	req, err := http.ReadRequest(bufio.NewReader(r))
+	br := bufio.NewReader(r)
+	req, err := http.ReadRequest(br)
 	if err != nil {
 		p.logger.Log(
 			"level", 0,
@@ -97,15 +105,151 @@ func (p *HTTPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessag
 			"ctrlMsg", msg,
 			"err", err,
 		)
+		http.Error(rw, "failed to read request", http.StatusBadGateway)
 		return
 	}
 
 	setXForwardedFor(req.Header, msg.RemoteAddr)
+	// local service spans are children of the server session span
+	if msg.TraceParent != "" {
+		req.Header.Set(proto.HeaderTraceParent, msg.TraceParent)
+	}
 	req.URL.Host = msg.ForwardedHost
+	ctx := withLocalDial(req.Context(), r)
+	if msg.RequestID != "" {
+		ctx = WithRequestID(ctx, msg.RequestID)
+	}
+	req = req.WithContext(ctx)
+
+	if isUpgrade(req.Header) {
+		p.proxyUpgrade(w, br, req, msg)
+		return
+	}
+
+	if p.localURLFor(req.URL) == nil {
+		p.logger.Log(
+			"level", 1,
+			"msg", "no target",
+			"ctrlMsg", msg,
+		)
+		http.Error(rw, "no target", http.StatusBadGateway)
+		return
+	}
 
 	p.ServeHTTP(rw, req)
 }
 
+// ErrorHandler is ReverseProxy ErrorHandler, it responds with 504 Gateway
+// Timeout if local service timed out and 502 Bad Gateway otherwise.
+func (p *HTTPProxy) ErrorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	p.logger.Log(
+		"level", 1,
+		"msg", "proxy error",
+		"url", req.URL,
+		"err", err,
+	)
+
+	status := errorStatus(err)
+	http.Error(w, http.StatusText(status), status)
+}
+
+// proxyUpgrade sends protocol upgrade request i.e. WebSocket to the local
+// service and transfers raw stream in both directions, the response
+// including status line and headers is written to w as is.
+func (p *HTTPProxy) proxyUpgrade(w io.Writer, r io.Reader, req *http.Request, msg *proto.ControlMessage) {
+	if p.localURLFor(req.URL) == nil {
+		p.logger.Log(
+			"level", 1,
+			"msg", "no target",
+			"ctrlMsg", msg,
+		)
+		io.WriteString(w, badGatewayResponse)
+		return
+	}
+	p.Director(req)
+
+	local, err := dialURL(req.Context(), req.URL)
+	if err != nil {
+		p.logger.Log(
+			"level", 0,
+			"msg", "dial failed",
+			"target", req.URL.Host,
+			"ctrlMsg", msg,
+			"err", err,
+		)
+		io.WriteString(w, badGatewayResponse)
+		return
+	}
+	defer local.Close()
+
+	if err := req.Write(local); err != nil {
+		p.logger.Log(
+			"level", 0,
+			"msg", "write failed",
+			"target", req.URL.Host,
+			"ctrlMsg", msg,
+			"err", err,
+		)
+		io.WriteString(w, badGatewayResponse)
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		transfer(local, r, log.NewContext(p.logger).With(
+			"dst", req.URL.Host,
+			"src", msg.ForwardedHost,
+		))
+		closeWrite(local)
+		close(done)
+	}()
+
+	transfer(flushWriter{w}, local, log.NewContext(p.logger).With(
+		"dst", msg.ForwardedHost,
+		"src", req.URL.Host,
+	))
+	local.Close()
+	<-done
+}
+
+// badGatewayResponse is written instead of upgrade response if local service
+// cannot be reached.
+const badGatewayResponse = "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+
+// dialURL connects to host of u using TLS for https and wss schemes, it uses
+// dial function carried in ctx.
+func dialURL(ctx context.Context, u *url.URL) (net.Conn, error) {
+	host := u.Host
+	secure := u.Scheme == proto.HTTPS || u.Scheme == "wss"
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if secure {
+			host = net.JoinHostPort(host, "443")
+		} else {
+			host = net.JoinHostPort(host, "80")
+		}
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if dial := localDialFrom(ctx); dial != nil {
+		conn, err = dial("tcp", host)
+	} else {
+		conn, err = net.DialTimeout("tcp", host, DefaultTimeout)
+	}
+	if err != nil || !secure {
+		return conn, err
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
 // Director is ReverseProxy Director it changes request URL so that the request
 // is correctly routed based on localURL and localURLMap. If no URL can be found
 // the request is canceled.
@@ -174,14 +318,17 @@ func (p *HTTPProxy) localURLFor(u *url.URL) *url.URL {
 	}
 
 	// try port
-	host, port, _ := net.SplitHostPort(hostPort)
+	_, port, _ := net.SplitHostPort(hostPort)
 	if addr := p.localURLMap[port]; addr != nil {
 		return addr
 	}
 
-	// try host
-	if addr := p.localURLMap[host]; addr != nil {
-		return addr
+	// try host and wildcard patterns matching host
+	host := trimPort(hostPort)
+	for _, pattern := range hostPatterns(host) {
+		if addr := p.localURLMap[pattern]; addr != nil {
+			return addr
+		}
 	}
 
 	return p.localURL
@@ -0,0 +1,96 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// acmeTLSProto is the ALPN protocol of ACME TLS-ALPN-01 challenges.
+const acmeTLSProto = "acme-tls/1"
+
+// HTTPSServer returns HTTPS server serving users on addr with certificates
+// from ServerConfig.GetCertificate, it's started with ListenAndServeTLS("",
+// ""). ACME TLS-ALPN-01 challenges are accepted so that autocert.Manager can
+// get certificates without a separate HTTP listener.
+func (s *Server) HTTPSServer(addr string) (*http.Server, error) {
+	if s.config.GetCertificate == nil {
+		return nil, errMissingGetCertificate
+	}
+
+	return &http.Server{
+		Addr:    addr,
+		Handler: s,
+		TLSConfig: &tls.Config{
+			GetCertificate: s.config.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1", acmeTLSProto},
+			MinVersion:     tls.VersionTLS12,
+		},
+		ReadHeaderTimeout: DefaultTimeout,
+	}, nil
+}
+
+// ListenAndServeHTTP serves users on addr, the public front end routes
+// requests to clients connected to the control listener of the server. If
+// tlsConfig is nil plain HTTP is served, otherwise HTTPS with HTTP/2 support,
+// tlsConfig must specify certificates. Control connections require client
+// certificates so addr must differ from ServerConfig.Addr. It returns nil
+// after the server is stopped, on Shutdown running requests are allowed to
+// finish.
+func (s *Server) ListenAndServeHTTP(addr string, tlsConfig *tls.Config) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: DefaultTimeout,
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Log(
+		"level", 1,
+		"action", "start http",
+		"addr", l.Addr(),
+		"tls", tlsConfig != nil,
+	)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.Done():
+			srv.Shutdown(context.Background())
+		case <-done:
+		}
+	}()
+
+	if tlsConfig != nil {
+		err = srv.ServeTLS(l, "", "")
+	} else {
+		err = srv.Serve(l)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// HostPolicy allows only hosts served by clients, connected to this or other
+// instance, it has the signature of autocert.HostPolicy. Clients with wildcard
+// hosts allow all matching hosts.
+func (s *Server) HostPolicy(ctx context.Context, host string) error {
+	if s.hasHost(host) || s.elsewhere(host) != nil {
+		return nil
+	}
+	return fmt.Errorf("host %q not served by any client", host)
+}
@@ -0,0 +1,49 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"errors"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+var errEmptyIdentity = errors.New("empty identity")
+
+// IdentityID returns identifier of client with identity returned by
+// ServerConfig.IdentityFunc, it's used with Server methods taking an
+// identifier i.e. Revoke.
+func IdentityID(identity string) id.ID {
+	return id.New([]byte(identity))
+}
+
+// identifier returns ID of the client or, if not set, identifier derived from
+// Identity.
+func (c *AllowedClient) identifier() id.ID {
+	var zero id.ID
+	if c.ID == zero && c.Identity != "" {
+		return IdentityID(c.Identity)
+	}
+	return c.ID
+}
+
+// peerID returns identifier of client connected over conn, see
+// ServerConfig.IdentityFunc.
+func (s *Server) peerID(conn *tls.Conn) (id.ID, error) {
+	if s.config.IdentityFunc == nil {
+		return id.PeerID(conn)
+	}
+
+	identity, err := s.config.IdentityFunc(conn)
+	if err != nil {
+		return id.ID{}, err
+	}
+	if identity == "" {
+		return id.ID{}, errEmptyIdentity
+	}
+
+	return IdentityID(identity), nil
+}
@@ -26,5 +26,10 @@ var (
 )
 
 func keepAlive(conn net.Conn) error {
-	return tcpkeepalive.SetKeepAlive(conn, DefaultKeepAliveIdleTime, DefaultKeepAliveCount, DefaultKeepAliveInterval)
+	return keepAliveIdle(conn, DefaultKeepAliveIdleTime)
+}
+
+// keepAliveIdle is like keepAlive but it allows to set idle time.
+func keepAliveIdle(conn net.Conn, idle time.Duration) error {
+	return tcpkeepalive.SetKeepAlive(conn, idle, DefaultKeepAliveCount, DefaultKeepAliveInterval)
 }
@@ -0,0 +1,97 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// keepAliveIdleTime returns SO_KEEPALIVE and TCP_KEEPIDLE of conn.
+func keepAliveIdleTime(t *testing.T, conn *net.TCPConn) (bool, time.Duration) {
+	sc, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var on, idle int
+	var serr error
+	if err := sc.Control(func(fd uintptr) {
+		if on, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); serr != nil {
+			return
+		}
+		idle, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return on != 0, time.Duration(idle) * time.Second
+}
+
+func TestServer_keepAlive(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	dial := func() *net.TCPConn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn.(*net.TCPConn)
+	}
+
+	table := []struct {
+		keepAlive time.Duration
+		tls       bool
+		idle      time.Duration
+	}{
+		{0, false, DefaultKeepAliveIdleTime},
+		{time.Minute, false, time.Minute},
+		{time.Minute, true, time.Minute},
+	}
+
+	for _, tt := range table {
+		s := &Server{config: &ServerConfig{TCPKeepAlive: tt.keepAlive}}
+
+		tcp := dial()
+		var conn net.Conn = tcp
+		if tt.tls {
+			conn = tls.Client(tcp, &tls.Config{})
+		}
+		if err := s.keepAlive(conn); err != nil {
+			t.Fatal(err)
+		}
+		if on, idle := keepAliveIdleTime(t, tcp); !on || idle != tt.idle {
+			t.Error(tt.keepAlive, tt.tls, "expected keepalive", tt.idle, "got", on, idle)
+		}
+		tcp.Close()
+	}
+
+	// non TCP connections are ignored
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if err := (&Server{config: &ServerConfig{TCPKeepAlive: time.Minute}}).keepAlive(c1); err != nil {
+		t.Fatal(err)
+	}
+}
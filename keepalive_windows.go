@@ -7,6 +7,7 @@ package tunnel
 import (
 	"fmt"
 	"net"
+	"time"
 )
 
 func keepAlive(conn net.Conn) error {
@@ -21,3 +22,12 @@ func keepAlive(conn net.Conn) error {
 
 	return nil
 }
+
+// keepAliveIdle is like keepAlive but it allows to set idle time.
+func keepAliveIdle(conn net.Conn, idle time.Duration) error {
+	if err := keepAlive(conn); err != nil {
+		return err
+	}
+
+	return conn.(*net.TCPConn).SetKeepAlivePeriod(idle)
+}
@@ -0,0 +1,75 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger returns logger writing structured records to the standard
+// "log/slog" logger. The "level" value is mapped to slog levels 0 - error,
+// 1 - info, 2 - debug, 3 - trace (debug-4), the "msg" or "action" value is
+// used as record message and remaining keyvals are added as attributes.
+func NewSlogLogger(logger *slog.Logger) Logger {
+	return slogLogger{
+		logger: logger,
+	}
+}
+
+func (p slogLogger) Log(keyvals ...interface{}) error {
+	level := slog.LevelInfo
+	msg := ""
+	attrs := make([]slog.Attr, 0, len(keyvals)/2)
+
+	for i := 0; i < len(keyvals); i += 2 {
+		k := fmt.Sprint(keyvals[i])
+		var v interface{}
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+
+		switch k {
+		case "level":
+			if l, ok := v.(int); ok {
+				level = slogLevel(l)
+				continue
+			}
+		case "msg", "action":
+			if s, ok := v.(string); ok && msg == "" {
+				msg = s
+				continue
+			}
+		}
+
+		attrs = append(attrs, slog.Any(k, v))
+	}
+
+	ctx := context.Background()
+	if !p.logger.Enabled(ctx, level) {
+		return nil
+	}
+	p.logger.LogAttrs(ctx, level, msg, attrs...)
+
+	return nil
+}
+
+func slogLevel(level int) slog.Level {
+	switch {
+	case level <= 0:
+		return slog.LevelError
+	case level == 1:
+		return slog.LevelInfo
+	case level == 2:
+		return slog.LevelDebug
+	default:
+		return slog.LevelDebug - 4
+	}
+}
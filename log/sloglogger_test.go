@@ -0,0 +1,36 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestSlogLogger_Log(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	l := NewSlogLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	})))
+
+	l.Log("level", 3, "action", "transferred", "bytes", 10)
+	if buf.Len() != 0 {
+		t.Fatal("expected trace to be filtered", buf.String())
+	}
+
+	l.Log("level", 0, "msg", "proxy error", "identifier", "ID", "err", "EOF")
+
+	var rec map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec["level"] != "ERROR" || rec["msg"] != "proxy error" || rec["identifier"] != "ID" || rec["err"] != "EOF" {
+		t.Fatal("unexpected record", rec)
+	}
+}
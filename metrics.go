@@ -0,0 +1,42 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+// Transfer directions reported to Metrics.
+const (
+	DirUserToClient = "user to client"
+	DirClientToUser = "client to user"
+)
+
+// Metrics is the interface for collecting server statistics, it allows for
+// plugging in any metrics system i.e. Prometheus, see package prom for
+// a dependency-free Prometheus text exposition. Implementations must be
+// safe for concurrent use by multiple goroutines.
+type Metrics interface {
+	// ControlConnAccepted is called when a client control connection is
+	// accepted.
+	ControlConnAccepted()
+	// HandshakeRejected is called when a client is rejected, reason is
+	// a short description of the rejection cause.
+	HandshakeRejected(reason string)
+	// BytesTransferred is called when a transfer is done, host is the
+	// HTTP host or the listener address the transfer is associated with,
+	// dir is DirUserToClient or DirClientToUser.
+	BytesTransferred(host, dir string, n int64)
+	// SessionStarted is called when proxying of a HTTP request or a TCP
+	// connection starts.
+	SessionStarted()
+	// SessionEnded is called when proxying of a HTTP request or a TCP
+	// connection ends.
+	SessionEnded()
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ControlConnAccepted()                   {}
+func (nopMetrics) HandshakeRejected(string)               {}
+func (nopMetrics) BytesTransferred(string, string, int64) {}
+func (nopMetrics) SessionStarted()                        {}
+func (nopMetrics) SessionEnded()                          {}
@@ -0,0 +1,138 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+// Package otel implements tunnel.Tracer with OpenTelemetry, it's a separate
+// package so that tunnel does not depend on OpenTelemetry.
+package otel
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/mmatczuk/go-http-tunnel"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// TracerName is the name of tracer obtained from TracerProvider.
+const TracerName = "github.com/mmatczuk/go-http-tunnel"
+
+// Span attribute keys.
+const (
+	AttrRequestID  = attribute.Key("tunnel.request_id")
+	AttrProto      = attribute.Key("tunnel.proto")
+	AttrHost       = attribute.Key("tunnel.host")
+	AttrTunnel     = attribute.Key("tunnel.name")
+	AttrRemoteAddr = attribute.Key("tunnel.remote_addr")
+	AttrClientID   = attribute.Key("tunnel.client.id")
+	AttrClientName = attribute.Key("tunnel.client.name")
+	AttrBytesIn    = attribute.Key("tunnel.bytes_in")
+	AttrBytesOut   = attribute.Key("tunnel.bytes_out")
+	AttrStallMs    = attribute.Key("tunnel.stall_ms")
+	AttrPhase      = attribute.Key("tunnel.error.phase")
+)
+
+// Tracer implements tunnel.Tracer creating a span for every session with
+// TracerProvider tp i.e. of OpenTelemetry SDK
+//
+//	server, _ := tunnel.NewServer(&tunnel.ServerConfig{Tracer: otel.New(tp), ...})
+//
+// The span is child of the user HTTP request span if the request carries W3C
+// traceparent, session stats are set as span attributes when it ends.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// New creates Tracer with tracer named TracerName of tp.
+func New(tp trace.TracerProvider) *Tracer {
+	return &Tracer{
+		tracer: tp.Tracer(TracerName),
+	}
+}
+
+// StartSession implements tunnel.Tracer.
+func (t *Tracer) StartSession(parent string, msg *proto.ControlMessage) (string, func(stats *tunnel.SessionStats)) {
+	attrs := []attribute.KeyValue{
+		AttrRequestID.String(msg.RequestID),
+		AttrProto.String(msg.ForwardedProto),
+		AttrHost.String(msg.ForwardedHost),
+	}
+	if msg.Tunnel != "" {
+		attrs = append(attrs, AttrTunnel.String(msg.Tunnel))
+	}
+	if msg.RemoteAddr != "" {
+		attrs = append(attrs, AttrRemoteAddr.String(msg.RemoteAddr))
+	}
+
+	_, span := t.tracer.Start(parentContext(parent), "tunnel "+msg.ForwardedProto,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...),
+	)
+
+	end := func(stats *tunnel.SessionStats) {
+		span.SetAttributes(
+			AttrClientID.String(stats.Identifier.String()),
+			AttrBytesIn.Int64(stats.BytesIn),
+			AttrBytesOut.Int64(stats.BytesOut),
+			AttrStallMs.Int64(stats.Stall.Milliseconds()),
+		)
+		if stats.ClientName != "" {
+			span.SetAttributes(AttrClientName.String(stats.ClientName))
+		}
+		if stats.Err != nil {
+			var pe *tunnel.ProxyError
+			if errors.As(stats.Err, &pe) {
+				span.SetAttributes(AttrPhase.String(pe.Phase.String()))
+			}
+			span.RecordError(stats.Err)
+			span.SetStatus(codes.Error, stats.Err.Error())
+		}
+		span.End()
+	}
+
+	return traceParent(span.SpanContext()), end
+}
+
+// parentContext returns context with remote span context of W3C traceparent
+// parent, if parent is not valid background context is returned.
+func parentContext(parent string) context.Context {
+	ctx := context.Background()
+	if !proto.ValidTraceParent(parent) {
+		return ctx
+	}
+
+	traceID, err := trace.TraceIDFromHex(parent[3:35])
+	if err != nil {
+		return ctx
+	}
+	spanID, err := trace.SpanIDFromHex(parent[36:52])
+	if err != nil {
+		return ctx
+	}
+	flags, err := hex.DecodeString(parent[53:])
+	if err != nil {
+		return ctx
+	}
+
+	return trace.ContextWithRemoteSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.TraceFlags(flags[0]),
+		Remote:     true,
+	}))
+}
+
+// traceParent returns W3C traceparent of sc, if sc is not valid empty string
+// is returned.
+func traceParent(sc trace.SpanContext) string {
+	if !sc.IsValid() {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID(), sc.SpanID(), sc.TraceFlags())
+}
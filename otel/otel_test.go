@@ -0,0 +1,151 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package otel
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/embedded"
+
+	"github.com/mmatczuk/go-http-tunnel"
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+var _ tunnel.Tracer = (*Tracer)(nil)
+
+// provider is TracerProvider of recorder.
+type provider struct {
+	embedded.TracerProvider
+	r *recorder
+}
+
+func (p provider) Tracer(name string, _ ...trace.TracerOption) trace.Tracer {
+	p.r.name = name
+	return p.r
+}
+
+// recorder is Tracer recording the last started span.
+type recorder struct {
+	embedded.Tracer
+
+	name   string
+	parent trace.SpanContext
+	span   *span
+}
+
+func (r *recorder) Start(ctx context.Context, _ string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	r.parent = trace.SpanContextFromContext(ctx)
+	config := trace.NewSpanStartConfig(opts...)
+	r.span = &span{
+		Span: trace.SpanFromContext(ctx),
+		sc: trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    r.parent.TraceID(),
+			SpanID:     trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+			TraceFlags: r.parent.TraceFlags(),
+		}),
+		attrs: config.Attributes(),
+	}
+	return trace.ContextWithSpan(ctx, r.span), r.span
+}
+
+type span struct {
+	trace.Span
+
+	sc     trace.SpanContext
+	attrs  []attribute.KeyValue
+	status codes.Code
+	ended  bool
+}
+
+func (s *span) SpanContext() trace.SpanContext {
+	return s.sc
+}
+
+func (s *span) SetAttributes(kv ...attribute.KeyValue) {
+	s.attrs = append(s.attrs, kv...)
+}
+
+func (s *span) SetStatus(code codes.Code, _ string) {
+	s.status = code
+}
+
+func (s *span) End(...trace.SpanEndOption) {
+	s.ended = true
+}
+
+func (s *span) attr(k attribute.Key) attribute.Value {
+	for _, kv := range s.attrs {
+		if kv.Key == k {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracer(t *testing.T) {
+	t.Parallel()
+
+	r := &recorder{}
+	tr := New(provider{r: r})
+	if r.name != TracerName {
+		t.Fatal("unexpected tracer name", r.name)
+	}
+
+	const parent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	traceParent, end := tr.StartSession(parent, &proto.ControlMessage{
+		RequestID:      "1",
+		ForwardedProto: proto.HTTP,
+		ForwardedHost:  "example.com",
+	})
+	if traceParent != "00-0af7651916cd43dd8448eb211c80319c-0102030405060708-01" {
+		t.Fatal("unexpected traceparent", traceParent)
+	}
+	if !r.parent.IsRemote() || r.parent.SpanID().String() != "b7ad6b7169203331" {
+		t.Fatal("unexpected parent", r.parent)
+	}
+	s := r.span
+	if v := s.attr(AttrHost).AsString(); v != "example.com" {
+		t.Fatal("unexpected host", v)
+	}
+
+	end(&tunnel.SessionStats{
+		Identifier: id.New([]byte("a")),
+		BytesIn:    10,
+		BytesOut:   20,
+		Err:        &tunnel.ProxyError{Op: tunnel.OpDial, Phase: tunnel.PhaseDial, Err: errors.New("not connected")},
+	})
+	if !s.ended {
+		t.Fatal("span not ended")
+	}
+	if v := s.attr(AttrBytesOut).AsInt64(); v != 20 {
+		t.Fatal("unexpected bytes out", v)
+	}
+	if v := s.attr(AttrPhase).AsString(); v != "dial" {
+		t.Fatal("unexpected phase", v)
+	}
+	if s.status != codes.Error {
+		t.Fatal("unexpected status", s.status)
+	}
+}
+
+func TestTracer_noParent(t *testing.T) {
+	t.Parallel()
+
+	r := &recorder{}
+	traceParent, _ := New(provider{r: r}).StartSession("invalid", &proto.ControlMessage{})
+	if r.parent.IsValid() {
+		t.Fatal("unexpected parent", r.parent)
+	}
+	// span context of recorder has no trace ID without parent
+	if traceParent != "" {
+		t.Fatal("unexpected traceparent", traceParent)
+	}
+}
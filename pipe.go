@@ -0,0 +1,151 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"io"
+	"sync"
+)
+
+// pipeWriter is the writing half of a pipe, io.PipeWriter or buffered pipe
+// writer.
+type pipeWriter interface {
+	io.WriteCloser
+	CloseWithError(err error) error
+}
+
+// pipe returns io.Pipe or if ServerConfig.PipeBufferSize is set a buffered
+// pipe of that size.
+func (s *Server) pipe() (io.ReadCloser, pipeWriter) {
+	if s.config.PipeBufferSize > 0 {
+		return newBufferedPipe(s.config.PipeBufferSize)
+	}
+	return io.Pipe()
+}
+
+// bufferedPipe is like io.Pipe but writes complete as soon as data fits into
+// a ring buffer, writer blocks only when the buffer is full and reader when
+// it's empty. When writer closes reader gets the buffered data before the
+// close error.
+type bufferedPipe struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+	off  int // read offset
+	n    int // number of buffered bytes
+	werr error
+	rerr error
+}
+
+type bufferedPipeReader struct {
+	*bufferedPipe
+}
+
+type bufferedPipeWriter struct {
+	*bufferedPipe
+}
+
+func newBufferedPipe(size int) (io.ReadCloser, pipeWriter) {
+	p := &bufferedPipe{
+		buf: make([]byte, size),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return bufferedPipeReader{p}, bufferedPipeWriter{p}
+}
+
+func (r bufferedPipeReader) Read(b []byte) (int, error) {
+	p := r.bufferedPipe
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.n == 0 && p.werr == nil && p.rerr == nil {
+		p.cond.Wait()
+	}
+	if p.rerr != nil {
+		return 0, io.ErrClosedPipe
+	}
+	if p.n == 0 {
+		return 0, p.werr
+	}
+
+	var n int
+	for n < len(b) && p.n > 0 {
+		end := p.off + p.n
+		if end > len(p.buf) {
+			end = len(p.buf)
+		}
+		c := copy(b[n:], p.buf[p.off:end])
+		n += c
+		p.n -= c
+		p.off = (p.off + c) % len(p.buf)
+	}
+	p.cond.Broadcast()
+
+	return n, nil
+}
+
+// Close closes the reader, subsequent writes fail with io.ErrClosedPipe.
+func (r bufferedPipeReader) Close() error {
+	p := r.bufferedPipe
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.rerr == nil {
+		p.rerr = io.ErrClosedPipe
+	}
+	p.cond.Broadcast()
+	return nil
+}
+
+func (w bufferedPipeWriter) Write(b []byte) (int, error) {
+	p := w.bufferedPipe
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var n int
+	for n < len(b) {
+		for p.n == len(p.buf) && p.werr == nil && p.rerr == nil {
+			p.cond.Wait()
+		}
+		if p.rerr != nil || p.werr != nil {
+			return n, io.ErrClosedPipe
+		}
+
+		start := (p.off + p.n) % len(p.buf)
+		end := len(p.buf)
+		if start < p.off {
+			end = p.off
+		}
+		c := copy(p.buf[start:end], b[n:])
+		n += c
+		p.n += c
+		p.cond.Broadcast()
+	}
+
+	return n, nil
+}
+
+// Close closes the writer, reader gets io.EOF after reading buffered data.
+func (w bufferedPipeWriter) Close() error {
+	return w.CloseWithError(nil)
+}
+
+// CloseWithError closes the writer, reader gets err or io.EOF if err is nil
+// after reading buffered data.
+func (w bufferedPipeWriter) CloseWithError(err error) error {
+	if err == nil {
+		err = io.EOF
+	}
+
+	p := w.bufferedPipe
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.werr == nil {
+		p.werr = err
+	}
+	p.cond.Broadcast()
+	return nil
+}
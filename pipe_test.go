@@ -0,0 +1,135 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestBufferedPipe(t *testing.T) {
+	t.Parallel()
+
+	data := make([]byte, 100000)
+	rand.Read(data)
+
+	for _, size := range []int{1, 7, 1024, 1 << 20} {
+		pr, pw := newBufferedPipe(size)
+		go func() {
+			// odd chunks exercise wrapping around the ring buffer
+			for b := data; len(b) > 0; {
+				n := 333
+				if n > len(b) {
+					n = len(b)
+				}
+				if _, err := pw.Write(b[:n]); err != nil {
+					t.Error(err)
+				}
+				b = b[n:]
+			}
+			pw.Close()
+		}()
+
+		actual, err := ioutil.ReadAll(pr)
+		if err != nil {
+			t.Fatal(size, err)
+		}
+		if !bytes.Equal(actual, data) {
+			t.Fatal(size, "data mismatch")
+		}
+	}
+}
+
+func TestBufferedPipeClose(t *testing.T) {
+	t.Parallel()
+
+	t.Run("writer error after buffered data", func(t *testing.T) {
+		pr, pw := newBufferedPipe(16)
+		pw.Write([]byte("data"))
+		e := errors.New("failed")
+		pw.CloseWithError(e)
+
+		b, err := ioutil.ReadAll(pr)
+		if string(b) != "data" || err != e {
+			t.Fatal("unexpected read", string(b), err)
+		}
+		if _, err := pw.Write([]byte("x")); err != io.ErrClosedPipe {
+			t.Fatal("expected write error", err)
+		}
+	})
+
+	t.Run("reader close unblocks writer", func(t *testing.T) {
+		pr, pw := newBufferedPipe(1)
+		done := make(chan error, 1)
+		go func() {
+			_, err := pw.Write([]byte("data"))
+			done <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+		pr.Close()
+
+		if err := <-done; err != io.ErrClosedPipe {
+			t.Fatal("expected write error", err)
+		}
+		if _, err := pr.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+			t.Fatal("expected read error", err)
+		}
+	})
+}
+
+// benchmarkPipe copies data through pipe where writer gets data in bursts
+// and reader stalls in between, as with a sender waiting for
+// acknowledgements on a high-latency link and a slow receiver.
+func benchmarkPipe(b *testing.B, pipe func() (io.ReadCloser, pipeWriter)) {
+	const (
+		chunk   = 32 * 1024
+		chunks  = 16
+		burst   = 4
+		latency = time.Millisecond
+	)
+	buf := make([]byte, chunk)
+
+	b.SetBytes(chunk * chunks)
+	for i := 0; i < b.N; i++ {
+		pr, pw := pipe()
+		go func() {
+			for j := 0; j < chunks; j++ {
+				if j%burst == 0 {
+					time.Sleep(latency)
+				}
+				pw.Write(buf)
+			}
+			pw.Close()
+		}()
+
+		p := make([]byte, chunk)
+		for j := 0; ; j++ {
+			if _, err := io.ReadFull(pr, p); err != nil {
+				break
+			}
+			if j%burst == burst/2 {
+				time.Sleep(latency)
+			}
+		}
+		pr.Close()
+	}
+}
+
+func BenchmarkPipe(b *testing.B) {
+	benchmarkPipe(b, func() (io.ReadCloser, pipeWriter) {
+		return io.Pipe()
+	})
+}
+
+func BenchmarkBufferedPipe(b *testing.B) {
+	benchmarkPipe(b, func() (io.ReadCloser, pipeWriter) {
+		return newBufferedPipe(256 * 1024)
+	})
+}
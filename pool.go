@@ -9,7 +9,9 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/http2"
@@ -17,126 +19,599 @@ import (
 	"github.com/mmatczuk/go-http-tunnel/id"
 )
 
+// activityConn records time of the last successful read.
+type activityConn struct {
+	net.Conn
+	lastRead int64 // unix nano
+}
+
+func newActivityConn(conn net.Conn) *activityConn {
+	return &activityConn{
+		Conn:     conn,
+		lastRead: time.Now().UnixNano(),
+	}
+}
+
+func (c *activityConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// idle returns time elapsed since the last read.
+func (c *activityConn) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastRead)))
+}
+
 type connPair struct {
-	conn       net.Conn
+	conn       *activityConn
 	clientConn *http2.ClientConn
+	created    time.Time
+	active     *int64 // number of requests leased the connection
+	draining   *int32 // set if client was asked to drain the connection
+	token      string // disconnect token issued to the client
 }
 
+func (cp connPair) isDraining() bool {
+	return atomic.LoadInt32(cp.draining) != 0
+}
+
+// connGroup holds all connections of a single client, requests are sent over
+// the connection with the fewest active requests, ties are broken in
+// round-robin fashion. Draining connections are used only if all connections
+// of the client are draining.
+type connGroup struct {
+	pairs []connPair
+	next  uint32
+}
+
+// ReconnectPolicy specifies what happens when a client connects while it
+// already has ConnPoolSize control connections, that is usually the case
+// when a client reconnects after an ungraceful disconnect and its stale
+// connection did not time out yet. Connections that do not respond to ping
+// are closed first regardless of the policy.
+type ReconnectPolicy int
+
+// Reconnect policies.
+const (
+	// ReconnectReject rejects the new connection.
+	ReconnectReject ReconnectPolicy = iota
+	// ReconnectReplace closes the oldest connection of the client and
+	// accepts the new one in its place, in-flight requests on the closed
+	// connection fail.
+	ReconnectReplace
+	// ReconnectQueue makes the new connection wait for one of the client
+	// connections to close, it's rejected if that does not happen within
+	// HandshakeTimeout.
+	ReconnectQueue
+)
+
 type connPool struct {
 	t     *http2.Transport
-	conns map[string]connPair // key is host:port
+	conns map[string]*connGroup // key is host:port
+	ports map[id.ID]int
+	size  int
 	free  func(identifier id.ID)
+	freed []id.ID // clients to free when mu is released
 	mu    sync.RWMutex
+
+	// reconnect, queueTimeout and path must be set before the pool is used.
+	reconnect    ReconnectPolicy
+	queueTimeout time.Duration
+	path         string
+	closed       *sync.Cond // signalled when connection is closed
 }
 
-func newConnPool(t *http2.Transport, f func(identifier id.ID)) *connPool {
-	return &connPool{
+// newConnPool creates a new connPool, ports specifies port used in client
+// address, if client is not in ports 443 is used. The ports map must not be
+// modified after the pool is created.
+func newConnPool(t *http2.Transport, size int, ports map[id.ID]int, f func(identifier id.ID)) *connPool {
+	if size < 1 {
+		size = 1
+	}
+
+	p := &connPool{
 		t:     t,
+		size:  size,
+		ports: ports,
 		free:  f,
-		conns: make(map[string]connPair),
+		conns: make(map[string]*connGroup),
 	}
+	p.closed = sync.NewCond(&p.mu)
+
+	return p
 }
 
+// URL returns URL of requests sent to the client, the URL host matches the
+// address used as connection key and the path is path of the pool if set.
 func (p *connPool) URL(identifier id.ID) string {
-	return fmt.Sprint("https://", identifier)
+	return fmt.Sprint("https://", p.addr(identifier), p.path)
 }
 
 func (p *connPool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
-	if cp, ok := p.conns[addr]; ok && cp.clientConn.CanTakeNewRequest() {
-		return cp.clientConn, nil
+	g, ok := p.conns[addr]
+	if !ok {
+		return nil, errClientNotConnected
 	}
 
-	return nil, errClientNotConnected
+	var (
+		best  *connPair
+		n     = uint32(len(g.pairs))
+		start = atomic.AddUint32(&g.next, 1)
+	)
+	for i := uint32(0); i < n; i++ {
+		cp := &g.pairs[(start+i)%n]
+		if !cp.clientConn.CanTakeNewRequest() {
+			continue
+		}
+		if best == nil || best.isDraining() && !cp.isDraining() {
+			best = cp
+			continue
+		}
+		if cp.isDraining() == best.isDraining() && atomic.LoadInt64(cp.active) < atomic.LoadInt64(best.active) {
+			best = cp
+		}
+	}
+	if best == nil {
+		return nil, errClientNotConnected
+	}
+
+	if l, ok := req.Context().Value(connLeaseKey{}).(*connLease); ok {
+		l.acquire(best.active)
+	}
+
+	return best.clientConn, nil
+}
+
+// connLeaseKey is context key of connLease.
+type connLeaseKey struct{}
+
+// connLease counts request as active on the connection GetClientConn selected
+// for it until the lease is released. If request is retried on another
+// connection the lease moves to that connection.
+type connLease struct {
+	mu     sync.Mutex
+	active *int64
+}
+
+// withConnLease returns shallow copy of req leasing connection it's sent
+// over, caller must release the lease when the request is done.
+func withConnLease(req *http.Request) (*http.Request, *connLease) {
+	l := &connLease{}
+	return req.WithContext(context.WithValue(req.Context(), connLeaseKey{}, l)), l
+}
+
+func (l *connLease) acquire(active *int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active != nil {
+		atomic.AddInt64(l.active, -1)
+	}
+	l.active = active
+	atomic.AddInt64(l.active, 1)
+}
+
+func (l *connLease) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active != nil {
+		atomic.AddInt64(l.active, -1)
+		l.active = nil
+	}
 }
 
 func (p *connPool) MarkDead(c *http2.ClientConn) {
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	defer p.unlock()
 
-	for addr, cp := range p.conns {
-		if cp.clientConn == c {
-			p.close(cp, addr)
-			return
+	for addr, g := range p.conns {
+		for _, cp := range g.pairs {
+			if cp.clientConn == c {
+				p.close(cp, addr)
+				return
+			}
 		}
 	}
 }
 
-func (p *connPool) AddConn(conn net.Conn, identifier id.ID) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
+// AddConn adds connection to the pool, token is the disconnect token issued
+// to the client for the connection. It returns true if client was already
+// connected and the connection joined the existing ones.
+func (p *connPool) AddConn(conn net.Conn, identifier id.ID, token string) (bool, error) {
 	addr := p.addr(identifier)
 
-	if cp, ok := p.conns[addr]; ok {
-		if err := p.ping(cp); err != nil {
-			p.close(cp, addr)
-		} else {
-			return errClientAlreadyConnected
+	// connections are pinged without mu held so that a slow client does
+	// not block routing requests to other clients
+	dead := p.pingFull(addr)
+
+	p.mu.Lock()
+	defer p.unlock()
+
+	for _, cp := range dead {
+		p.close(cp, addr)
+	}
+	if p.full(addr) {
+		switch p.reconnect {
+		case ReconnectReplace:
+			p.close(p.conns[addr].pairs[0], addr)
+		case ReconnectQueue:
+			if !p.waitFree(addr) {
+				return false, errClientAlreadyConnected
+			}
+		default:
+			return false, errClientAlreadyConnected
 		}
 	}
+	_, joined := p.conns[addr]
 
-	c, err := p.t.NewClientConn(conn)
+	ac := newActivityConn(conn)
+	c, err := p.t.NewClientConn(ac)
 	if err != nil {
-		return err
+		return false, err
 	}
-	p.conns[addr] = connPair{
-		conn:       conn,
+
+	g, ok := p.conns[addr]
+	if !ok {
+		g = &connGroup{}
+		p.conns[addr] = g
+	}
+	g.pairs = append(g.pairs, connPair{
+		conn:       ac,
 		clientConn: c,
+		created:    time.Now(),
+		active:     new(int64),
+		draining:   new(int32),
+		token:      token,
+	})
+
+	return joined, nil
+}
+
+// pingFull pings connections of client connected at addr concurrently if the
+// client has pool size connections, it returns connections that failed to
+// respond. It must be called without mu held.
+func (p *connPool) pingFull(addr string) []connPair {
+	p.mu.RLock()
+	var pairs []connPair
+	if p.full(addr) {
+		pairs = append(pairs, p.conns[addr].pairs...)
 	}
+	p.mu.RUnlock()
 
-	return nil
+	errs := make([]error, len(pairs))
+	var wg sync.WaitGroup
+	for i := range pairs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = p.ping(pairs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var dead []connPair
+	for i, err := range errs {
+		if err != nil {
+			dead = append(dead, pairs[i])
+		}
+	}
+	return dead
+}
+
+// full returns true if client connected at addr has pool size connections,
+// it must be called with mu held.
+func (p *connPool) full(addr string) bool {
+	g, ok := p.conns[addr]
+	return ok && len(g.pairs) >= p.size
+}
+
+// waitFree waits up to queueTimeout for a connection of client connected at
+// addr to close, it must be called with mu held. It returns false on timeout.
+func (p *connPool) waitFree(addr string) bool {
+	expired := false
+	t := time.AfterFunc(p.queueTimeout, func() {
+		p.mu.Lock()
+		expired = true
+		p.closed.Broadcast()
+		p.mu.Unlock()
+	})
+	defer t.Stop()
+
+	for p.full(addr) && !expired {
+		p.closed.Wait()
+	}
+	return !p.full(addr)
 }
 
 func (p *connPool) DeleteConn(identifier id.ID) {
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	defer p.unlock()
 
 	addr := p.addr(identifier)
 
-	if cp, ok := p.conns[addr]; ok {
-		p.close(cp, addr)
+	if g, ok := p.conns[addr]; ok {
+		for _, cp := range g.pairs {
+			p.close(cp, addr)
+		}
 	}
 }
 
-func (p *connPool) Ping(identifier id.ID) (time.Duration, error) {
+// DeleteConnToken closes connections of client issued disconnect token in
+// tokens.
+func (p *connPool) DeleteConnToken(identifier id.ID, tokens ...string) {
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	defer p.unlock()
 
 	addr := p.addr(identifier)
 
-	if cp, ok := p.conns[addr]; ok {
-		start := time.Now()
-		err := p.ping(cp)
-		return time.Since(start), err
+	if g, ok := p.conns[addr]; ok {
+		for _, cp := range g.pairs {
+			for _, t := range tokens {
+				if cp.token == t {
+					p.close(cp, addr)
+					break
+				}
+			}
+		}
+	}
+}
+
+// ClientConnToken returns client connection issued disconnect token, it
+// returns nil if there is no such connection.
+func (p *connPool) ClientConnToken(identifier id.ID, token string) *http2.ClientConn {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if g, ok := p.conns[p.addr(identifier)]; ok {
+		for _, cp := range g.pairs {
+			if cp.token == token {
+				return cp.clientConn
+			}
+		}
+	}
+	return nil
+}
+
+// IsConnected returns true if client has at least one connection.
+func (p *connPool) IsConnected(identifier id.ID) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	_, ok := p.conns[p.addr(identifier)]
+	return ok
+}
+
+// IsRoutable returns true if client has at least one connection that is not
+// draining.
+func (p *connPool) IsRoutable(identifier id.ID) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if g, ok := p.conns[p.addr(identifier)]; ok {
+		for _, cp := range g.pairs {
+			if !cp.isDraining() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Drain marks connections of client that are not draining yet as draining
+// and returns them.
+func (p *connPool) Drain(identifier id.ID) []*http2.ClientConn {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var conns []*http2.ClientConn
+	if g, ok := p.conns[p.addr(identifier)]; ok {
+		for _, cp := range g.pairs {
+			if atomic.CompareAndSwapInt32(cp.draining, 0, 1) {
+				conns = append(conns, cp.clientConn)
+			}
+		}
+	}
+	return conns
+}
+
+// Undrain clears draining mark of conns.
+func (p *connPool) Undrain(conns []*http2.ClientConn) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, g := range p.conns {
+		for _, cp := range g.pairs {
+			for _, c := range conns {
+				if cp.clientConn == c {
+					atomic.StoreInt32(cp.draining, 0)
+				}
+			}
+		}
+	}
+}
+
+// Status returns remote address and creation time of the oldest connection
+// of a client, ok is false if client is not connected.
+func (p *connPool) Status(identifier id.ID) (addr net.Addr, created time.Time, ok bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	g, ok := p.conns[p.addr(identifier)]
+	if !ok || len(g.pairs) == 0 {
+		return nil, time.Time{}, false
+	}
+	cp := g.pairs[0]
+
+	return cp.conn.RemoteAddr(), cp.created, true
+}
+
+// Conn returns the first connection of client, it returns nil if client is
+// not connected.
+func (p *connPool) Conn(identifier id.ID) net.Conn {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	g, ok := p.conns[p.addr(identifier)]
+	if !ok || len(g.pairs) == 0 {
+		return nil
+	}
+
+	return g.pairs[0].conn
+}
+
+func (p *connPool) DeleteAll() {
+	p.mu.Lock()
+	defer p.unlock()
+
+	for addr, g := range p.conns {
+		for _, cp := range g.pairs {
+			p.close(cp, addr)
+		}
 	}
+}
+
+// Expired returns identifiers of clients having connections older than
+// maxAge, draining connections are skipped.
+func (p *connPool) Expired(maxAge time.Duration) []id.ID {
+	deadline := time.Now().Add(-maxAge)
 
-	return 0, errClientNotConnected
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var expired []id.ID
+	for addr, g := range p.conns {
+		for _, cp := range g.pairs {
+			if cp.created.Before(deadline) && !cp.isDraining() {
+				expired = append(expired, p.identifier(addr))
+				break
+			}
+		}
+	}
+
+	return expired
+}
+
+// PingAll pings all connections concurrently and closes the ones that fail
+// to respond within timeout, it returns identifiers of the closed connections.
+func (p *connPool) PingAll(timeout time.Duration) []id.ID {
+	return p.PingIdle(0, timeout)
+}
+
+// PingIdle is like PingAll but it only pings connections that did not receive
+// any data for at least idle.
+func (p *connPool) PingIdle(idle, timeout time.Duration) []id.ID {
+	now := time.Now()
+
+	p.mu.RLock()
+	var (
+		pairs []connPair
+		addrs []string
+	)
+	for addr, g := range p.conns {
+		for _, cp := range g.pairs {
+			if cp.conn.idle(now) < idle {
+				continue
+			}
+			pairs = append(pairs, cp)
+			addrs = append(addrs, addr)
+		}
+	}
+	p.mu.RUnlock()
+
+	errs := make([]error, len(pairs))
+	var wg sync.WaitGroup
+	for i := range pairs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = p.pingTimeout(pairs[i], timeout)
+		}(i)
+	}
+	wg.Wait()
+
+	var dead []id.ID
+	for i, err := range errs {
+		if err != nil {
+			p.MarkDead(pairs[i].clientConn)
+			dead = append(dead, p.identifier(addrs[i]))
+		}
+	}
+
+	return dead
 }
 
 func (p *connPool) ping(cp connPair) error {
-	ctx, cancel := context.WithTimeout(context.Background(), DefaultPingTimeout)
+	return p.pingTimeout(cp, DefaultPingTimeout)
+}
+
+func (p *connPool) pingTimeout(cp connPair, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	return cp.clientConn.Ping(ctx)
 }
 
+// close closes connection and removes it from the pool, when the last
+// connection of a client is closed the client is freed on unlock.
 func (p *connPool) close(cp connPair, addr string) {
 	cp.conn.Close()
+
+	g, ok := p.conns[addr]
+	if !ok {
+		return
+	}
+
+	pairs := make([]connPair, 0, len(g.pairs))
+	for _, v := range g.pairs {
+		if v != cp {
+			pairs = append(pairs, v)
+		}
+	}
+	g.pairs = pairs
+	p.closed.Broadcast()
+
+	if len(g.pairs) > 0 {
+		return
+	}
+
 	delete(p.conns, addr)
 	if p.free != nil {
-		p.free(p.identifier(addr))
+		p.freed = append(p.freed, p.identifier(addr))
+	}
+}
+
+// unlock releases mu and calls free for clients whose last connection was
+// closed while mu was held. The free function clears client from registry
+// that is locked while connections are checked, so it must not be called
+// with mu held.
+func (p *connPool) unlock() {
+	freed := p.freed
+	p.freed = nil
+	p.mu.Unlock()
+
+	for _, identifier := range freed {
+		p.free(identifier)
 	}
 }
 
 func (p *connPool) addr(identifier id.ID) string {
-	return fmt.Sprint(identifier.String(), ":443")
+	port, ok := p.ports[identifier]
+	if !ok {
+		port = 443
+	}
+	return net.JoinHostPort(identifier.String(), strconv.Itoa(port))
 }
 
 func (p *connPool) identifier(addr string) id.ID {
 	var identifier id.ID
-	identifier.UnmarshalText([]byte(addr[:len(addr)-4]))
+	host, _, _ := net.SplitHostPort(addr)
+	identifier.UnmarshalText([]byte(host))
 	return identifier
 }
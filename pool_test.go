@@ -0,0 +1,344 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+func TestConnPool_Addr(t *testing.T) {
+	t.Parallel()
+
+	a, b := id.New([]byte("a")), id.New([]byte("b"))
+
+	p := newConnPool(nil, 1, map[id.ID]int{b: 8443}, nil)
+
+	table := []struct {
+		identifier id.ID
+		addr       string
+	}{
+		{a, a.String() + ":443"},
+		{b, b.String() + ":8443"},
+	}
+
+	for _, tt := range table {
+		if addr := p.addr(tt.identifier); addr != tt.addr {
+			t.Fatal("expected", tt.addr, "got", addr)
+		}
+		if identifier := p.identifier(tt.addr); identifier != tt.identifier {
+			t.Fatal("expected", tt.identifier, "got", identifier)
+		}
+		if u := p.URL(tt.identifier); u != "https://"+tt.addr {
+			t.Fatal("unexpected URL", u)
+		}
+	}
+
+	p.path = "/tunnel"
+	if u := p.URL(a); u != "https://"+a.String()+":443/tunnel" {
+		t.Fatal("unexpected URL", u)
+	}
+}
+
+func TestActivityConn(t *testing.T) {
+	t.Parallel()
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	c := newActivityConn(a)
+	c.lastRead = 0
+
+	now := time.Now()
+	if c.idle(now) < time.Hour {
+		t.Fatal("expected idle connection")
+	}
+
+	go b.Write([]byte("x"))
+	if _, err := c.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if d := c.idle(time.Now()); d > time.Second {
+		t.Fatal("expected active connection, idle", d)
+	}
+}
+
+// h2Conn returns client side of connection served by HTTP/2 server.
+func h2Conn(t *testing.T) net.Conn {
+	a, b := net.Pipe()
+	go (&http2.Server{}).ServeConn(b, &http2.ServeConnOpts{
+		Handler: http.NotFoundHandler(),
+	})
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+func TestConnPool_ReconnectPolicy(t *testing.T) {
+	t.Parallel()
+
+	a := id.New([]byte("a"))
+
+	newPool := func(policy ReconnectPolicy, freed *int32) *connPool {
+		p := newConnPool(&http2.Transport{}, 1, nil, func(id.ID) {
+			atomic.AddInt32(freed, 1)
+		})
+		p.reconnect = policy
+		p.queueTimeout = 100 * time.Millisecond
+		if _, err := p.AddConn(h2Conn(t), a, ""); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		var freed int32
+		p := newPool(ReconnectReject, &freed)
+		if _, err := p.AddConn(h2Conn(t), a, ""); err != errClientAlreadyConnected {
+			t.Fatal("expected", errClientAlreadyConnected, "got", err)
+		}
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		var freed int32
+		p := newPool(ReconnectReplace, &freed)
+		joined, err := p.AddConn(h2Conn(t), a, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if joined {
+			t.Fatal("expected new connection to replace the old one")
+		}
+		if n := atomic.LoadInt32(&freed); n != 1 {
+			t.Fatal("expected old connection to be freed, got", n)
+		}
+		if !p.IsConnected(a) {
+			t.Fatal("expected client to be connected")
+		}
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		var freed int32
+		p := newPool(ReconnectQueue, &freed)
+		if _, err := p.AddConn(h2Conn(t), a, ""); err != errClientAlreadyConnected {
+			t.Fatal("expected", errClientAlreadyConnected, "got", err)
+		}
+
+		time.AfterFunc(20*time.Millisecond, func() { p.DeleteConn(a) })
+		if _, err := p.AddConn(h2Conn(t), a, ""); err != nil {
+			t.Fatal(err)
+		}
+		if !p.IsConnected(a) {
+			t.Fatal("expected client to be connected")
+		}
+	})
+}
+
+// silentConn returns client side of connection whose peer reads but never
+// responds, pings over it time out.
+func silentConn(t *testing.T) net.Conn {
+	a, b := net.Pipe()
+	go io.Copy(ioutil.Discard, b)
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+func TestConnPool_AddConnPingUnlocked(t *testing.T) {
+	t.Parallel()
+
+	a, b := id.New([]byte("a")), id.New([]byte("b"))
+
+	p := newConnPool(&http2.Transport{}, 1, nil, nil)
+	if _, err := p.AddConn(silentConn(t), a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.AddConn(h2Conn(t), b, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// pool of a is full, its connection is pinged
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.AddConn(h2Conn(t), a, "")
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	req, _ := http.NewRequest(http.MethodPut, p.URL(b), nil)
+	if _, err := p.GetClientConn(req, p.addr(b)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+		t.Fatal("ping did not block AddConn")
+	default:
+	}
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Fatal("routing blocked by ping", d)
+	}
+
+	<-done
+	if !p.IsConnected(a) || p.Conn(a) == nil {
+		t.Fatal("expected new connection of a")
+	}
+}
+
+func TestConnPool_GetClientConnLeastLoaded(t *testing.T) {
+	t.Parallel()
+
+	a := id.New([]byte("a"))
+
+	p := newConnPool(&http2.Transport{}, 2, nil, nil)
+	for i := 0; i < 2; i++ {
+		if _, err := p.AddConn(h2Conn(t), a, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addr := p.addr(a)
+
+	get := func() (*http2.ClientConn, *connLease) {
+		req, err := http.NewRequest(http.MethodPut, p.URL(a), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, l := withConnLease(req)
+		cc, err := p.GetClientConn(req, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cc, l
+	}
+
+	c0, l0 := get()
+	c1, l1 := get()
+	if c0 == c1 {
+		t.Fatal("expected requests to be sent over different connections")
+	}
+
+	// c1 is busy, c0 is the least loaded connection once released
+	l0.release()
+	for i := 0; i < 3; i++ {
+		cc, l := get()
+		if cc != c0 {
+			t.Fatal("expected least loaded connection")
+		}
+		l.release()
+	}
+	l1.release()
+
+	// requests without lease are not counted
+	req, _ := http.NewRequest(http.MethodPut, p.URL(a), nil)
+	if _, err := p.GetClientConn(req, addr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addrConn overrides remote address of connection.
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestConnPool_DeleteConnToken(t *testing.T) {
+	t.Parallel()
+
+	a := id.New([]byte("a"))
+
+	var freed int32
+	p := newConnPool(&http2.Transport{}, 3, nil, func(id.ID) {
+		atomic.AddInt32(&freed, 1)
+	})
+	// connections are matched by token, not address, i.e. behind NAT all
+	// connections come from the same address
+	addr, err := net.ResolveTCPAddr("tcp", "10.0.0.1:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := []string{"t1", "t2", "t3"}
+	for _, token := range tokens {
+		if _, err := p.AddConn(addrConn{h2Conn(t), addr}, a, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p.DeleteConnToken(a, tokens[0], tokens[1], "t4")
+	if n := len(p.conns[p.addr(a)].pairs); n != 1 {
+		t.Fatal("expected 1 connection left, got", n)
+	}
+	if p.ClientConnToken(a, tokens[0]) != nil || p.ClientConnToken(a, tokens[2]) == nil {
+		t.Fatal("unexpected connection left")
+	}
+	if n := atomic.LoadInt32(&freed); n != 0 {
+		t.Fatal("expected client not freed, got", n)
+	}
+
+	p.DeleteConnToken(a, tokens[2])
+	if p.IsConnected(a) {
+		t.Fatal("expected client not connected")
+	}
+	if n := atomic.LoadInt32(&freed); n != 1 {
+		t.Fatal("expected client freed, got", n)
+	}
+}
+
+func TestConnPool_Drain(t *testing.T) {
+	t.Parallel()
+
+	a := id.New([]byte("a"))
+
+	p := newConnPool(&http2.Transport{}, 2, nil, nil)
+	if _, err := p.AddConn(h2Conn(t), a, ""); err != nil {
+		t.Fatal(err)
+	}
+	addr := p.addr(a)
+
+	drained := p.Drain(a)
+	if len(drained) != 1 {
+		t.Fatal("expected 1 draining connection, got", len(drained))
+	}
+	if p.IsRoutable(a) {
+		t.Fatal("expected draining client not routable")
+	}
+	if conns := p.Drain(a); len(conns) != 0 {
+		t.Fatal("expected connection to be drained once")
+	}
+
+	// client reconnects while the old connection drains
+	if _, err := p.AddConn(h2Conn(t), a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !p.IsRoutable(a) {
+		t.Fatal("expected client routable over the new connection")
+	}
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest(http.MethodPut, p.URL(a), nil)
+		cc, err := p.GetClientConn(req, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cc == drained[0] {
+			t.Fatal("expected draining connection not used")
+		}
+	}
+
+	p.Undrain(drained)
+	if conns := p.Drain(a); len(conns) != 2 {
+		t.Fatal("expected 2 draining connections, got", len(conns))
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+// Package prom exports tunnel server metrics in Prometheus text exposition
+// format, it does not depend on Prometheus client library.
+package prom
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentType is the content type of Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Metrics implements tunnel.Metrics counting control connections, rejected
+// handshakes by reason, bytes transferred by host and direction and active
+// sessions. It's an http.Handler serving the metrics, i.e.
+//
+//	m := prom.New()
+//	server, _ := tunnel.NewServer(&tunnel.ServerConfig{Metrics: m, ...})
+//	http.Handle("/metrics", m)
+type Metrics struct {
+	accepted int64
+	active   int64
+
+	mu       sync.Mutex
+	rejected map[string]int64
+	bytes    map[bytesKey]int64
+}
+
+type bytesKey struct {
+	host string
+	dir  string
+}
+
+// New creates new Metrics.
+func New() *Metrics {
+	return &Metrics{
+		rejected: make(map[string]int64),
+		bytes:    make(map[bytesKey]int64),
+	}
+}
+
+// ControlConnAccepted implements tunnel.Metrics.
+func (m *Metrics) ControlConnAccepted() {
+	atomic.AddInt64(&m.accepted, 1)
+}
+
+// HandshakeRejected implements tunnel.Metrics.
+func (m *Metrics) HandshakeRejected(reason string) {
+	m.mu.Lock()
+	m.rejected[reason]++
+	m.mu.Unlock()
+}
+
+// BytesTransferred implements tunnel.Metrics.
+func (m *Metrics) BytesTransferred(host, dir string, n int64) {
+	m.mu.Lock()
+	m.bytes[bytesKey{host, dir}] += n
+	m.mu.Unlock()
+}
+
+// SessionStarted implements tunnel.Metrics.
+func (m *Metrics) SessionStarted() {
+	atomic.AddInt64(&m.active, 1)
+}
+
+// SessionEnded implements tunnel.Metrics.
+func (m *Metrics) SessionEnded() {
+	atomic.AddInt64(&m.active, -1)
+}
+
+// ServeHTTP writes metrics in Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	m.WriteTo(w)
+}
+
+// WriteTo writes metrics in Prometheus text exposition format to w, series
+// are sorted by labels.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+
+	header(&b, "tunnel_control_connections_accepted_total", "counter", "Number of accepted client control connections.")
+	fmt.Fprintf(&b, "tunnel_control_connections_accepted_total %d\n", atomic.LoadInt64(&m.accepted))
+
+	m.mu.Lock()
+	reasons := make([]string, 0, len(m.rejected))
+	for reason := range m.rejected {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	header(&b, "tunnel_handshakes_rejected_total", "counter", "Number of rejected client handshakes by reason.")
+	for _, reason := range reasons {
+		fmt.Fprintf(&b, "tunnel_handshakes_rejected_total{reason=\"%s\"} %d\n", escape(reason), m.rejected[reason])
+	}
+
+	keys := make([]bytesKey, 0, len(m.bytes))
+	for k := range m.bytes {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].host != keys[j].host {
+			return keys[i].host < keys[j].host
+		}
+		return keys[i].dir < keys[j].dir
+	})
+	header(&b, "tunnel_bytes_transferred_total", "counter", "Number of bytes transferred by host and direction.")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "tunnel_bytes_transferred_total{host=\"%s\",dir=\"%s\"} %d\n", escape(k.host), escape(k.dir), m.bytes[k])
+	}
+	m.mu.Unlock()
+
+	header(&b, "tunnel_sessions_active", "gauge", "Number of active proxy sessions.")
+	fmt.Fprintf(&b, "tunnel_sessions_active %d\n", atomic.LoadInt64(&m.active))
+
+	return b.WriteTo(w)
+}
+
+func header(b *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escape escapes label value.
+func escape(v string) string {
+	return labelEscaper.Replace(v)
+}
@@ -0,0 +1,60 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package prom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel"
+)
+
+var _ tunnel.Metrics = (*Metrics)(nil)
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	m := New()
+	m.ControlConnAccepted()
+	m.ControlConnAccepted()
+	m.HandshakeRejected("unknown client")
+	m.HandshakeRejected("token \"error\"")
+	m.HandshakeRejected("unknown client")
+	m.BytesTransferred("b.example.com", tunnel.DirClientToUser, 10)
+	m.BytesTransferred("a.example.com", tunnel.DirUserToClient, 5)
+	m.BytesTransferred("a.example.com", tunnel.DirClientToUser, 7)
+	m.BytesTransferred("a.example.com", tunnel.DirClientToUser, 3)
+	m.SessionStarted()
+	m.SessionStarted()
+	m.SessionEnded()
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if ct := w.Header().Get("Content-Type"); ct != ContentType {
+		t.Fatal("unexpected content type", ct)
+	}
+
+	expected := `# HELP tunnel_control_connections_accepted_total Number of accepted client control connections.
+# TYPE tunnel_control_connections_accepted_total counter
+tunnel_control_connections_accepted_total 2
+# HELP tunnel_handshakes_rejected_total Number of rejected client handshakes by reason.
+# TYPE tunnel_handshakes_rejected_total counter
+tunnel_handshakes_rejected_total{reason="token \"error\""} 1
+tunnel_handshakes_rejected_total{reason="unknown client"} 2
+# HELP tunnel_bytes_transferred_total Number of bytes transferred by host and direction.
+# TYPE tunnel_bytes_transferred_total counter
+tunnel_bytes_transferred_total{host="a.example.com",dir="client to user"} 10
+tunnel_bytes_transferred_total{host="a.example.com",dir="user to client"} 5
+tunnel_bytes_transferred_total{host="b.example.com",dir="client to user"} 10
+# HELP tunnel_sessions_active Number of active proxy sessions.
+# TYPE tunnel_sessions_active gauge
+tunnel_sessions_active 1
+`
+	if w.Body.String() != expected {
+		t.Fatalf("unexpected metrics\n%s", w.Body.String())
+	}
+}
@@ -7,20 +7,42 @@ package proto
 import (
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
 // Protocol HTTP headers.
 const (
 	HeaderError = "X-Error"
+	// HeaderConnToken carries disconnect token server issues for a control
+	// connection, it's set on the handshake request of the first connection
+	// and on a ping of connections joining it.
+	HeaderConnToken = "X-Conn-Token"
 
 	HeaderAction         = "X-Action"
+	HeaderForwardedFor   = "X-Forwarded-For"
 	HeaderForwardedHost  = "X-Forwarded-Host"
 	HeaderForwardedProto = "X-Forwarded-Proto"
+	HeaderRequestID      = "X-Request-Id"
+	HeaderTarget         = "X-Target"
+	HeaderCompression    = "X-Compression"
+	HeaderToken          = "X-Token"
+	HeaderTunnel         = "X-Tunnel"
+	HeaderALPN           = "X-Tls-Alpn"
+
+	HeaderTraceParent = "Traceparent"
 )
 
 // Known actions.
 const (
-	ActionProxy = "proxy"
+	ActionProxy   = "proxy"
+	ActionPing    = "ping"
+	ActionForward = "forward"
+	ActionConnect = "connect"
+	ActionDrain   = "drain"
+	ActionStats   = "stats"
+
+	ActionDisconnect = "disconnect"
 )
 
 // Known protocol types.
@@ -32,25 +54,151 @@ const (
 	TCP4 = "tcp4"
 	TCP6 = "tcp6"
 	UNIX = "unix"
+
+	// SNI is TLS passthrough routed by server name.
+	SNI = "sni"
+
+	UDP = "udp"
+)
+
+// Known compression algorithms.
+const (
+	CompressionGzip = "gzip"
+)
+
+// Known PROXY protocol versions.
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
 )
 
 // ControlMessage is sent from server to client before streaming data. It's
 // used to inform client about the data and action to take. Based on that client
-// routes requests to backend services.
+// routes requests to backend services. ActionForward messages are sent the
+// other way, from client to server, to forward a connection to Target.
+// ActionConnect messages are sent by client on plain TCP connections to
+// authenticate with Token. ActionDrain messages ask client to finish in-flight
+// sessions, reject new ones and reconnect. ActionStats messages ask client
+// for Stats. ActionDisconnect messages are sent by client, like ActionForward,
+// when it stops so that server deregisters it immediately, their Target is
+// comma separated list of tokens, see HeaderConnToken, of the client control
+// connections to close. Tunnel is the name of the tunnel from the client
+// handshake serving the proxied session. ALPN is comma separated list of
+// protocols offered in TLS ClientHello of SNI sessions, it's set only if server
+// is configured to forward it. TraceParent is W3C Trace Context traceparent of
+// the server span of the session, it's set if server has ServerConfig.Tracer so
+// that client side spans link up.
 type ControlMessage struct {
 	Action         string
+	ForwardedFor   string
 	ForwardedHost  string
 	ForwardedProto string
+	RequestID      string
+	Target         string
+	Compression    string
 	RemoteAddr     string
+	Token          string
+	Tunnel         string
+	ALPN           string
+	TraceParent    string
+}
+
+// controlHeaders are headers ControlMessage is serialized to.
+var controlHeaders = []string{
+	HeaderAction,
+	HeaderForwardedFor,
+	HeaderForwardedHost,
+	HeaderForwardedProto,
+	HeaderRequestID,
+	HeaderTarget,
+	HeaderCompression,
+	HeaderToken,
+	HeaderTunnel,
+	HeaderALPN,
+	HeaderTraceParent,
 }
 
-// ReadControlMessage reads ControlMessage from HTTP headers.
+// DefaultMaxControlMessageSize is the default MaxControlMessageSize.
+const DefaultMaxControlMessageSize = 8 << 10
+
+// MaxControlMessageSize is the maximal size in bytes of ControlMessage
+// headers, names and values, accepted by ReadControlMessage. Zero or negative
+// value means no limit. It must not be changed while messages are read.
+var MaxControlMessageSize = DefaultMaxControlMessageSize
+
+// ReadControlMessage reads ControlMessage from HTTP headers of r, see
+// ParseControlMessage. RemoteAddr is set to r.RemoteAddr.
 func ReadControlMessage(r *http.Request) (*ControlMessage, error) {
+	msg, err := parseControlMessage(r.Header, MaxControlMessageSize)
+	if err != nil {
+		return nil, err
+	}
+	msg.RemoteAddr = r.RemoteAddr
+	return msg, nil
+}
+
+// ParseControlMessage parses ControlMessage from HTTP headers h, it's safe to
+// use with untrusted input. Messages larger than MaxControlMessageSize,
+// repeated headers, unknown actions, protocols and compression algorithms,
+// malformed traceparent and messages missing required headers are rejected.
+func ParseControlMessage(h http.Header) (*ControlMessage, error) {
+	return parseControlMessage(h, MaxControlMessageSize)
+}
+
+func parseControlMessage(h http.Header, max int) (*ControlMessage, error) {
+	if max > 0 {
+		if size := controlMessageSize(h); size > max {
+			return nil, fmt.Errorf("control message too large: %d bytes, limit is %d", size, max)
+		}
+	}
+
+	var err error
+	get := func(key string) string {
+		if len(h[key]) > 1 && err == nil {
+			err = fmt.Errorf("repeated header %s", key)
+		}
+		v, e := decodeValue(h.Get(key))
+		if e != nil && err == nil {
+			err = fmt.Errorf("invalid header %s: %s", key, e)
+		}
+		return v
+	}
+
 	msg := ControlMessage{
-		Action:         r.Header.Get(HeaderAction),
-		ForwardedHost:  r.Header.Get(HeaderForwardedHost),
-		ForwardedProto: r.Header.Get(HeaderForwardedProto),
-		RemoteAddr:     r.RemoteAddr,
+		Action:         get(HeaderAction),
+		ForwardedFor:   get(HeaderForwardedFor),
+		ForwardedHost:  get(HeaderForwardedHost),
+		ForwardedProto: get(HeaderForwardedProto),
+		RequestID:      get(HeaderRequestID),
+		Target:         get(HeaderTarget),
+		Compression:    get(HeaderCompression),
+		Token:          get(HeaderToken),
+		Tunnel:         get(HeaderTunnel),
+		ALPN:           get(HeaderALPN),
+		TraceParent:    get(HeaderTraceParent),
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch msg.Action {
+	case "", ActionProxy, ActionPing, ActionForward, ActionConnect, ActionDrain, ActionStats, ActionDisconnect:
+	default:
+		return nil, fmt.Errorf("unknown action %q", msg.Action)
+	}
+	switch msg.ForwardedProto {
+	case "", HTTP, HTTPS, TCP, TCP4, TCP6, UNIX, SNI, UDP:
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", msg.ForwardedProto)
+	}
+	switch msg.Compression {
+	case "", CompressionGzip:
+	default:
+		return nil, fmt.Errorf("unknown compression %q", msg.Compression)
+	}
+
+	if msg.TraceParent != "" && !ValidTraceParent(msg.TraceParent) {
+		return nil, fmt.Errorf("invalid traceparent %q", msg.TraceParent)
 	}
 
 	var missing []string
@@ -58,11 +206,17 @@ func ReadControlMessage(r *http.Request) (*ControlMessage, error) {
 	if msg.Action == "" {
 		missing = append(missing, HeaderAction)
 	}
-	if msg.ForwardedHost == "" {
-		missing = append(missing, HeaderForwardedHost)
-	}
-	if msg.ForwardedProto == "" {
-		missing = append(missing, HeaderForwardedProto)
+	// ping, connect, drain, stats and disconnect carry no forwarding
+	// information
+	switch msg.Action {
+	case ActionPing, ActionConnect, ActionDrain, ActionStats, ActionDisconnect:
+	default:
+		if msg.ForwardedHost == "" {
+			missing = append(missing, HeaderForwardedHost)
+		}
+		if msg.ForwardedProto == "" {
+			missing = append(missing, HeaderForwardedProto)
+		}
 	}
 
 	if len(missing) != 0 {
@@ -72,9 +226,110 @@ func ReadControlMessage(r *http.Request) (*ControlMessage, error) {
 	return &msg, nil
 }
 
-// WriteToHeader writes ControlMessage to HTTP header.
+// controlMessageSize returns size of ControlMessage headers in h.
+func controlMessageSize(h http.Header) int {
+	size := 0
+	for _, k := range controlHeaders {
+		for _, v := range h[k] {
+			size += len(k) + len(v)
+		}
+	}
+	return size
+}
+
+// WriteToHeader writes ControlMessage to HTTP header, values are percent
+// encoded so that they can hold arbitrary bytes.
 func (c *ControlMessage) WriteToHeader(h http.Header) {
-	h.Set(HeaderAction, string(c.Action))
-	h.Set(HeaderForwardedHost, c.ForwardedHost)
-	h.Set(HeaderForwardedProto, c.ForwardedProto)
+	h.Set(HeaderAction, encodeValue(c.Action))
+	if c.ForwardedFor != "" {
+		h.Set(HeaderForwardedFor, encodeValue(c.ForwardedFor))
+	}
+	h.Set(HeaderForwardedHost, encodeValue(c.ForwardedHost))
+	h.Set(HeaderForwardedProto, encodeValue(c.ForwardedProto))
+	if c.RequestID != "" {
+		h.Set(HeaderRequestID, encodeValue(c.RequestID))
+	}
+	if c.Target != "" {
+		h.Set(HeaderTarget, encodeValue(c.Target))
+	}
+	if c.Compression != "" {
+		h.Set(HeaderCompression, encodeValue(c.Compression))
+	}
+	if c.Token != "" {
+		h.Set(HeaderToken, encodeValue(c.Token))
+	}
+	if c.Tunnel != "" {
+		h.Set(HeaderTunnel, encodeValue(c.Tunnel))
+	}
+	if c.ALPN != "" {
+		h.Set(HeaderALPN, encodeValue(c.ALPN))
+	}
+	if c.TraceParent != "" {
+		h.Set(HeaderTraceParent, c.TraceParent)
+	}
+}
+
+// ValidTraceParent returns true if v is W3C Trace Context traceparent header
+// value of version 00 with non-zero trace and parent IDs, that is
+// "00-<32 hex digits>-<16 hex digits>-<2 hex digits>".
+func ValidTraceParent(v string) bool {
+	if len(v) != 55 || v[:3] != "00-" || v[35] != '-' || v[52] != '-' {
+		return false
+	}
+	return isHex(v[3:35], true) && isHex(v[36:52], true) && isHex(v[53:], false)
+}
+
+// isHex returns true if v consists of lowercase hex digits, if nonZero is set
+// at least one of them must be non-zero.
+func isHex(v string, nonZero bool) bool {
+	zero := true
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case c == '0':
+		case '1' <= c && c <= '9', 'a' <= c && c <= 'f':
+			zero = false
+		default:
+			return false
+		}
+	}
+	return !nonZero || !zero
+}
+
+// encodeValue percent encodes bytes of v that are not printable ASCII, space
+// and percent sign, other bytes are left intact so that common values are
+// readable and compatible with peers not encoding values.
+func encodeValue(v string) string {
+	n := 0
+	for i := 0; i < len(v); i++ {
+		if shouldEscape(v[i]) {
+			n++
+		}
+	}
+	if n == 0 {
+		return v
+	}
+
+	const hex = "0123456789ABCDEF"
+	b := make([]byte, 0, len(v)+2*n)
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if shouldEscape(c) {
+			b = append(b, '%', hex[c>>4], hex[c&15])
+		} else {
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
+
+func shouldEscape(c byte) bool {
+	return c <= ' ' || c >= 0x7f || c == '%'
+}
+
+// decodeValue reverses encodeValue.
+func decodeValue(v string) (string, error) {
+	if !strings.Contains(v, "%") {
+		return v, nil
+	}
+	return url.PathUnescape(v)
 }
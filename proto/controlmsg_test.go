@@ -5,9 +5,13 @@
 package proto
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
+	"fmt"
 	"net/http"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -20,33 +24,69 @@ func TestControlMessageWriteRead(t *testing.T) {
 	}{
 		{
 			&ControlMessage{
-				Action:         "action",
+				Action:         ActionProxy,
 				ForwardedHost:  "forwarded_host",
-				ForwardedProto: "forwarded_proto",
+				ForwardedProto: HTTP,
 			},
 			nil,
 		},
 		{
 			&ControlMessage{
 				ForwardedHost:  "forwarded_host",
-				ForwardedProto: "forwarded_proto",
+				ForwardedProto: HTTP,
 			},
 			errors.New("missing headers: [X-Action]"),
 		},
 		{
 			&ControlMessage{
-				Action:        "action",
+				Action:        ActionProxy,
 				ForwardedHost: "forwarded_host",
 			},
 			errors.New("missing headers: [X-Forwarded-Proto]"),
 		},
 		{
 			&ControlMessage{
-				Action:         "action",
-				ForwardedProto: "forwarded_proto",
+				Action:         ActionProxy,
+				ForwardedProto: HTTP,
 			},
 			errors.New("missing headers: [X-Forwarded-Host]"),
 		},
+		{
+			&ControlMessage{
+				Action:         ActionProxy,
+				ForwardedFor:   "forwarded_for",
+				ForwardedHost:  "forwarded_host",
+				ForwardedProto: HTTP,
+			},
+			nil,
+		},
+		{
+			&ControlMessage{
+				Action:         ActionProxy,
+				ForwardedHost:  "forwarded_host",
+				ForwardedProto: HTTP,
+				RequestID:      "request_id",
+				Target:         "target",
+				Compression:    CompressionGzip,
+				Tunnel:         "tunnel",
+				ALPN:           "h2,http/1.1",
+				TraceParent:    "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			},
+			nil,
+		},
+		{
+			&ControlMessage{
+				Action: ActionPing,
+			},
+			nil,
+		},
+		{
+			&ControlMessage{
+				Action: ActionConnect,
+				Token:  "token",
+			},
+			nil,
+		},
 	}
 
 	for i, tt := range data {
@@ -68,3 +108,268 @@ func TestControlMessageWriteRead(t *testing.T) {
 		}
 	}
 }
+
+func TestReadControlMessageSize(t *testing.T) {
+	t.Parallel()
+
+	msg := &ControlMessage{
+		Action:         ActionProxy,
+		ForwardedHost:  "forwarded_host",
+		ForwardedProto: HTTP,
+	}
+	h := http.Header{}
+	msg.WriteToHeader(h)
+	size := controlMessageSize(h)
+
+	data := []struct {
+		max int
+		err error
+	}{
+		{0, nil},
+		{-1, nil},
+		{size, nil},
+		{size + 1, nil},
+		{size - 1, fmt.Errorf("control message too large: %d bytes, limit is %d", size, size-1)},
+	}
+
+	for i, tt := range data {
+		actual, err := parseControlMessage(h, tt.max)
+		if tt.err != nil {
+			if err == nil {
+				t.Error(i, "expected error")
+			} else if tt.err.Error() != err.Error() {
+				t.Error(i, tt.err, err)
+			}
+		} else if !reflect.DeepEqual(msg, actual) {
+			t.Error(i, msg, actual, err)
+		}
+	}
+}
+
+func TestReadControlMessageDefaultSize(t *testing.T) {
+	t.Parallel()
+
+	newRequest := func(n int) *http.Request {
+		h := http.Header{}
+		(&ControlMessage{
+			Action:         ActionProxy,
+			ForwardedHost:  "forwarded_host",
+			ForwardedProto: HTTP,
+		}).WriteToHeader(h)
+		// pad Target so that message has exactly n bytes
+		h.Set(HeaderTarget, "")
+		h.Set(HeaderTarget, strings.Repeat("x", n-controlMessageSize(h)))
+		return &http.Request{Header: h}
+	}
+
+	if _, err := ReadControlMessage(newRequest(DefaultMaxControlMessageSize)); err != nil {
+		t.Fatal("expected message of maximal size to be accepted", err)
+	}
+	if _, err := ReadControlMessage(newRequest(DefaultMaxControlMessageSize + 1)); err == nil {
+		t.Fatal("expected oversized message to be rejected")
+	}
+}
+
+// roundTrip writes msg to headers of a request sent over the wire and reads
+// it back.
+func roundTrip(msg *ControlMessage) (*ControlMessage, error) {
+	r, err := http.NewRequest(http.MethodPut, "http://localhost/", nil)
+	if err != nil {
+		return nil, err
+	}
+	msg.WriteToHeader(r.Header)
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		return nil, err
+	}
+	r, err = http.ReadRequest(bufio.NewReader(&buf))
+	if err != nil {
+		return nil, err
+	}
+
+	return ReadControlMessage(r)
+}
+
+func TestControlMessageEncoding(t *testing.T) {
+	t.Parallel()
+
+	data := []string{
+		"plain",
+		"100%",
+		"%41",
+		" leading and trailing space ",
+		"header\r\nX-Injected: value",
+		"\x00\x7f\xff",
+		"zażółć gęślą jaźń",
+	}
+
+	for i, v := range data {
+		msg := &ControlMessage{
+			Action:         ActionProxy,
+			ForwardedFor:   v,
+			ForwardedHost:  v,
+			ForwardedProto: HTTP,
+			RequestID:      v,
+			Target:         v,
+			Token:          v,
+			Tunnel:         v,
+			ALPN:           v,
+		}
+		actual, err := roundTrip(msg)
+		if err != nil {
+			t.Error(i, err)
+			continue
+		}
+		actual.RemoteAddr = ""
+		if !reflect.DeepEqual(msg, actual) {
+			t.Errorf("%d: expected %+v, got %+v", i, msg, actual)
+		}
+	}
+
+	if v := encodeValue("127.0.0.1:80"); v != "127.0.0.1:80" {
+		t.Error("expected printable value not to be encoded", v)
+	}
+}
+
+func TestReadControlMessageInvalidEncoding(t *testing.T) {
+	t.Parallel()
+
+	r := http.Request{Header: http.Header{}}
+	(&ControlMessage{Action: ActionPing}).WriteToHeader(r.Header)
+	r.Header.Set(HeaderTunnel, "%zz")
+
+	if _, err := ReadControlMessage(&r); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func FuzzControlMessage(f *testing.F) {
+	f.Add("127.0.0.1:1234", "example.com", "http", "tunnel")
+	f.Add("a\r\nb", "%", " ", "\x00")
+
+	f.Fuzz(func(t *testing.T, forwardedFor, host, target, tunnel string) {
+		if host == "" {
+			host = "host"
+		}
+		msg := &ControlMessage{
+			Action:         ActionProxy,
+			ForwardedFor:   forwardedFor,
+			ForwardedHost:  host,
+			ForwardedProto: HTTP,
+			Target:         target,
+			Tunnel:         tunnel,
+		}
+		if MaxControlMessageSize > 0 && len(encodeValue(forwardedFor+host+target+tunnel)) > MaxControlMessageSize/2 {
+			t.Skip()
+		}
+
+		actual, err := roundTrip(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual.RemoteAddr = ""
+		if !reflect.DeepEqual(msg, actual) {
+			t.Fatalf("expected %+v, got %+v", msg, actual)
+		}
+	})
+}
+
+func TestParseControlMessageInvalid(t *testing.T) {
+	t.Parallel()
+
+	data := []struct {
+		header string
+		value  []string
+		err    string
+	}{
+		{HeaderAction, []string{"action"}, `unknown action "action"`},
+		{HeaderAction, []string{ActionProxy, ActionPing}, "repeated header X-Action"},
+		{HeaderForwardedProto, []string{"ftp"}, `unknown protocol "ftp"`},
+		{HeaderCompression, []string{"br"}, `unknown compression "br"`},
+		{HeaderTarget, []string{"%"}, "invalid header X-Target"},
+		{HeaderTraceParent, []string{"00-00000000000000000000000000000000-00f067aa0ba902b7-01"}, "invalid traceparent"},
+		{HeaderTraceParent, []string{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}, "invalid traceparent"},
+	}
+
+	for _, tt := range data {
+		h := http.Header{}
+		(&ControlMessage{
+			Action:         ActionProxy,
+			ForwardedHost:  "forwarded_host",
+			ForwardedProto: HTTP,
+		}).WriteToHeader(h)
+		h[tt.header] = tt.value
+
+		_, err := ParseControlMessage(h)
+		if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("%s %q: expected error %q, got %v", tt.header, tt.value, tt.err, err)
+		}
+	}
+}
+
+func FuzzParseControlMessage(f *testing.F) {
+	f.Add(ActionProxy, "127.0.0.1:1234", "example.com", HTTP, "", "")
+	f.Add(ActionPing, "", "", "", "", "")
+	f.Add("proxy\x00", "%zz", "%", "tcp%", "gzip ", "\r\n")
+
+	f.Fuzz(func(t *testing.T, action, forwardedFor, host, protocol, compression, tunnel string) {
+		h := http.Header{}
+		for k, v := range map[string]string{
+			HeaderAction:         action,
+			HeaderForwardedFor:   forwardedFor,
+			HeaderForwardedHost:  host,
+			HeaderForwardedProto: protocol,
+			HeaderCompression:    compression,
+			HeaderTunnel:         tunnel,
+		} {
+			if v != "" {
+				h.Set(k, v)
+			}
+		}
+
+		msg, err := ParseControlMessage(h)
+		if err != nil {
+			if msg != nil {
+				t.Fatal("expected nil message on error")
+			}
+			return
+		}
+
+		// parsed message is valid and survives serialization
+		h = http.Header{}
+		msg.WriteToHeader(h)
+		actual, err := ParseControlMessage(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(msg, actual) {
+			t.Fatalf("expected %+v, got %+v", msg, actual)
+		}
+	})
+}
+
+func TestValidTraceParent(t *testing.T) {
+	t.Parallel()
+
+	data := []struct {
+		v     string
+		valid bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true},
+		{"", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0x", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-", false},
+	}
+
+	for _, tt := range data {
+		if valid := ValidTraceParent(tt.v); valid != tt.valid {
+			t.Errorf("%q: expected %v got %v", tt.v, tt.valid, valid)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package proto
+
+// Stats is sent by client in response to ActionStats control message, it's
+// encoded as JSON in the response body.
+type Stats struct {
+	// ActiveSessions is number of sessions being proxied by the client.
+	ActiveSessions int64
+	// TotalSessions is number of sessions proxied since the client started.
+	TotalSessions int64
+	// BytesIn is number of bytes received from the server.
+	BytesIn int64
+	// BytesOut is number of bytes sent to the server.
+	BytesOut int64
+	// Services is status of local services, it's reported only if client
+	// has a health check.
+	Services []ServiceStatus
+}
+
+// ServiceStatus describes reachability of local service serving a tunnel.
+type ServiceStatus struct {
+	// Tunnel is the tunnel name.
+	Tunnel string
+	// Target is the host or address of the tunnel the check was run for.
+	Target string
+	// Up is true if the check passed.
+	Up bool
+	// Err is the check error if any.
+	Err string
+}
@@ -17,7 +17,17 @@ type Tunnel struct {
 	// Auth specifies HTTP basic auth credentials in form "user:password",
 	// if set server would protect HTTP and WS tunnels with basic auth.
 	Auth string
-	// Addr specifies TCP address server would listen on, it's required
-	// for TCP tunnels.
+	// Addr specifies TCP or UDP address server would listen on, it's
+	// required for TCP and UDP tunnels.
 	Addr string
+	// Target specifies address of the backend in form host:port TCP
+	// connections are forwarded to by the client, server may allow only
+	// certain targets. Server sends it back in ControlMessage and client
+	// refuses connections if it does not match its local address.
+	Target string
+	// AppProtocol specifies application protocol of TCP tunnel connections
+	// overriding network of the listener. If it's HTTP server handles
+	// connections as HTTP requests and sends them to the client as HTTP
+	// sessions with ForwardedHost set to the listener address.
+	AppProtocol string
 }
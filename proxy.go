@@ -6,6 +6,7 @@ package tunnel
 
 import (
 	"io"
+	"net/http"
 
 	"github.com/mmatczuk/go-http-tunnel/proto"
 )
@@ -20,6 +21,8 @@ type ProxyFuncs struct {
 	HTTP ProxyFunc
 	// TCP is custom implementation of TCP proxing.
 	TCP ProxyFunc
+	// UDP is custom implementation of UDP proxing.
+	UDP ProxyFunc
 }
 
 // Proxy returns a ProxyFunc that uses custom function if provided.
@@ -29,11 +32,17 @@ func Proxy(p ProxyFuncs) ProxyFunc {
 		switch msg.ForwardedProto {
 		case proto.HTTP, proto.HTTPS:
 			f = p.HTTP
-		case proto.TCP, proto.TCP4, proto.TCP6, proto.UNIX:
+		case proto.TCP, proto.TCP4, proto.TCP6, proto.UNIX, proto.SNI:
 			f = p.TCP
+		case proto.UDP:
+			f = p.UDP
 		}
 
 		if f == nil {
+			// let HTTP user know that request cannot be served
+			if rw, ok := w.(http.ResponseWriter); ok && (msg.ForwardedProto == proto.HTTP || msg.ForwardedProto == proto.HTTPS) {
+				http.Error(rw, "unsupported protocol", http.StatusBadGateway)
+			}
 			return
 		}
 
@@ -0,0 +1,109 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// proxyProtocolV2Sig is the PROXY protocol version 2 header signature.
+var proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// writeProxyProtocol writes PROXY protocol header of a given version
+// describing connection from src to dst. If addresses are not TCP addresses
+// of the same family connection is described as unknown.
+func writeProxyProtocol(w io.Writer, version, src, dst string) error {
+	srcIP, srcPort, srcOK := splitIPPort(src)
+	dstIP, dstPort, dstOK := splitIPPort(dst)
+
+	// server may listen on unspecified address i.e. [::]:80
+	if srcOK && dstOK && dstIP.IsUnspecified() {
+		if srcIP.To4() != nil {
+			dstIP = net.IPv4zero
+		} else {
+			dstIP = net.IPv6unspecified
+		}
+	}
+
+	known := srcOK && dstOK && (srcIP.To4() != nil) == (dstIP.To4() != nil)
+
+	var b []byte
+	switch version {
+	case proto.ProxyProtocolV1:
+		b = proxyProtocolV1(known, srcIP, dstIP, srcPort, dstPort)
+	case proto.ProxyProtocolV2:
+		b = proxyProtocolV2(known, srcIP, dstIP, srcPort, dstPort)
+	default:
+		return fmt.Errorf("unknown PROXY protocol version %q", version)
+	}
+
+	_, err := w.Write(b)
+	return err
+}
+
+func proxyProtocolV1(known bool, srcIP, dstIP net.IP, srcPort, dstPort uint16) []byte {
+	if !known {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family := "TCP6"
+	if srcIP.To4() != nil {
+		family = "TCP4"
+	}
+
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcPort, dstPort))
+}
+
+func proxyProtocolV2(known bool, srcIP, dstIP net.IP, srcPort, dstPort uint16) []byte {
+	var buf bytes.Buffer
+	buf.Write(proxyProtocolV2Sig)
+
+	if !known {
+		// LOCAL command, AF_UNSPEC, no addresses
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+
+	var family byte = 0x21 // TCP over IPv6
+	if ip4 := srcIP.To4(); ip4 != nil {
+		family = 0x11 // TCP over IPv4
+		srcIP, dstIP = ip4, dstIP.To4()
+	} else {
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	}
+
+	// PROXY command
+	buf.Write([]byte{0x21, family})
+	binary.Write(&buf, binary.BigEndian, uint16(2*len(srcIP)+4))
+	buf.Write(srcIP)
+	buf.Write(dstIP)
+	binary.Write(&buf, binary.BigEndian, srcPort)
+	binary.Write(&buf, binary.BigEndian, dstPort)
+
+	return buf.Bytes()
+}
+
+func splitIPPort(hostPort string) (net.IP, uint16, bool) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, 0, false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, false
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, 0, false
+	}
+	return ip, uint16(p), true
+}
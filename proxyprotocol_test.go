@@ -0,0 +1,49 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestWriteProxyProtocol(t *testing.T) {
+	t.Parallel()
+
+	sig := string(proxyProtocolV2Sig)
+
+	table := []struct {
+		version  string
+		src      string
+		dst      string
+		expected string
+	}{
+		{proto.ProxyProtocolV1, "192.168.0.1:56324", "10.0.0.1:443", "PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\n"},
+		{proto.ProxyProtocolV1, "192.168.0.1:56324", "[::]:443", "PROXY TCP4 192.168.0.1 0.0.0.0 56324 443\r\n"},
+		{proto.ProxyProtocolV1, "[2001:db8::1]:56324", "[::]:443", "PROXY TCP6 2001:db8::1 :: 56324 443\r\n"},
+		{proto.ProxyProtocolV1, "@", "/tmp/sock", "PROXY UNKNOWN\r\n"},
+		{proto.ProxyProtocolV2, "192.168.0.1:56324", "10.0.0.1:443", sig +
+			"\x21\x11\x00\x0c" +
+			"\xc0\xa8\x00\x01" + "\x0a\x00\x00\x01" +
+			"\xdc\x04" + "\x01\xbb"},
+		{proto.ProxyProtocolV2, "@", "/tmp/sock", sig + "\x20\x00\x00\x00"},
+	}
+
+	for _, tt := range table {
+		var buf bytes.Buffer
+		if err := writeProxyProtocol(&buf, tt.version, tt.src, tt.dst); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.expected {
+			t.Errorf("%s %s %s: expected %q got %q", tt.version, tt.src, tt.dst, tt.expected, buf.String())
+		}
+	}
+
+	if err := writeProxyProtocol(&bytes.Buffer{}, "v3", "", ""); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting throughput to rate bytes per second,
+// bucket capacity is equal to rate so bursts of up to one second are allowed.
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// wait takes n tokens from the bucket sleeping until they are available or
+// ctx is done, in which case ctx error is returned.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	d := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// allow takes a token from the bucket if one is available, it never sleeps.
+func (l *rateLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// burst returns maximal number of bytes that should be transferred at once.
+func (l *rateLimiter) burst() int {
+	if l.rate < 1 {
+		return 1
+	}
+	return int(l.rate)
+}
+
+type limitReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *rateLimiter
+}
+
+func (lr limitReader) Read(p []byte) (int, error) {
+	if b := lr.l.burst(); len(p) > b {
+		p = p[:b]
+	}
+	n, err := lr.r.Read(p)
+	if werr := lr.l.wait(lr.ctx, n); err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+type limitReadCloser struct {
+	limitReader
+	io.Closer
+}
+
+type limitWriter struct {
+	ctx context.Context
+	w   io.Writer
+	l   *rateLimiter
+}
+
+func (lw limitWriter) Write(p []byte) (n int, err error) {
+	b := lw.l.burst()
+	for len(p) > 0 && err == nil {
+		chunk := p
+		if len(chunk) > b {
+			chunk = chunk[:b]
+		}
+		if err = lw.l.wait(lw.ctx, len(chunk)); err != nil {
+			break
+		}
+
+		var m int
+		m, err = lw.w.Write(chunk)
+		n += m
+		p = p[m:]
+	}
+	return
+}
+
+// clientLimiters holds rate limiters of a single client, in and out may point
+// to the same limiter if both directions share the limit.
+type clientLimiters struct {
+	in  *rateLimiter // user to client
+	out *rateLimiter // client to user
+}
+
+func newClientLimiters(c *AllowedClient) *clientLimiters {
+	if c == nil || c.RateLimit <= 0 {
+		return nil
+	}
+
+	l := &clientLimiters{
+		in: newRateLimiter(c.RateLimit),
+	}
+	if c.SharedRateLimit {
+		l.out = l.in
+	} else {
+		l.out = newRateLimiter(c.RateLimit)
+	}
+
+	return l
+}
+
+// reader limits data flowing from user to client, waiting for the limit is
+// abandoned when ctx is done.
+func (l *clientLimiters) reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return limitReader{ctx, r, l.in}
+}
+
+// writer limits data flowing from user to client, waiting for the limit is
+// abandoned when ctx is done.
+func (l *clientLimiters) writer(ctx context.Context, w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return limitWriter{ctx, w, l.in}
+}
+
+// readCloser limits data flowing from client to user, waiting for the limit
+// is abandoned when ctx is done.
+func (l *clientLimiters) readCloser(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	if l == nil {
+		return rc
+	}
+	return limitReadCloser{limitReader{ctx, rc, l.out}, rc}
+}
+
+// handshakeLimiter limits rate of accepted control connections globally and
+// per source IP, see ServerConfig.MaxHandshakesPerSecond. Source IPs are
+// counted in one second windows so that memory use is bounded by number of
+// IPs connecting within a second.
+type handshakeLimiter struct {
+	global *rateLimiter
+	perIP  int
+	window time.Time
+	ips    map[string]int
+	mu     sync.Mutex
+}
+
+func newHandshakeLimiter(global, perIP int) *handshakeLimiter {
+	if global <= 0 && perIP <= 0 {
+		return nil
+	}
+
+	l := &handshakeLimiter{
+		perIP: perIP,
+		ips:   make(map[string]int),
+	}
+	if global > 0 {
+		l.global = newRateLimiter(int64(global))
+	}
+
+	return l
+}
+
+// allow returns true if a new connection from ip may be accepted.
+func (l *handshakeLimiter) allow(ip string) bool {
+	if l == nil {
+		return true
+	}
+
+	if l.perIP > 0 {
+		l.mu.Lock()
+		now := time.Now()
+		if now.Sub(l.window) >= time.Second {
+			l.window = now
+			l.ips = make(map[string]int)
+		}
+		n := l.ips[ip] + 1
+		l.ips[ip] = n
+		l.mu.Unlock()
+
+		if n > l.perIP {
+			return false
+		}
+	}
+
+	return l.global == nil || l.global.allow()
+}
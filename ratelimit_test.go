@@ -0,0 +1,88 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+
+	l := newClientLimiters(&AllowedClient{RateLimit: 1000})
+
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, l.reader(context.Background(), bytes.NewReader(make([]byte, 1500))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1500 {
+		t.Fatal("read mismatch", n)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatal("too fast", d)
+	}
+
+	if l := newClientLimiters(&AllowedClient{}); l != nil {
+		t.Fatal("expected no limiters")
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	t.Parallel()
+
+	l := newRateLimiter(1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	if err := l.wait(ctx, 11000); err != context.Canceled {
+		t.Fatal("expected cancel, got", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatal("wait not canceled", d)
+	}
+}
+
+func TestHandshakeLimiter(t *testing.T) {
+	t.Parallel()
+
+	if l := newHandshakeLimiter(0, 0); l != nil {
+		t.Fatal("expected no limiter")
+	}
+
+	l := newHandshakeLimiter(0, 2)
+	for i := 0; i < 2; i++ {
+		if !l.allow("10.0.0.1") {
+			t.Fatal("expected allow", i)
+		}
+	}
+	if l.allow("10.0.0.1") {
+		t.Fatal("expected per IP limit")
+	}
+	if !l.allow("10.0.0.2") {
+		t.Fatal("expected other IP allow")
+	}
+
+	l = newHandshakeLimiter(3, 0)
+	for i := 0; i < 3; i++ {
+		if !l.allow("10.0.0.1") {
+			t.Fatal("expected allow", i)
+		}
+	}
+	if l.allow("10.0.0.2") {
+		t.Fatal("expected global limit")
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	if !l.allow("10.0.0.2") {
+		t.Fatal("expected allow after refill")
+	}
+}
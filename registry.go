@@ -6,8 +6,14 @@ package tunnel
 
 import (
 	"fmt"
+	"hash/fnv"
+	"math/rand"
 	"net"
+	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/mmatczuk/go-http-tunnel/id"
 	"github.com/mmatczuk/go-http-tunnel/log"
@@ -16,37 +22,168 @@ import (
 // RegistryItem holds information about hosts and listeners associated with a
 // client.
 type RegistryItem struct {
-	Hosts     []*HostAuth
-	Listeners []net.Listener
+	Hosts           []*HostAuth
+	Listeners       []*ListenerSpec
+	PacketListeners []net.PacketConn
+
+	// closed is closed when listeners are deliberately closed.
+	closed chan struct{}
+}
+
+// ListenerSpec holds listener and address of the backend on the client side
+// connections accepted by the listener are forwarded to.
+type ListenerSpec struct {
+	Listener net.Listener
+	// Tunnel is name of the client tunnel serving the listener.
+	Tunnel string
+	// Protocol is application protocol of connections accepted by the
+	// listener sent in ControlMessage, if empty network of the listener is
+	// used. If it's HTTP connections are served as HTTP requests.
+	Protocol string
+	// TargetHost and TargetPort if set are sent to the client in
+	// ControlMessage, they are empty if client did not specify a target.
+	TargetHost string
+	TargetPort int
+}
+
+// target returns target address in form host:port or empty string if not set.
+func (l *ListenerSpec) target() string {
+	if l.TargetHost == "" {
+		return ""
+	}
+	return net.JoinHostPort(l.TargetHost, strconv.Itoa(l.TargetPort))
+}
+
+// protocol returns application protocol of connections accepted by the
+// listener.
+func (l *ListenerSpec) protocol() string {
+	if l.Protocol == "" {
+		return l.Listener.Addr().Network()
+	}
+	return l.Protocol
 }
 
 // HostAuth holds host and authentication info.
 type HostAuth struct {
 	Host string
 	Auth *Auth
+	// Tunnel is name of the client tunnel serving the host.
+	Tunnel string
+	// PathPrefixes if not empty limits requests to paths starting with one
+	// of the prefixes, this allows many clients to share a host.
+	PathPrefixes []string
+	// StripPathPrefix if enabled removes the matched prefix from request
+	// path.
+	StripPathPrefix bool
+	// Sticky specifies session affinity of requests to the host.
+	Sticky Sticky
+	// StickyCookie is name of the cookie used with StickyCookie affinity.
+	StickyCookie string
+	// Weight is relative share of requests to the host the client gets
+	// when load balancing, zero is the same as 1.
+	Weight int
 }
 
+// LoadBalance specifies how requests are distributed among clients serving
+// the same host.
+type LoadBalance int
+
+// Load balancing strategies.
+const (
+	// LoadBalanceNone allows only a single client per host.
+	LoadBalanceNone LoadBalance = iota
+	// LoadBalanceRoundRobin selects clients in turns.
+	LoadBalanceRoundRobin
+	// LoadBalanceRandom selects clients at random.
+	LoadBalanceRandom
+)
+
+// Sticky specifies how requests of a user are pinned to one of the clients
+// serving the same host.
+type Sticky int
+
+// Session affinity strategies.
+const (
+	// StickyNone disables session affinity.
+	StickyNone Sticky = iota
+	// StickyCookie pins users with a cookie holding the client identifier,
+	// the cookie is set in response to the first request.
+	StickyCookie
+	// StickySourceIP pins users by their IP address.
+	StickySourceIP
+)
+
 type hostInfo struct {
-	identifier id.ID
-	auth       *Auth
+	identifier   id.ID
+	tunnel       string
+	auth         *Auth
+	prefixes     []string
+	stripPrefix  bool
+	sticky       Sticky
+	stickyCookie string
+	weight       int
+
+	// current is smooth weighted round-robin state guarded by hostGroup mu.
+	current int
+}
+
+// match returns length of the longest prefix matching path, if host has no
+// prefixes 0 is returned, if none matches -1 is returned.
+func (h *hostInfo) match(path string) int {
+	if len(h.prefixes) == 0 {
+		return 0
+	}
+
+	best := -1
+	for _, prefix := range h.prefixes {
+		if len(prefix) > best && matchPathPrefix(path, prefix) {
+			best = len(prefix)
+		}
+	}
+	return best
+}
+
+// overlaps returns true if h and o would serve the same requests.
+func (h *hostInfo) overlaps(o *hostInfo) bool {
+	if len(h.prefixes) == 0 || len(o.prefixes) == 0 {
+		return len(h.prefixes) == len(o.prefixes)
+	}
+	for _, a := range h.prefixes {
+		for _, b := range o.prefixes {
+			if a == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hostGroup holds all clients serving a host.
+type hostGroup struct {
+	infos []*hostInfo
+	next  uint32
+	// mu guards weighted round-robin state of infos.
+	mu sync.Mutex
 }
 
 type registry struct {
-	items  map[id.ID]*RegistryItem
-	hosts  map[string]*hostInfo
-	mu     sync.RWMutex
-	logger log.Logger
+	items   map[id.ID]*RegistryItem
+	hosts   map[string]*hostGroup
+	balance LoadBalance
+	mu      sync.RWMutex
+	logger  log.Logger
 }
 
-func newRegistry(logger log.Logger) *registry {
+func newRegistry(balance LoadBalance, logger log.Logger) *registry {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
 
 	return &registry{
-		items:  make(map[id.ID]*RegistryItem),
-		hosts:  make(map[string]*hostInfo),
-		logger: logger,
+		items:   make(map[id.ID]*RegistryItem),
+		hosts:   make(map[string]*hostGroup),
+		balance: balance,
+		logger:  logger,
 	}
 }
 
@@ -78,17 +215,265 @@ func (r *registry) IsSubscribed(identifier id.ID) bool {
 	return ok
 }
 
-// Subscriber returns client identifier assigned to given host.
+// Subscriber returns client identifier assigned to given host, if there are
+// many clients serving the host one is selected according to load balancing
+// strategy.
 func (r *registry) Subscriber(hostPort string) (id.ID, *Auth, bool) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	return r.subscriber(hostPort, nil)
+}
 
-	h, ok := r.hosts[trimPort(hostPort)]
+// subscriber is like Subscriber but it selects only clients for which accept
+// returns true, if accept is nil all clients are accepted.
+func (r *registry) subscriber(hostPort string, accept func(id.ID) bool) (id.ID, *Auth, bool) {
+	h, _, ok := r.route(hostPort, "", accept)
 	if !ok {
 		return id.ID{}, nil, false
 	}
+	return h.identifier, h.auth, true
+}
 
-	return h.identifier, h.auth, ok
+// hasHost returns true if any client serves host, directly or with a wildcard
+// pattern.
+func (r *registry) hasHost(hostPort string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, host := range hostPatterns(trimPort(hostPort)) {
+		if _, ok := r.hosts[host]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// route selects client serving request to host and path, it returns the
+// selected client and the matched path prefix. Hosts may be registered as
+// wildcard patterns i.e. "*.example.com", exact match is preferred over
+// wildcards and more specific wildcards over less specific ones. Within a host
+// the client with the longest matching path prefix wins, clients without
+// prefixes serve the remaining paths.
+func (r *registry) route(hostPort, path string, accept func(id.ID) bool) (*hostInfo, string, bool) {
+	return r.routeRequest(hostPort, path, nil, accept)
+}
+
+// routeRequest is like route but if req is not nil clients are selected
+// according to session affinity of the host.
+func (r *registry) routeRequest(hostPort, path string, req *http.Request, accept func(id.ID) bool) (*hostInfo, string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, host := range hostPatterns(trimPort(hostPort)) {
+		g, ok := r.hosts[host]
+		if !ok {
+			continue
+		}
+		if h, prefix, ok := r.selectPath(g, path, req, accept); ok {
+			return h, prefix, true
+		}
+	}
+
+	return nil, "", false
+}
+
+// selectPath selects client from group with the longest prefix matching path.
+func (r *registry) selectPath(g *hostGroup, path string, req *http.Request, accept func(id.ID) bool) (*hostInfo, string, bool) {
+	best := -1
+	for _, h := range g.infos {
+		if m := h.match(path); m > best {
+			best = m
+		}
+	}
+
+	for ; best >= 0; best-- {
+		var infos []*hostInfo
+		for _, h := range g.infos {
+			if h.match(path) == best {
+				infos = append(infos, h)
+			}
+		}
+		if len(infos) == 0 {
+			continue
+		}
+		if h, ok := selectSticky(infos, req, accept); ok {
+			return h, path[:best], true
+		}
+		if h, ok := r.selectHost(g, infos, accept); ok {
+			return h, path[:best], true
+		}
+	}
+
+	return nil, "", false
+}
+
+// selectHost selects one of infos according to load balancing strategy.
+// If hosts have different weights they get proportional share of requests,
+// hosts not accepted are skipped and their share goes to the others.
+func (r *registry) selectHost(g *hostGroup, infos []*hostInfo, accept func(id.ID) bool) (*hostInfo, bool) {
+	if weighted(infos) {
+		switch r.balance {
+		case LoadBalanceRoundRobin:
+			return g.selectWeighted(infos, accept)
+		case LoadBalanceRandom:
+			return selectWeightedRandom(infos, accept)
+		}
+	}
+
+	n := uint32(len(infos))
+	var start uint32
+	switch r.balance {
+	case LoadBalanceRoundRobin:
+		start = atomic.AddUint32(&g.next, 1)
+	case LoadBalanceRandom:
+		start = rand.Uint32()
+	}
+
+	for i := uint32(0); i < n; i++ {
+		h := infos[(start+i)%n]
+		if accept == nil || accept(h.identifier) {
+			return h, true
+		}
+	}
+
+	return nil, false
+}
+
+// weighted returns true if infos do not have equal weights.
+func weighted(infos []*hostInfo) bool {
+	for _, h := range infos[1:] {
+		if h.effectiveWeight() != infos[0].effectiveWeight() {
+			return true
+		}
+	}
+	return false
+}
+
+// selectWeighted selects one of infos using smooth weighted round-robin, it
+// interleaves hosts so that i.e. weights 3 and 1 give a, a, b, a order
+// instead of a, a, a, b.
+func (g *hostGroup) selectWeighted(infos []*hostInfo, accept func(id.ID) bool) (*hostInfo, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var (
+		best  *hostInfo
+		total int
+	)
+	for _, h := range infos {
+		if accept != nil && !accept(h.identifier) {
+			continue
+		}
+		w := h.effectiveWeight()
+		h.current += w
+		total += w
+		if best == nil || h.current > best.current {
+			best = h
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
+	best.current -= total
+
+	return best, true
+}
+
+// selectWeightedRandom selects one of infos at random with probability
+// proportional to weight.
+func selectWeightedRandom(infos []*hostInfo, accept func(id.ID) bool) (*hostInfo, bool) {
+	var (
+		accepted []*hostInfo
+		total    int
+	)
+	for _, h := range infos {
+		if accept == nil || accept(h.identifier) {
+			accepted = append(accepted, h)
+			total += h.effectiveWeight()
+		}
+	}
+	if total == 0 {
+		return nil, false
+	}
+
+	v := rand.Intn(total)
+	for _, h := range accepted {
+		if v -= h.effectiveWeight(); v < 0 {
+			return h, true
+		}
+	}
+
+	return nil, false
+}
+
+// selectSticky selects one of infos the user sending req is pinned to, the
+// strategy is taken from the first host. If the pinned client is not accepted
+// ok is false.
+func selectSticky(infos []*hostInfo, req *http.Request, accept func(id.ID) bool) (*hostInfo, bool) {
+	if req == nil || len(infos) < 2 {
+		return nil, false
+	}
+
+	switch infos[0].sticky {
+	case StickyCookie:
+		c, err := req.Cookie(infos[0].cookieName())
+		if err != nil {
+			return nil, false
+		}
+		for _, h := range infos {
+			if h.identifier.String() == c.Value && (accept == nil || accept(h.identifier)) {
+				return h, true
+			}
+		}
+	case StickySourceIP:
+		// rendezvous hashing, only users of a gone client are moved
+		ip := trimPort(req.RemoteAddr)
+		var (
+			best  *hostInfo
+			score uint64
+		)
+		for _, h := range infos {
+			if accept != nil && !accept(h.identifier) {
+				continue
+			}
+			f := fnv.New64a()
+			f.Write([]byte(ip))
+			f.Write(h.identifier[:])
+			if v := f.Sum64(); best == nil || v > score {
+				best, score = h, v
+			}
+		}
+		return best, best != nil
+	}
+
+	return nil, false
+}
+
+// Subscribers returns all subscribed clients and their RegistryItems.
+func (r *registry) Subscribers() map[id.ID]*RegistryItem {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	m := make(map[id.ID]*RegistryItem, len(r.items))
+	for identifier, i := range r.items {
+		m[identifier] = i
+	}
+
+	return m
+}
+
+// tcpListener returns TCP tunnel listening on port and the client it belongs to.
+func (r *registry) tcpListener(port int) (*ListenerSpec, id.ID, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for identifier, i := range r.items {
+		for _, l := range i.Listeners {
+			if addr, ok := l.Listener.Addr().(*net.TCPAddr); ok && addr.Port == port {
+				return l, identifier, true
+			}
+		}
+	}
+
+	return nil, id.ID{}, false
 }
 
 // Unsubscribe removes client from registry and returns it's RegistryItem.
@@ -109,7 +494,7 @@ func (r *registry) Unsubscribe(identifier id.ID) *RegistryItem {
 
 	if i.Hosts != nil {
 		for _, h := range i.Hosts {
-			delete(r.hosts, h.Host)
+			r.deleteHost(h.Host, identifier)
 		}
 	}
 
@@ -141,16 +526,31 @@ func (r *registry) set(i *RegistryItem, identifier id.ID) error {
 			if h.Auth != nil && h.Auth.User == "" {
 				return fmt.Errorf("missing auth user")
 			}
-			if _, ok := r.hosts[trimPort(h.Host)]; ok {
-				return fmt.Errorf("host %q is occupied", h.Host)
+			g, ok := r.hosts[trimPort(h.Host)]
+			if !ok {
+				continue
+			}
+			if r.balance == LoadBalanceNone {
+				info := newHostInfo(h, identifier)
+				for _, j := range g.infos {
+					if j.overlaps(info) {
+						return fmt.Errorf("host %q is occupied", h.Host)
+					}
+				}
+			}
+			if !sameAuth(g.infos[0].auth, h.Auth) {
+				return fmt.Errorf("host %q is occupied with different auth", h.Host)
 			}
 		}
 
 		for _, h := range i.Hosts {
-			r.hosts[trimPort(h.Host)] = &hostInfo{
-				identifier: identifier,
-				auth:       h.Auth,
+			host := trimPort(h.Host)
+			g, ok := r.hosts[host]
+			if !ok {
+				g = &hostGroup{}
+				r.hosts[host] = g
 			}
+			g.infos = append(g.infos, newHostInfo(h, identifier))
 		}
 	}
 
@@ -176,7 +576,7 @@ func (r *registry) clear(identifier id.ID) *RegistryItem {
 
 	if i.Hosts != nil {
 		for _, h := range i.Hosts {
-			delete(r.hosts, trimPort(h.Host))
+			r.deleteHost(h.Host, identifier)
 		}
 	}
 
@@ -185,10 +585,99 @@ func (r *registry) clear(identifier id.ID) *RegistryItem {
 	return i
 }
 
+// deleteHost removes client with a given identifier from host, r.mu must be
+// held.
+func (r *registry) deleteHost(hostPort string, identifier id.ID) {
+	host := trimPort(hostPort)
+
+	g, ok := r.hosts[host]
+	if !ok {
+		return
+	}
+
+	infos := make([]*hostInfo, 0, len(g.infos))
+	for _, h := range g.infos {
+		if h.identifier != identifier {
+			infos = append(infos, h)
+		}
+	}
+	g.infos = infos
+
+	if len(g.infos) == 0 {
+		delete(r.hosts, host)
+	}
+}
+
+func newHostInfo(h *HostAuth, identifier id.ID) *hostInfo {
+	return &hostInfo{
+		identifier:   identifier,
+		tunnel:       h.Tunnel,
+		auth:         h.Auth,
+		prefixes:     h.PathPrefixes,
+		stripPrefix:  h.StripPathPrefix,
+		sticky:       h.Sticky,
+		stickyCookie: h.StickyCookie,
+		weight:       h.Weight,
+	}
+}
+
+// effectiveWeight returns load balancing weight of the host.
+func (h *hostInfo) effectiveWeight() int {
+	if h.weight <= 0 {
+		return 1
+	}
+	return h.weight
+}
+
+// cookieName returns name of the StickyCookie affinity cookie.
+func (h *hostInfo) cookieName() string {
+	if h.stickyCookie == "" {
+		return DefaultStickyCookie
+	}
+	return h.stickyCookie
+}
+
+// matchPathPrefix returns true if path starts with prefix at path segment
+// boundary i.e. "/api" matches "/api" and "/api/v1" but not "/apis".
+func matchPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+func sameAuth(a, b *Auth) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// hostPatterns returns host followed by wildcard patterns matching it ordered
+// from the most specific one i.e. for "a.b.example.com" it returns
+// "a.b.example.com", "*.b.example.com", "*.example.com", "*.com".
+func hostPatterns(host string) []string {
+	patterns := []string{host}
+	for i := strings.IndexByte(host, '.'); i >= 0; {
+		patterns = append(patterns, "*"+host[i:])
+		j := strings.IndexByte(host[i+1:], '.')
+		if j < 0 {
+			break
+		}
+		i += j + 1
+	}
+	return patterns
+}
+
+// trimPort returns host part of hostPort, brackets of IPv6 literals are
+// removed so that "[::1]", "[::1]:80" and "::1" yield the same host.
 func trimPort(hostPort string) (host string) {
 	host, _, _ = net.SplitHostPort(hostPort)
 	if host == "" {
 		host = hostPort
 	}
+	if len(host) > 1 && host[0] == '[' && host[len(host)-1] == ']' {
+		host = host[1 : len(host)-1]
+	}
 	return
 }
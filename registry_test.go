@@ -0,0 +1,318 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+func TestRegistry_LoadBalance(t *testing.T) {
+	t.Parallel()
+
+	a, b := id.New([]byte("a")), id.New([]byte("b"))
+
+	r := newRegistry(LoadBalanceRoundRobin, nil)
+	for _, identifier := range []id.ID{a, b} {
+		r.Subscribe(identifier)
+		i := &RegistryItem{
+			Hosts: []*HostAuth{{Host: "example.com"}},
+		}
+		if err := r.set(i, identifier); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := make(map[id.ID]int)
+	for i := 0; i < 4; i++ {
+		identifier, _, ok := r.Subscriber("example.com:80")
+		if !ok {
+			t.Fatal("no subscriber")
+		}
+		seen[identifier]++
+	}
+	if seen[a] != 2 || seen[b] != 2 {
+		t.Fatal("unbalanced", seen)
+	}
+
+	identifier, _, ok := r.subscriber("example.com", func(identifier id.ID) bool {
+		return identifier != a
+	})
+	if !ok || identifier != b {
+		t.Fatal("expected fail over to", b, "got", identifier)
+	}
+
+	r.clear(b)
+	for i := 0; i < 2; i++ {
+		if identifier, _, _ := r.Subscriber("example.com"); identifier != a {
+			t.Fatal("expected", a, "got", identifier)
+		}
+	}
+}
+
+func TestRegistry_Weight(t *testing.T) {
+	t.Parallel()
+
+	a, b, c := id.New([]byte("a")), id.New([]byte("b")), id.New([]byte("c"))
+
+	for _, balance := range []LoadBalance{LoadBalanceRoundRobin, LoadBalanceRandom} {
+		r := newRegistry(balance, nil)
+		for identifier, weight := range map[id.ID]int{a: 6, b: 2, c: 0} {
+			r.Subscribe(identifier)
+			i := &RegistryItem{
+				Hosts: []*HostAuth{{Host: "example.com", Weight: weight}},
+			}
+			if err := r.set(i, identifier); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		seen := make(map[id.ID]int)
+		for i := 0; i < 900; i++ {
+			identifier, _, ok := r.Subscriber("example.com:80")
+			if !ok {
+				t.Fatal("no subscriber")
+			}
+			seen[identifier]++
+		}
+		if balance == LoadBalanceRoundRobin {
+			if seen[a] != 600 || seen[b] != 200 || seen[c] != 100 {
+				t.Fatal("unexpected distribution", seen)
+			}
+		} else if seen[a] < seen[b] || seen[b] < seen[c] || seen[c] == 0 {
+			t.Fatal("unexpected distribution", seen)
+		}
+
+		// share of a not accepted client goes to the others
+		seen = make(map[id.ID]int)
+		for i := 0; i < 300; i++ {
+			identifier, _, ok := r.subscriber("example.com", func(identifier id.ID) bool {
+				return identifier != a
+			})
+			if !ok {
+				t.Fatal("no subscriber")
+			}
+			seen[identifier]++
+		}
+		if seen[a] != 0 || (balance == LoadBalanceRoundRobin && (seen[b] != 200 || seen[c] != 100)) {
+			t.Fatal("unexpected distribution", seen)
+		}
+	}
+}
+
+func TestRegistry_HostOccupied(t *testing.T) {
+	t.Parallel()
+
+	a, b := id.New([]byte("a")), id.New([]byte("b"))
+
+	r := newRegistry(LoadBalanceNone, nil)
+	r.Subscribe(a)
+	r.Subscribe(b)
+
+	if err := r.set(&RegistryItem{Hosts: []*HostAuth{{Host: "example.com"}}}, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.set(&RegistryItem{Hosts: []*HostAuth{{Host: "example.com"}}}, b); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestRegistry_Wildcard(t *testing.T) {
+	t.Parallel()
+
+	a, b, c := id.New([]byte("a")), id.New([]byte("b")), id.New([]byte("c"))
+
+	r := newRegistry(LoadBalanceNone, nil)
+	for identifier, host := range map[id.ID]string{
+		a: "*.example.com",
+		b: "*.foo.example.com",
+		c: "bar.foo.example.com",
+	} {
+		r.Subscribe(identifier)
+		if err := r.set(&RegistryItem{Hosts: []*HostAuth{{Host: host}}}, identifier); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	table := []struct {
+		host       string
+		identifier id.ID
+		ok         bool
+	}{
+		{"bar.foo.example.com:80", c, true},
+		{"baz.foo.example.com", b, true},
+		{"foo.example.com", a, true},
+		{"a.b.example.com", a, true},
+		{"example.com", id.ID{}, false},
+		{"example.org", id.ID{}, false},
+	}
+
+	for _, tt := range table {
+		identifier, _, ok := r.Subscriber(tt.host)
+		if ok != tt.ok || identifier != tt.identifier {
+			t.Error(tt.host, "expected", tt.identifier, tt.ok, "got", identifier, ok)
+		}
+	}
+
+	identifier, _, ok := r.subscriber("bar.foo.example.com", func(identifier id.ID) bool {
+		return identifier != c
+	})
+	if !ok || identifier != b {
+		t.Fatal("expected fall back to wildcard", b, "got", identifier)
+	}
+}
+
+func TestRegistry_IPv6(t *testing.T) {
+	t.Parallel()
+
+	a, b := id.New([]byte("a")), id.New([]byte("b"))
+
+	r := newRegistry(LoadBalanceNone, nil)
+	for identifier, host := range map[id.ID]string{
+		a: "[::1]",
+		b: "2001:db8::1",
+	} {
+		r.Subscribe(identifier)
+		if err := r.set(&RegistryItem{Hosts: []*HostAuth{{Host: host}}}, identifier); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	table := []struct {
+		host       string
+		identifier id.ID
+	}{
+		{"[::1]", a},
+		{"[::1]:8080", a},
+		{"::1", a},
+		{"2001:db8::1", b},
+		{"[2001:db8::1]", b},
+		{"[2001:db8::1]:443", b},
+	}
+
+	for _, tt := range table {
+		identifier, _, ok := r.Subscriber(tt.host)
+		if !ok || identifier != tt.identifier {
+			t.Error(tt.host, "expected", tt.identifier, "got", identifier, ok)
+		}
+	}
+}
+
+func TestTrimPort(t *testing.T) {
+	t.Parallel()
+
+	table := []struct {
+		hostPort string
+		host     string
+	}{
+		{"example.com", "example.com"},
+		{"example.com:80", "example.com"},
+		{"127.0.0.1:80", "127.0.0.1"},
+		{"[::1]", "::1"},
+		{"[::1]:8080", "::1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+	}
+
+	for _, tt := range table {
+		if host := trimPort(tt.hostPort); host != tt.host {
+			t.Errorf("trimPort(%q) = %q, expected %q", tt.hostPort, host, tt.host)
+		}
+	}
+}
+
+func TestRegistry_PathPrefix(t *testing.T) {
+	t.Parallel()
+
+	a, b, c := id.New([]byte("a")), id.New([]byte("b")), id.New([]byte("c"))
+
+	r := newRegistry(LoadBalanceNone, nil)
+	for identifier, prefixes := range map[id.ID][]string{
+		a: nil,
+		b: {"/api"},
+		c: {"/api/v2", "/static/"},
+	} {
+		r.Subscribe(identifier)
+		i := &RegistryItem{
+			Hosts: []*HostAuth{{Host: "example.com", PathPrefixes: prefixes}},
+		}
+		if err := r.set(i, identifier); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	table := []struct {
+		path       string
+		identifier id.ID
+		prefix     string
+	}{
+		{"/", a, ""},
+		{"/apis", a, ""},
+		{"/api", b, "/api"},
+		{"/api/v1/users", b, "/api"},
+		{"/api/v2/users", c, "/api/v2"},
+		{"/static/app.js", c, "/static/"},
+	}
+
+	for _, tt := range table {
+		h, prefix, ok := r.route("example.com", tt.path, nil)
+		if !ok || h.identifier != tt.identifier || prefix != tt.prefix {
+			t.Error(tt.path, "expected", tt.identifier, tt.prefix, "got", h, prefix, ok)
+		}
+	}
+
+	d := id.New([]byte("d"))
+	r.Subscribe(d)
+	i := &RegistryItem{
+		Hosts: []*HostAuth{{Host: "example.com", PathPrefixes: []string{"/api"}}},
+	}
+	if err := r.set(i, d); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestRegistry_Sticky(t *testing.T) {
+	t.Parallel()
+
+	a, b := id.New([]byte("a")), id.New([]byte("b"))
+
+	for _, sticky := range []Sticky{StickyCookie, StickySourceIP} {
+		r := newRegistry(LoadBalanceRoundRobin, nil)
+		for _, identifier := range []id.ID{a, b} {
+			r.Subscribe(identifier)
+			i := &RegistryItem{
+				Hosts: []*HostAuth{{Host: "example.com", Sticky: sticky}},
+			}
+			if err := r.set(i, identifier); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.AddCookie(&http.Cookie{Name: DefaultStickyCookie, Value: b.String()})
+
+		h, _, _ := r.routeRequest(req.Host, "/", req, nil)
+		pinned := h.identifier
+		if sticky == StickyCookie && pinned != b {
+			t.Fatal(sticky, "expected", b, "got", pinned)
+		}
+		for i := 0; i < 4; i++ {
+			if h, _, _ := r.routeRequest(req.Host, "/", req, nil); h.identifier != pinned {
+				t.Fatal(sticky, "expected", pinned, "got", h.identifier)
+			}
+		}
+
+		h, _, ok := r.routeRequest(req.Host, "/", req, func(identifier id.ID) bool {
+			return identifier != pinned
+		})
+		if !ok || h.identifier == pinned {
+			t.Fatal(sticky, "expected fail over, got", h, ok)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying request ID. Server uses ID
+// from the context of proxied request if present, otherwise a new one is
+// generated.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestID returns request ID carried by ctx. It's available in contexts of
+// requests sent to local services by HTTPProxy and of requests passed to
+// Server.RoundTrip.
+func RequestID(ctx context.Context) (string, bool) {
+	requestID, ok := ctx.Value(requestIDKey{}).(string)
+	return requestID, ok
+}
+
+// newRequestID returns random identifier of a proxy session, it's logged by
+// both server and client to correlate log lines.
+func newRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// requestIDFrom returns request ID from ctx or a new one.
+func requestIDFrom(ctx context.Context) string {
+	if requestID, ok := RequestID(ctx); ok && requestID != "" {
+		return requestID
+	}
+	return newRequestID()
+}
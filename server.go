@@ -5,6 +5,8 @@
 package tunnel
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
 	"crypto/tls"
 	"encoding/json"
@@ -13,7 +15,13 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/http2"
@@ -28,32 +36,576 @@ type ServerConfig struct {
 	// Addr is TCP address to listen for client connections. If empty ":0"
 	// is used.
 	Addr string
+	// AllowedClients specifies clients subscribed when server is created
+	// along with their settings.
+	AllowedClients []*AllowedClient
 	// AutoSubscribe if enabled will automatically subscribe new clients on
 	// first call.
 	AutoSubscribe bool
+	// RevokedIDs specifies clients that are rejected even if they are
+	// allowed or auto subscribed, see also Server.Revoke.
+	RevokedIDs []id.ID
 	// TLSConfig specifies the tls configuration to use with tls.Listener.
 	TLSConfig *tls.Config
+	// IdentityFunc is optional function returning identity of client
+	// connected over conn, it's called after TLS handshake. Clients are
+	// matched with AllowedClient.Identity and identified by IdentityID of
+	// the identity. If nil identifier is derived from the client
+	// certificate.
+	IdentityFunc func(conn *tls.Conn) (string, error)
+	// InsecureControl if enabled makes server accept client connections
+	// over plain TCP instead of TLS, clients authenticate with
+	// ClientConfig.Token and are identified by TokenID of the token. It's
+	// meant for trusted networks where TLS is terminated by a load balancer,
+	// TLSConfig and VerifyCertValidity are not used.
+	InsecureControl bool
 	// Listener specifies optional listener for client connections. If nil
 	// tls.Listen("tcp", Addr, TLSConfig) is used.
 	Listener net.Listener
+	// DataListener is optional function wrapping listeners of TCP and TLS
+	// passthrough tunnels opened for clients, i.e. for connection counting
+	// or PROXY protocol decoding. Returning nil fails opening of the tunnel.
+	DataListener func(net.Listener) net.Listener
+	// GetCertificate returns certificates of the public HTTPS listener
+	// serving users, see Server.HTTPSServer. It's separate from TLSConfig of
+	// client connections, i.e. autocert.Manager GetCertificate with
+	// Server.HostPolicy gets certificates of client hosts automatically.
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	// ForwardALPN if enabled makes TLS passthrough listeners parse ALPN
+	// protocols offered in ClientHello and pass them to clients in
+	// ControlMessage.ALPN, i.e. for backends that multiplex gRPC and HTTP
+	// on one port.
+	ForwardALPN bool
+	// AcceptEarlyData if enabled would accept TLS 1.3 0-RTT early data on
+	// control connections. Early data saves a round trip on reconnect but
+	// it can be replayed by an attacker, a replayed control handshake could
+	// open tunnels on behalf of the client. crypto/tls does not support
+	// early data on servers, handshake is always completed before any
+	// control message is read, so enabling it is rejected by Validate.
+	AcceptEarlyData bool
+	// LoadBalance specifies how requests are distributed among clients
+	// serving the same host. If LoadBalanceNone only one client can serve
+	// a host.
+	LoadBalance LoadBalance
+	// ConnPoolSize specifies maximal number of control connections a single
+	// client may open, see ClientConfig.PoolSize. Requests are sent over
+	// the connection with the fewest active requests. If zero only one
+	// connection is allowed.
+	ConnPoolSize int
+	// ReconnectPolicy specifies how connections of clients that already
+	// have ConnPoolSize connections are handled. If zero ReconnectReject is
+	// used.
+	ReconnectPolicy ReconnectPolicy
+	// TransportOptions is optional function used to tune HTTP/2 transport
+	// used for sending requests to clients i.e. MaxHeaderListSize. It's
+	// called after the defaults are set, the transport connection pool is
+	// always managed by the server and cannot be replaced.
+	TransportOptions func(t *http2.Transport)
+	// TransportPath specifies path of HTTP requests sent to clients over
+	// control connections, it allows to pass intermediaries that only allow
+	// specific paths. If empty "/" is used, see Server.ClientURL.
+	TransportPath string
+	// HTTPClient is optional client used for sending requests to clients,
+	// it allows for instrumentation or for substituting transport in tests.
+	// If Transport is nil or *http2.Transport the server installs its
+	// client connection pool on it, other transports are used as is. If
+	// CheckRedirect is nil redirects are not followed. The client is copied
+	// and must not be modified after the server is created.
+	HTTPClient *http.Client
+	// OnClientConnect is optional callback invoked in a new goroutine after
+	// client connects and its tunnels are opened. Client is the AllowedClient
+	// of the client, for clients not in AllowedClients i.e. with
+	// AutoSubscribe it has only ID set. It must not be modified.
+	OnClientConnect func(client *AllowedClient, conn net.Conn)
+	// OnClientDisconnect is optional callback invoked in a new goroutine
+	// after connected client goes away, client is as in OnClientConnect.
+	OnClientDisconnect func(client *AllowedClient)
+	// FlapThreshold if set enables detection of flapping clients, a client
+	// connecting FlapThreshold or more times within FlapWindow is flapping,
+	// see Server.ClientFlapping.
+	FlapThreshold int
+	// FlapWindow specifies window of FlapThreshold. If zero
+	// DefaultFlapWindow is used.
+	FlapWindow time.Duration
+	// OnClientFlapping is optional callback invoked in a new goroutine when
+	// a client starts flapping, connects is number of its connections
+	// within FlapWindow.
+	OnClientFlapping func(identifier id.ID, connects int)
+	// OnReject is optional callback invoked when client control handshake
+	// is rejected, it's called before the connection is closed and should
+	// not block.
+	OnReject func(remoteAddr string, reason RejectReason)
+	// AuditLog is optional callback invoked with an event for every client
+	// authentication attempt, accepted or rejected, and when clients are
+	// revoked or unsubscribed. It's called synchronously and should not
+	// block.
+	AuditLog func(AuditEvent)
+	// OnSessionEnd is optional callback invoked when proxying of HTTP
+	// request, TCP connection or UDP session to a client is done.
+	OnSessionEnd func(stats *SessionStats)
+	// Tracer is optional tracer creating spans of HTTP requests, TCP
+	// connections and UDP sessions proxied to clients, trace context of
+	// user HTTP requests is taken from traceparent header.
+	Tracer Tracer
+	// HandshakeTimeout specifies maximal duration of control handshake with
+	// a connecting client. If zero DefaultTimeout is used.
+	HandshakeTimeout time.Duration
+	// TLSHandshakeTimeout specifies maximal duration of TLS handshake with
+	// a connecting client, stalled peers are disconnected when it elapses.
+	// If zero HandshakeTimeout is used.
+	TLSHandshakeTimeout time.Duration
+	// MaxHandshakesPerSecond if set limits rate of accepted control
+	// connections, connections over the limit are closed right after they
+	// are accepted, before TLS handshake.
+	MaxHandshakesPerSecond int
+	// MaxHandshakesPerSecondPerIP if set limits rate of accepted control
+	// connections from a single source IP, it works like
+	// MaxHandshakesPerSecond.
+	MaxHandshakesPerSecondPerIP int
+	// VerifyCertValidity if enabled rejects clients presenting certificates
+	// that are expired or not yet valid.
+	VerifyCertValidity bool
+	// CertClockSkew specifies tolerated clock difference when checking
+	// certificate validity period.
+	CertClockSkew time.Duration
+	// MinTLSVersion if set rejects clients that negotiated lower TLS
+	// version of control connection, i.e. tls.VersionTLS12.
+	MinTLSVersion uint16
+	// AllowedCipherSuites if not empty rejects clients that negotiated
+	// cipher suite of control connection not in the list. Unlike
+	// TLSConfig.CipherSuites it applies to TLS 1.3 suites too. Rejected
+	// clients are reported with RejectTLSPolicy.
+	AllowedCipherSuites []uint16
+	// IdleTimeout specifies how often control connections are pinged,
+	// connections not responding within PingTimeout are closed. If zero
+	// connections are not checked.
+	IdleTimeout time.Duration
+	// PingTimeout specifies how long Ping waits for the client to respond.
+	// If zero DefaultPingTimeout is used.
+	PingTimeout time.Duration
+	// TCPKeepAlive specifies how long accepted TCP connections, both control
+	// and tunneled, can be idle before sending keepalive probes. If zero
+	// DefaultKeepAliveIdleTime is used.
+	TCPKeepAlive time.Duration
+	// DisableNoDelay if enabled clears TCP_NODELAY of accepted tunneled TCP
+	// connections so that small writes are coalesced, it may help bulk
+	// transfers. By default TCP_NODELAY is set for low latency of
+	// interactive protocols i.e. SSH.
+	DisableNoDelay bool
+	// ReadIdleTimeout specifies after how long without receiving any frame
+	// from the client a health check ping is sent on control connection.
+	// Connections not responding within PingTimeout are closed, dead clients
+	// are detected within 2*ReadIdleTimeout+PingTimeout. Unlike IdleTimeout
+	// busy connections are not pinged. If zero connections are not checked.
+	ReadIdleTimeout time.Duration
+	// MaxConnLifetime specifies maximal age of client control connections,
+	// older connections are drained, see DrainClient, so that the client
+	// finishes in-flight sessions, reconnects and authenticates again.
+	// Clients failing to drain are disconnected. If zero connections are
+	// not limited.
+	MaxConnLifetime time.Duration
+	// DialWait specifies how long HTTP request waits for a client serving
+	// the host to connect, this smooths over client reconnects. If zero
+	// requests fail immediately.
+	DialWait time.Duration
+	// ProxyTimeout specifies maximal duration of a single proxied session
+	// that is HTTP request, TCP connection or UDP session, session is torn
+	// down when it expires. If zero sessions are not limited.
+	ProxyTimeout time.Duration
+	// ResponseHeaderTimeout specifies how long to wait for client response
+	// headers after the request is sent, HTTP requests fail with 504 Gateway
+	// Timeout when it expires. If zero there is no timeout.
+	ResponseHeaderTimeout time.Duration
+	// TransferBufferSize specifies size of buffers used for copying data
+	// between users and clients. If zero DefaultTransferBufferSize is used.
+	TransferBufferSize int
+	// PipeBufferSize if set specifies size of a buffer between reading user
+	// data and sending it to the client, it decouples user and client rates
+	// on high-latency links. If zero reads and writes are synchronous.
+	PipeBufferSize int
+	// FlushInterval specifies how often HTTP responses are flushed to users
+	// while they are copied. If zero responses are flushed only when the
+	// copy buffer is full, negative value flushes after every write.
+	// Streaming responses with Content-Type text/event-stream are always
+	// flushed after every write.
+	FlushInterval time.Duration
+	// MaxStall specifies how long a write of HTTP response or TCP data to
+	// a user may block, sessions of users not reading data for longer are
+	// aborted so that they don't hold client resources. If zero sessions
+	// are never aborted, see also Server.SlowConsumers.
+	MaxStall time.Duration
+	// Compression if enabled allows clients to send gzip compressed HTTP
+	// responses, clients compress text based responses if they have
+	// compression enabled.
+	Compression bool
+	// DecompressResponses if enabled makes server decompress HTTP response
+	// bodies with Content-Encoding gzip before ModifyResponse is called,
+	// i.e. to rewrite HTML. Content-Encoding and Content-Length headers are
+	// removed, responses with other or multiple encodings are left intact.
+	DecompressResponses bool
+	// RecompressResponses if enabled makes server compress responses
+	// decompressed due to DecompressResponses with gzip again before they're
+	// written to users, unless ModifyResponse sets Content-Encoding.
+	RecompressResponses bool
+	// MaxRequestBytes specifies maximal size of HTTP request body, larger
+	// requests get 413 Request Entity Too Large. If zero size is not
+	// limited.
+	MaxRequestBytes int64
+	// MaxHeaderBytes specifies maximal size of HTTP request line and
+	// headers, larger requests get 413 Request Entity Too Large. If zero size
+	// is not limited.
+	MaxHeaderBytes int
+	// LoadShedder is optional function reporting that the server is
+	// overloaded i.e. is short of memory or file descriptors. It's called
+	// before a new proxy session is started, if it returns true TCP and TLS
+	// connections are closed, UDP sessions are dropped and HTTP requests get
+	// 503 Service Unavailable with Retry-After. It's called for every
+	// session and should be fast.
+	LoadShedder func() bool
+	// ModifyRequest is optional function that modifies HTTP requests before
+	// they are sent to clients i.e. adds X-Real-IP or removes headers. It's
+	// called after X-Forwarded-For, X-Forwarded-Host, X-Forwarded-Proto and
+	// X-Forwarded-Prefix headers are set, also for upgrade requests.
+	ModifyRequest func(r *http.Request)
+	// ModifyResponse is optional function that modifies HTTP responses of
+	// clients before they are written to users i.e. rewrites Location
+	// headers or adds HSTS. If it returns an error the response body is
+	// closed and user gets 502 Bad Gateway. Response Request is the user
+	// request. It's not called for upgrade requests.
+	ModifyResponse func(resp *http.Response) error
+	// Registry is optional store of client registrations shared by server
+	// instances behind a load balancer. Clients and their HTTP hosts are
+	// registered when they connect and deleted when they go away, requests
+	// to hosts not served by local clients but registered by other
+	// instances are passed to ElsewhereHandler. If nil NewMemoryRegistry is
+	// used.
+	Registry Registry
+	// Instance identifies the server in Registry i.e. its internal address.
+	// If empty address of client connections listener is used.
+	Instance string
+	// ElsewhereHandler is optional handler of HTTP requests to hosts served
+	// by clients connected to other instances, reg describes the client. It
+	// may i.e. redirect or proxy the request to reg.Instance. If nil and
+	// PeerDialer is set requests are proxied to the instance, otherwise 502
+	// Bad Gateway is returned.
+	ElsewhereHandler func(w http.ResponseWriter, r *http.Request, reg *Registration)
+	// PeerDialer is optional function connecting to other server instances,
+	// if set HTTP requests to hosts served by clients connected to other
+	// instance are proxied to the instance, Instance must be then address of
+	// HTTP server of the instance. Requests proxied once are not proxied
+	// again. The dialer may return TLS connection, it should give up when
+	// ctx is done i.e. user went away or request timed out.
+	PeerDialer func(ctx context.Context, network, addr string) (net.Conn, error)
+	// NotFoundHandler is optional handler of HTTP requests to hosts that are
+	// not served by any client. If nil 404 Not Found is returned.
+	NotFoundHandler http.Handler
+	// AccessLog is optional writer of HTTP access log in Combined Log Format,
+	// each line is followed by request duration in microseconds. CONNECT and
+	// upgrade requests are not logged.
+	AccessLog io.Writer
+	// Metrics is optional metrics collector.
+	Metrics Metrics
 	// Logger is optional logger. If nil logging is disabled.
 	Logger log.Logger
 }
 
+// AllowedClient specifies server side settings of a client.
+type AllowedClient struct {
+	// ID is the client identifier.
+	ID id.ID
+	// Identity specifies client identity returned by
+	// ServerConfig.IdentityFunc, if set ID may be empty and defaults to
+	// IdentityID of the identity.
+	Identity string
+	// Name is optional human-readable name of the client, it's reported in
+	// logs, ClientStatus, SessionStats and AuditEvent.
+	Name string
+	// Labels are optional free-form labels of the client i.e. tenant,
+	// they're reported along with Name.
+	Labels map[string]string
+	// Hosts if not empty restricts HTTP tunnels of the client to the listed
+	// hosts and makes PathPrefixes, StripPathPrefix, Sticky, StickyCookie
+	// and Weight apply to these hosts only. A client serving several hosts
+	// with different settings is configured with AllowedClients sharing ID
+	// and having distinct Hosts, at most one of them may have no Hosts and
+	// it applies to the other hosts. Settings not related to HTTP hosts are
+	// taken from the first AllowedClient of the ID. Hosts may be wildcard
+	// patterns i.e. "*.example.com".
+	Hosts []string
+	// RateLimit specifies maximal throughput of the client in bytes per
+	// second. If zero throughput is not limited.
+	RateLimit int64
+	// SharedRateLimit if enabled makes both directions share RateLimit,
+	// otherwise each direction is limited separately.
+	SharedRateLimit bool
+	// PathPrefixes if not empty makes the client serve only requests with
+	// paths starting with one of the prefixes, clients with different
+	// prefixes may share a host. The longest matching prefix wins, requests
+	// not matching any prefix go to client without prefixes if any.
+	PathPrefixes []string
+	// StripPathPrefix if enabled removes the matched prefix from request
+	// path before it's sent to the client.
+	StripPathPrefix bool
+	// Port specifies port of the internal address identifying client
+	// connections in HTTP/2 transport. If zero 443 is used.
+	Port int
+	// AllowedTargets if not empty specifies backend addresses in form
+	// host:port the client may forward TCP tunnels to, tunnels with other
+	// or no target are rejected.
+	AllowedTargets []string
+	// MaxConns specifies maximal number of HTTP requests and TCP connections
+	// proxied to the client at the same time. Further TCP connections are
+	// closed and HTTP requests get 503 Service Unavailable. If zero number
+	// of connections is not limited.
+	MaxConns int
+	// ForwardTargets specifies addresses in form host:port the server dials
+	// on behalf of the client for connections accepted by client side
+	// listeners, see ClientConfig.Forwards. If empty reverse forwarding is
+	// disabled for the client.
+	ForwardTargets []string
+	// Sticky specifies session affinity of HTTP requests to hosts the client
+	// shares with other clients, clients sharing a host should use the same
+	// settings. If the client a user is pinned to is not connected requests
+	// are load balanced as usual.
+	Sticky Sticky
+	// StickyCookie specifies name of the cookie used with StickyCookie
+	// affinity. If empty DefaultStickyCookie is used.
+	StickyCookie string
+	// Weight specifies relative share of HTTP requests the client gets
+	// among clients serving the same host with LoadBalanceRoundRobin or
+	// LoadBalanceRandom, i.e. weights 95 and 5 send 5% of traffic to the
+	// second client. Zero is the same as 1, if all weights are equal
+	// requests are distributed evenly. Clients that are not connected are
+	// skipped and their share is split among the others proportionally to
+	// their weights, that includes failover of requests to a disconnected
+	// client. Sticky users stay pinned regardless of weights.
+	Weight int
+}
+
+// Validate checks configuration, it's invoked by NewServer.
+func (c *ServerConfig) Validate() error {
+	if c.TLSConfig == nil && !c.InsecureControl {
+		return errors.New("missing TLSConfig")
+	}
+
+	var zero id.ID
+	seen := make(map[id.ID]bool, len(c.AllowedClients))
+	seenHosts := make(map[id.ID]map[string]bool)
+	for i, client := range c.AllowedClients {
+		if client == nil {
+			return fmt.Errorf("allowed client %d: nil", i)
+		}
+		if client.ID == zero && client.Identity == "" {
+			return fmt.Errorf("allowed client %d: missing ID", i)
+		}
+		if client.ID != zero && client.Identity != "" && client.ID != IdentityID(client.Identity) {
+			return fmt.Errorf("allowed client %s: ID does not match Identity %q", client.ID, client.Identity)
+		}
+		identifier := client.identifier()
+		if len(client.Hosts) == 0 {
+			if seen[identifier] {
+				return fmt.Errorf("allowed client %s: duplicate ID", identifier)
+			}
+			seen[identifier] = true
+		}
+		for _, host := range client.Hosts {
+			if trimPort(host) == "" {
+				return fmt.Errorf("allowed client %s: empty host", identifier)
+			}
+			if seenHosts[identifier] == nil {
+				seenHosts[identifier] = make(map[string]bool)
+			}
+			if seenHosts[identifier][trimPort(host)] {
+				return fmt.Errorf("allowed client %s: duplicate host %q", identifier, host)
+			}
+			seenHosts[identifier][trimPort(host)] = true
+		}
+
+		if client.RateLimit < 0 {
+			return fmt.Errorf("allowed client %s: negative RateLimit", identifier)
+		}
+		for _, target := range client.AllowedTargets {
+			if _, _, err := splitTarget(target); err != nil {
+				return fmt.Errorf("allowed client %s: invalid target %q: %s", identifier, target, err)
+			}
+		}
+		for _, target := range client.ForwardTargets {
+			if _, _, err := splitTarget(target); err != nil {
+				return fmt.Errorf("allowed client %s: invalid forward target %q: %s", identifier, target, err)
+			}
+		}
+		if client.Sticky < StickyNone || client.Sticky > StickySourceIP {
+			return fmt.Errorf("allowed client %s: unknown Sticky %d", identifier, client.Sticky)
+		}
+		if client.MaxConns < 0 {
+			return fmt.Errorf("allowed client %s: negative MaxConns", identifier)
+		}
+		if client.Weight < 0 {
+			return fmt.Errorf("allowed client %s: negative Weight", identifier)
+		}
+		if client.Port < 0 || client.Port > 65535 {
+			return fmt.Errorf("allowed client %s: invalid Port %d", identifier, client.Port)
+		}
+		for _, prefix := range client.PathPrefixes {
+			if !strings.HasPrefix(prefix, "/") {
+				return fmt.Errorf("allowed client %s: path prefix %q must start with /", identifier, prefix)
+			}
+		}
+	}
+
+	if c.AcceptEarlyData {
+		return errEarlyData
+	}
+	if err := c.validateTLSPolicy(); err != nil {
+		return err
+	}
+
+	if c.TransportPath != "" {
+		if !strings.HasPrefix(c.TransportPath, "/") {
+			return fmt.Errorf("TransportPath %q must start with /", c.TransportPath)
+		}
+		if u, err := url.Parse(c.TransportPath); err != nil || u.Path != c.TransportPath {
+			return fmt.Errorf("invalid TransportPath %q", c.TransportPath)
+		}
+	}
+	if c.ConnPoolSize < 0 {
+		return errors.New("negative ConnPoolSize")
+	}
+	switch c.ReconnectPolicy {
+	case ReconnectReject, ReconnectReplace, ReconnectQueue:
+	default:
+		return fmt.Errorf("unknown ReconnectPolicy %d", c.ReconnectPolicy)
+	}
+	if c.HandshakeTimeout < 0 || c.TLSHandshakeTimeout < 0 || c.IdleTimeout < 0 || c.ReadIdleTimeout < 0 || c.MaxConnLifetime < 0 || c.TCPKeepAlive < 0 || c.PingTimeout < 0 || c.CertClockSkew < 0 || c.DialWait < 0 || c.ProxyTimeout < 0 || c.ResponseHeaderTimeout < 0 || c.MaxStall < 0 || c.FlapWindow < 0 {
+		return errors.New("negative timeout")
+	}
+	if c.TransferBufferSize < 0 {
+		return errors.New("negative TransferBufferSize")
+	}
+	if c.PipeBufferSize < 0 {
+		return errors.New("negative PipeBufferSize")
+	}
+	if c.FlapThreshold < 0 {
+		return errors.New("negative FlapThreshold")
+	}
+	if c.MaxHandshakesPerSecond < 0 || c.MaxHandshakesPerSecondPerIP < 0 {
+		return errors.New("negative handshake rate limit")
+	}
+	if c.MaxRequestBytes < 0 || c.MaxHeaderBytes < 0 {
+		return errors.New("negative request size limit")
+	}
+
+	return nil
+}
+
+// clientInfo holds server side state of an allowed client.
+type clientInfo struct {
+	config   *AllowedClient
+	hosts    []*AllowedClient
+	limiters *clientLimiters
+	active   int64
+}
+
+// hostConfig returns AllowedClient of the client applying to host, that is
+// the one with the most specific Hosts entry matching the host or else the one
+// without Hosts. It returns nil if the client may not serve the host.
+func (c *clientInfo) hostConfig(host string) *AllowedClient {
+	for _, pattern := range hostPatterns(trimPort(host)) {
+		for _, config := range c.hosts {
+			for _, h := range config.Hosts {
+				if trimPort(h) == pattern {
+					return config
+				}
+			}
+		}
+	}
+	for _, config := range c.hosts {
+		if len(config.Hosts) == 0 {
+			return config
+		}
+	}
+	return nil
+}
+
+// ClientStatus describes state of a subscribed client.
+type ClientStatus struct {
+	// ID is the client identifier.
+	ID id.ID
+	// Name is AllowedClient.Name of the client.
+	Name string
+	// Labels are AllowedClient.Labels of the client.
+	Labels map[string]string
+	// Hosts are HTTP hosts served by the client.
+	Hosts []string
+	// Connected is true if client has a live control connection.
+	Connected bool
+	// RemoteAddr is network address of the control connection.
+	RemoteAddr net.Addr
+	// ConnectedAt is the time the control connection was established.
+	ConnectedAt time.Time
+	// TLS is state of the control connection, it's nil for connections
+	// without TLS i.e. with InsecureControl.
+	TLS *tls.ConnectionState
+}
+
 // Server is responsible for proxying public connections to the client over a
 // tunnel connection.
 type Server struct {
 	*registry
 	config *ServerConfig
 
-	listener   net.Listener
-	connPool   *connPool
-	httpClient *http.Client
-	logger     log.Logger
+	listener            net.Listener
+	clients             map[id.ID]*clientInfo
+	connPool            *connPool
+	httpClient          *http.Client
+	handshakeTimeout    time.Duration
+	tlsHandshakeTimeout time.Duration
+	pingTimeout         time.Duration
+	bufferPool          *bufferPool
+	metrics             Metrics
+	accessLog           *accessLog
+	handshakeLimiter    *handshakeLimiter
+	sni                 *sniRouter
+	sharedRegistry      Registry
+	instance            string
+	peerProxy           *httputil.ReverseProxy
+	logger              log.Logger
+
+	sessions   sync.WaitGroup
+	sessionsMu sync.Mutex
+	shutdown   bool
+
+	activeSessions int64
+	totalSessions  int64
+	failedSessions int64
+	slowConsumers  int64
+
+	revoked   map[id.ID]bool
+	revokedMu sync.RWMutex
+
+	connects   map[id.ID][]time.Time
+	connectsMu sync.Mutex
+
+	connected   *sync.Cond
+	connectedMu sync.Mutex
+
+	done     chan struct{}
+	stopOnce sync.Once
+
+	routines sync.WaitGroup
+	// terminated is closed when the first of Stop, Shutdown or closing of
+	// the listener by its owner finishes, err is the terminal error.
+	terminated    chan struct{}
+	terminateOnce sync.Once
+	terminalErr   error
 }
 
 // NewServer creates a new Server.
 func NewServer(config *ServerConfig) (*Server, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
 	listener, err := listener(config)
 	if err != nil {
 		return nil, fmt.Errorf("listener failed: %s", err)
@@ -64,40 +616,157 @@ func NewServer(config *ServerConfig) (*Server, error) {
 		logger = log.NewNopLogger()
 	}
 
+	var metrics Metrics = nopMetrics{}
+	if config.Metrics != nil {
+		metrics = config.Metrics
+	}
+
+	handshakeTimeout := config.HandshakeTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = DefaultTimeout
+	}
+
+	tlsHandshakeTimeout := config.TLSHandshakeTimeout
+	if tlsHandshakeTimeout == 0 {
+		tlsHandshakeTimeout = handshakeTimeout
+	}
+
+	pingTimeout := config.PingTimeout
+	if pingTimeout == 0 {
+		pingTimeout = DefaultPingTimeout
+	}
+
 	s := &Server{
-		registry: newRegistry(logger),
-		config:   config,
-		listener: listener,
-		logger:   logger,
+		registry:            newRegistry(config.LoadBalance, logger),
+		config:              config,
+		listener:            listener,
+		handshakeTimeout:    handshakeTimeout,
+		tlsHandshakeTimeout: tlsHandshakeTimeout,
+		pingTimeout:         pingTimeout,
+		bufferPool:          defaultBufferPool,
+		metrics:             metrics,
+		handshakeLimiter:    newHandshakeLimiter(config.MaxHandshakesPerSecond, config.MaxHandshakesPerSecondPerIP),
+		sni:                 newSNIRouter(config.DataListener),
+		logger:              logger,
+		done:                make(chan struct{}),
+		terminated:          make(chan struct{}),
+		clients:             make(map[id.ID]*clientInfo),
+		revoked:             make(map[id.ID]bool),
+		connects:            make(map[id.ID][]time.Time),
 	}
+	s.connected = sync.NewCond(&s.connectedMu)
 
-	t := &http2.Transport{}
-	pool := newConnPool(t, s.disconnected)
-	t.ConnPool = pool
-	s.connPool = pool
-	s.httpClient = &http.Client{
-		Transport: t,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+	s.sharedRegistry = config.Registry
+	if s.sharedRegistry == nil {
+		s.sharedRegistry = NewMemoryRegistry()
+	}
+	s.instance = config.Instance
+	if s.instance == "" {
+		s.instance = listener.Addr().String()
+	}
+	if config.PeerDialer != nil {
+		s.peerProxy = s.newPeerProxy()
+	}
+
+	if config.AccessLog != nil {
+		s.accessLog = &accessLog{w: config.AccessLog}
+	}
+
+	for _, identifier := range config.RevokedIDs {
+		s.revoked[identifier] = true
+	}
+
+	if config.TransferBufferSize > 0 && config.TransferBufferSize != DefaultTransferBufferSize {
+		s.bufferPool = newBufferPool(config.TransferBufferSize)
+	}
+
+	for _, c := range config.AllowedClients {
+		if info, ok := s.clients[c.identifier()]; ok {
+			info.hosts = append(info.hosts, c)
+			continue
+		}
+		s.clients[c.identifier()] = &clientInfo{
+			config:   c,
+			hosts:    []*AllowedClient{c},
+			limiters: newClientLimiters(c),
+		}
+		s.Subscribe(c.identifier())
+	}
+
+	var client http.Client
+	if config.HTTPClient != nil {
+		client = *config.HTTPClient
+	}
+	if client.CheckRedirect == nil {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
-		},
+		}
 	}
 
+	t, ok := client.Transport.(*http2.Transport)
+	if !ok {
+		// responses must reach users with Content-Encoding of the local
+		// service, not transparently decompressed
+		t = &http2.Transport{DisableCompression: true}
+	}
+	if client.Transport == nil {
+		client.Transport = t
+	}
+	if config.TransportOptions != nil {
+		config.TransportOptions(t)
+	}
+	ports := make(map[id.ID]int)
+	for identifier, c := range s.clients {
+		if c.config.Port != 0 {
+			ports[identifier] = c.config.Port
+		}
+	}
+	pool := newConnPool(t, config.ConnPoolSize, ports, s.disconnected)
+	pool.reconnect = config.ReconnectPolicy
+	pool.queueTimeout = handshakeTimeout
+	pool.path = config.TransportPath
+	t.ConnPool = pool
+	s.connPool = pool
+	s.httpClient = &client
+
 	return s, nil
 }
 
+// listenData opens listener of a client tunnel wrapped with wrap if not nil.
+func listenData(network, addr string, wrap func(net.Listener) net.Listener) (net.Listener, error) {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if wrap == nil {
+		return l, nil
+	}
+	if wl := wrap(l); wl != nil {
+		return wl, nil
+	}
+	l.Close()
+	return nil, errNilDataListener
+}
+
 func listener(config *ServerConfig) (net.Listener, error) {
 	if config.Listener != nil {
 		return config.Listener, nil
 	}
 
-	if config.Addr == "" {
-		return nil, errors.New("missing Addr")
+	addr := config.Addr
+	if addr == "" {
+		addr = ":0"
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid Addr %q: %s", addr, err)
 	}
-	if config.TLSConfig == nil {
-		return nil, errors.New("missing TLSConfig")
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("bind to %q failed: %s", addr, err)
 	}
 
-	return net.Listen("tcp", config.Addr)
+	return l, nil
 }
 
 // disconnected clears resources used by client, it's invoked by connection pool
@@ -113,20 +782,45 @@ func (s *Server) disconnected(identifier id.ID) {
 	if i == nil {
 		return
 	}
+	s.unregister(identifier)
+
+	if s.config.OnClientDisconnect != nil {
+		go s.config.OnClientDisconnect(s.allowedClient(identifier))
+	}
+
+	// let accept loops know that close is deliberate
+	if i.closed != nil {
+		close(i.closed)
+	}
+
+	s.sni.remove(identifier)
+
 	for _, l := range i.Listeners {
 		s.logger.Log(
 			"level", 2,
 			"action", "close listener",
 			"identifier", identifier,
-			"addr", l.Addr(),
+			"addr", l.Listener.Addr(),
 		)
-		l.Close()
+		l.Listener.Close()
+	}
+	for _, pc := range i.PacketListeners {
+		s.logger.Log(
+			"level", 2,
+			"action", "close packet listener",
+			"identifier", identifier,
+			"addr", pc.LocalAddr(),
+		)
+		pc.Close()
 	}
 }
 
 // Start starts accepting connections form clients. For accepting http traffic
 // from end users server must be run as handler on http server.
 func (s *Server) Start() {
+	s.routines.Add(1)
+	defer s.routines.Done()
+
 	addr := s.listener.Addr().String()
 
 	s.logger.Log(
@@ -135,15 +829,43 @@ func (s *Server) Start() {
 		"addr", addr,
 	)
 
+	if s.config.IdleTimeout > 0 {
+		s.routines.Add(1)
+		go func() {
+			defer s.routines.Done()
+			s.evictIdle()
+		}()
+	}
+	if s.config.ReadIdleTimeout > 0 {
+		s.routines.Add(1)
+		go func() {
+			defer s.routines.Done()
+			s.healthCheck()
+		}()
+	}
+	if s.config.MaxConnLifetime > 0 {
+		s.routines.Add(1)
+		go func() {
+			defer s.routines.Done()
+			s.expireConns()
+		}()
+	}
+
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
-			if strings.Contains(err.Error(), "use of closed network connection") {
+			if listenerClosed(s.done, err) {
 				s.logger.Log(
 					"level", 1,
 					"action", "control connection listener closed",
 					"addr", addr,
 				)
+				// listener may be closed by its owner
+				select {
+				case <-s.done:
+				default:
+					s.Stop()
+				}
 				return
 			}
 
@@ -156,7 +878,18 @@ func (s *Server) Start() {
 			continue
 		}
 
-		if err := keepAlive(conn); err != nil {
+		if !s.handshakeLimiter.allow(trimPort(conn.RemoteAddr().String())) {
+			conn.Close()
+			s.metrics.HandshakeRejected(RejectRateLimit.String())
+			s.logger.Log(
+				"level", 3,
+				"action", "rate limited",
+				"addr", conn.RemoteAddr(),
+			)
+			continue
+		}
+
+		if err := s.keepAlive(conn); err != nil {
 			s.logger.Log(
 				"level", 0,
 				"msg", "TCP keepalive for control connection failed",
@@ -165,12 +898,95 @@ func (s *Server) Start() {
 			)
 		}
 
-		go s.handleClient(tls.Server(conn, s.config.TLSConfig))
+		s.metrics.ControlConnAccepted()
+
+		if s.config.InsecureControl {
+			go s.handleClient(conn)
+		} else {
+			go s.handleClient(tls.Server(conn, s.config.TLSConfig))
+		}
+	}
+}
+
+// RejectReason describes why a client was rejected.
+type RejectReason int
+
+// Client rejection reasons.
+const (
+	// RejectInvalidConn is reported for non TLS connections.
+	RejectInvalidConn RejectReason = iota + 1
+	// RejectDeadline is reported if setting connection deadline fails.
+	RejectDeadline
+	// RejectTLSHandshake is reported if TLS handshake fails.
+	RejectTLSHandshake
+	// RejectCertificate is reported if client certificate is missing or
+	// invalid.
+	RejectCertificate
+	// RejectCertNotYetValid is reported if VerifyCertValidity is set and
+	// client certificate is not valid yet.
+	RejectCertNotYetValid
+	// RejectCertExpired is reported if VerifyCertValidity is set and
+	// client certificate expired.
+	RejectCertExpired
+	// RejectRevoked is reported for revoked clients.
+	RejectRevoked
+	// RejectUnknownClient is reported for clients that are not subscribed.
+	RejectUnknownClient
+	// RejectPreface is reported if reading of connection preface fails.
+	RejectPreface
+	// RejectConnPool is reported if connection cannot be added to the
+	// connection pool i.e. ConnPoolSize is exceeded.
+	RejectConnPool
+	// RejectHandshake is reported if control handshake fails, including
+	// writing of InsecureControl upgrade response, or client sends no
+	// tunnels.
+	RejectHandshake
+	// RejectAddTunnels is reported if tunnels requested by client cannot
+	// be opened.
+	RejectAddTunnels
+	// RejectToken is reported if InsecureControl is set and reading of
+	// upgrade request fails or it carries no token.
+	RejectToken
+	// RejectRateLimit is reported for connections over
+	// MaxHandshakesPerSecond or MaxHandshakesPerSecondPerIP limit.
+	RejectRateLimit
+	// RejectTLSPolicy is reported if TLS version or cipher suite of control
+	// connection is not allowed by MinTLSVersion or AllowedCipherSuites.
+	RejectTLSPolicy
+)
+
+var rejectReasonText = map[RejectReason]string{
+	RejectInvalidConn:     "invalid connection type",
+	RejectDeadline:        "setting deadline failed",
+	RejectTLSHandshake:    "TLS handshake failed",
+	RejectCertificate:     "certificate error",
+	RejectCertNotYetValid: "certificate not yet valid",
+	RejectCertExpired:     "certificate expired",
+	RejectRevoked:         "revoked client",
+	RejectUnknownClient:   "unknown client",
+	RejectPreface:         "reading connection preface failed",
+	RejectConnPool:        "adding connection failed",
+	RejectHandshake:       "handshake failed",
+	RejectAddTunnels:      "adding tunnels failed",
+	RejectToken:           "token error",
+	RejectRateLimit:       "rate limited",
+	RejectTLSPolicy:       "TLS policy violation",
+}
+
+// String returns short description of the reason, it's the reason reported
+// to Metrics.HandshakeRejected.
+func (r RejectReason) String() string {
+	if t, ok := rejectReasonText[r]; ok {
+		return t
 	}
+	return fmt.Sprintf("RejectReason(%d)", int(r))
 }
 
 func (s *Server) handleClient(conn net.Conn) {
-	logger := log.NewContext(s.logger).With("addr", conn.RemoteAddr())
+	logger := log.NewContext(s.logger).With(
+		"addr", conn.RemoteAddr(),
+		"requestID", newRequestID(),
+	)
 
 	logger.Log(
 		"level", 1,
@@ -179,36 +995,139 @@ func (s *Server) handleClient(conn net.Conn) {
 
 	var (
 		identifier id.ID
+		br         *bufio.Reader
+		head       []byte
 		req        *http.Request
 		resp       *http.Response
 		tunnels    map[string]*proto.Tunnel
 		err        error
 		ok         bool
+		joined     bool
+		reason     RejectReason
+		tlsConn    *tls.Conn
+		token      string
 
+		upgrading  bool
 		inConnPool bool
 	)
 
-	tlsConn, ok := conn.(*tls.Conn)
+	if s.config.InsecureControl {
+		if err = conn.SetDeadline(time.Now().Add(s.handshakeTimeout)); err != nil {
+			logger.Log(
+				"level", 2,
+				"msg", "setting handshake deadline failed",
+				"err", err,
+			)
+			reason = RejectDeadline
+			goto reject
+		}
+
+		upgrading = true
+		var uc net.Conn
+		if identifier, uc, err = readUpgrade(conn); err != nil {
+			logger.Log(
+				"level", 2,
+				"msg", "token error",
+				"err", err,
+			)
+			reason = RejectToken
+			goto reject
+		}
+		conn = uc
+		goto authenticated
+	}
+
+	tlsConn, ok = conn.(*tls.Conn)
 	if !ok {
 		logger.Log(
 			"level", 0,
 			"msg", "invalid connection type",
 			"err", fmt.Errorf("expected TLS conn, got %T", conn),
 		)
+		reason = RejectInvalidConn
+		goto reject
+	}
+
+	if err = conn.SetDeadline(time.Now().Add(s.tlsHandshakeTimeout)); err != nil {
+		logger.Log(
+			"level", 2,
+			"msg", "setting TLS handshake deadline failed",
+			"err", err,
+		)
+		reason = RejectDeadline
+		goto reject
+	}
+
+	// identity and control messages are trusted only after full handshake,
+	// no replayable 0-RTT data is accepted, see AcceptEarlyData
+	if err = tlsConn.Handshake(); err != nil {
+		logger.Log(
+			"level", 2,
+			"msg", "TLS handshake failed",
+			"err", err,
+		)
+		reason = RejectTLSHandshake
+		goto reject
+	}
+
+	if err = conn.SetDeadline(time.Now().Add(s.handshakeTimeout)); err != nil {
+		logger.Log(
+			"level", 2,
+			"msg", "setting handshake deadline failed",
+			"err", err,
+		)
+		reason = RejectDeadline
 		goto reject
 	}
 
-	identifier, err = id.PeerID(tlsConn)
+	identifier, err = s.peerID(tlsConn)
 	if err != nil {
 		logger.Log(
 			"level", 2,
 			"msg", "certificate error",
 			"err", err,
 		)
+		reason = RejectCertificate
 		goto reject
 	}
 
+authenticated:
 	logger = logger.With("identifier", identifier)
+	if c, ok := s.clients[identifier]; ok && c.config.Name != "" {
+		logger = logger.With("name", c.config.Name)
+	}
+
+	if s.IsRevoked(identifier) {
+		logger.Log(
+			"level", 2,
+			"msg", "revoked client",
+		)
+		reason = RejectRevoked
+		goto reject
+	}
+
+	if tlsConn != nil {
+		if err = s.checkTLSPolicy(connectionState(tlsConn)); err != nil {
+			logger.Log(
+				"level", 2,
+				"msg", "TLS policy violation",
+				"err", err,
+			)
+			reason = RejectTLSPolicy
+			goto reject
+		}
+	}
+
+	if s.config.VerifyCertValidity && tlsConn != nil {
+		if reason, err = checkCertValidity(tlsConn, time.Now(), s.config.CertClockSkew); err != nil {
+			logger.Log(
+				"level", 2,
+				"msg", reason.String(),
+				"err", err,
+			)
+			goto reject
+		}
+	}
 
 	if s.config.AutoSubscribe {
 		s.Subscribe(identifier)
@@ -217,26 +1136,80 @@ func (s *Server) handleClient(conn net.Conn) {
 			"level", 2,
 			"msg", "unknown client",
 		)
+		reason = RejectUnknownClient
 		goto reject
 	}
 
-	if err = conn.SetDeadline(time.Time{}); err != nil {
+	if upgrading {
+		if err = acceptUpgrade(conn); err != nil {
+			logger.Log(
+				"level", 2,
+				"msg", "upgrade failed",
+				"err", err,
+			)
+			// upgrade response may be partially written, do not send
+			// rejection
+			upgrading = false
+			reason = RejectHandshake
+			goto reject
+		}
+		upgrading = false
+	}
+
+	// control connection client sends HTTP/2 SETTINGS frame, forwarded
+	// connection starts with HTTP/1.1 request
+	br = bufio.NewReaderSize(conn, len(forwardRequestPrefix))
+	if head, err = br.Peek(len(forwardRequestPrefix)); err != nil {
 		logger.Log(
 			"level", 2,
-			"msg", "setting infinite deadline failed",
+			"msg", "reading connection preface failed",
 			"err", err,
 		)
+		reason = RejectPreface
 		goto reject
 	}
+	if string(head) == forwardRequestPrefix {
+		s.audit(AuditAccept, conn, identifier, 0, nil)
+		s.serveForward(conn, br, identifier, logger)
+		return
+	}
 
-	if err := s.connPool.AddConn(conn, identifier); err != nil {
+	token = newConnToken()
+	if joined, err = s.connPool.AddConn(bufferedConn{conn, br}, identifier, token); err != nil {
 		logger.Log(
 			"level", 2,
 			"msg", "adding connection failed",
 			"err", err,
 		)
+		reason = RejectConnPool
 		goto reject
 	}
+	// tunnels are already opened by the first connection
+	if joined {
+		if err = conn.SetDeadline(time.Time{}); err != nil {
+			logger.Log(
+				"level", 2,
+				"msg", "setting infinite deadline failed",
+				"err", err,
+			)
+			s.connPool.DeleteConnToken(identifier, token)
+			return
+		}
+		if err = s.sendConnToken(identifier, token); err != nil {
+			logger.Log(
+				"level", 2,
+				"msg", "sending disconnect token failed",
+				"err", err,
+			)
+		}
+		logger.Log(
+			"level", 1,
+			"action", "joined connection pool",
+		)
+		s.audit(AuditAccept, conn, identifier, 0, nil)
+		s.notifyConnected()
+		return
+	}
 	inConnPool = true
 
 	req, err = http.NewRequest(http.MethodConnect, s.connPool.URL(identifier), nil)
@@ -246,11 +1219,13 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "handshake request creation failed",
 			"err", err,
 		)
+		reason = RejectHandshake
 		goto reject
 	}
+	req.Header.Set(proto.HeaderConnToken, token)
 
 	{
-		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), s.handshakeTimeout)
 		defer cancel()
 		req = req.WithContext(ctx)
 	}
@@ -262,6 +1237,7 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "handshake failed",
 			"err", err,
 		)
+		reason = RejectHandshake
 		goto reject
 	}
 
@@ -272,6 +1248,7 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "handshake failed",
 			"err", err,
 		)
+		reason = RejectHandshake
 		goto reject
 	}
 
@@ -282,6 +1259,7 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "handshake failed",
 			"err", err,
 		)
+		reason = RejectHandshake
 		goto reject
 	}
 
@@ -291,6 +1269,7 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "handshake failed",
 			"err", err,
 		)
+		reason = RejectHandshake
 		goto reject
 	}
 
@@ -301,15 +1280,27 @@ func (s *Server) handleClient(conn net.Conn) {
 			"msg", "handshake failed",
 			"err", err,
 		)
+		reason = RejectHandshake
+		goto reject
+	}
+
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		logger.Log(
+			"level", 2,
+			"msg", "setting infinite deadline failed",
+			"err", err,
+		)
+		reason = RejectDeadline
 		goto reject
 	}
 
 	if err = s.addTunnels(tunnels, identifier); err != nil {
 		logger.Log(
 			"level", 2,
-			"msg", "handshake failed",
+			"msg", "adding tunnels failed",
 			"err", err,
 		)
+		reason = RejectAddTunnels
 		goto reject
 	}
 
@@ -317,6 +1308,14 @@ func (s *Server) handleClient(conn net.Conn) {
 		"level", 1,
 		"action", "connected",
 	)
+	s.audit(AuditAccept, conn, identifier, 0, nil)
+	s.recordConnect(identifier)
+
+	s.notifyConnected()
+
+	if s.config.OnClientConnect != nil {
+		go s.config.OnClientConnect(s.allowedClient(identifier), conn)
+	}
 
 	return
 
@@ -326,10 +1325,23 @@ reject:
 		"action", "rejected",
 	)
 
+	s.metrics.HandshakeRejected(reason.String())
+
 	if inConnPool {
 		s.notifyError(err, identifier)
 		s.connPool.DeleteConn(identifier)
 	}
+	if upgrading {
+		rejectUpgrade(conn, reason)
+	}
+
+	if s.config.OnReject != nil {
+		s.config.OnReject(conn.RemoteAddr().String(), reason)
+	}
+	if err != nil {
+		err = &ProxyError{Op: OpHandshake, Phase: PhaseHandshake, Err: err}
+	}
+	s.audit(AuditReject, conn, identifier, reason, err)
 
 	conn.Close()
 }
@@ -359,25 +1371,87 @@ func (s *Server) notifyError(serverError error, identifier id.ID) {
 	s.httpClient.Do(req.WithContext(ctx))
 }
 
+// checkCertValidity checks if peer certificate of conn is valid at now
+// tolerating skew, on failure it returns rejection reason and error.
+func checkCertValidity(conn *tls.Conn, now time.Time, skew time.Duration) (RejectReason, error) {
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return RejectCertificate, errors.New("no peer certificate")
+	}
+	cert := certs[0]
+
+	if now.Add(skew).Before(cert.NotBefore) {
+		return RejectCertNotYetValid, fmt.Errorf("certificate valid from %s", cert.NotBefore)
+	}
+	if now.Add(-skew).After(cert.NotAfter) {
+		return RejectCertExpired, fmt.Errorf("certificate expired at %s", cert.NotAfter)
+	}
+
+	return 0, nil
+}
+
 // addTunnels invokes addHost or addListener based on data from proto.Tunnel. If
 // a tunnel cannot be added whole batch is reverted.
 func (s *Server) addTunnels(tunnels map[string]*proto.Tunnel, identifier id.ID) error {
 	i := &RegistryItem{
 		Hosts:     []*HostAuth{},
-		Listeners: []net.Listener{},
+		Listeners: []*ListenerSpec{},
+		closed:    make(chan struct{}),
 	}
 
-	var err error
+	var (
+		sniListeners  []*sniListener
+		packetTunnels []string
+		err           error
+	)
 	for name, t := range tunnels {
 		switch t.Protocol {
 		case proto.HTTP:
-			i.Hosts = append(i.Hosts, &HostAuth{t.Host, NewAuth(t.Auth)})
+			h := &HostAuth{
+				Host:   t.Host,
+				Auth:   NewAuth(t.Auth),
+				Tunnel: name,
+			}
+			if c, ok := s.clients[identifier]; ok {
+				config := c.hostConfig(t.Host)
+				if config == nil {
+					err = fmt.Errorf("host not allowed for tunnel %s: %q", name, t.Host)
+					goto rollback
+				}
+				h.PathPrefixes = config.PathPrefixes
+				h.StripPathPrefix = config.StripPathPrefix
+				h.Sticky = config.Sticky
+				h.StickyCookie = config.StickyCookie
+				h.Weight = config.Weight
+			}
+			i.Hosts = append(i.Hosts, h)
 		case proto.TCP, proto.TCP4, proto.TCP6, proto.UNIX:
+			spec := &ListenerSpec{Tunnel: name}
+			switch t.AppProtocol {
+			case "", proto.HTTP, proto.TCP, proto.TCP4, proto.TCP6, proto.UNIX:
+				spec.Protocol = t.AppProtocol
+			default:
+				err = fmt.Errorf("unsupported application protocol for tunnel %s: %s", name, t.AppProtocol)
+				goto rollback
+			}
+			if t.Target != "" {
+				spec.TargetHost, spec.TargetPort, err = splitTarget(t.Target)
+				if err != nil {
+					err = fmt.Errorf("invalid target for tunnel %s: %s", name, err)
+					goto rollback
+				}
+			}
+			if !s.targetAllowed(identifier, t.Target) {
+				err = fmt.Errorf("target not allowed for tunnel %s: %q", name, t.Target)
+				goto rollback
+			}
+
 			var l net.Listener
-			l, err = net.Listen(t.Protocol, t.Addr)
+			l, err = listenData(t.Protocol, t.Addr, s.config.DataListener)
 			if err != nil {
 				goto rollback
 			}
+			spec.Listener = l
 
 			s.logger.Log(
 				"level", 2,
@@ -386,9 +1460,56 @@ func (s *Server) addTunnels(tunnels map[string]*proto.Tunnel, identifier id.ID)
 				"addr", l.Addr(),
 			)
 
-			i.Listeners = append(i.Listeners, l)
-		default:
-			err = fmt.Errorf("unsupported protocol for tunnel %s: %s", name, t.Protocol)
+			i.Listeners = append(i.Listeners, spec)
+		case proto.UDP:
+			var pc net.PacketConn
+			pc, err = net.ListenPacket(t.Protocol, t.Addr)
+			if err != nil {
+				goto rollback
+			}
+
+			s.logger.Log(
+				"level", 2,
+				"action", "open packet listener",
+				"identifier", identifier,
+				"addr", pc.LocalAddr(),
+			)
+
+			i.PacketListeners = append(i.PacketListeners, pc)
+			packetTunnels = append(packetTunnels, name)
+		case proto.SNI:
+			if t.Host == "" {
+				err = fmt.Errorf("missing server name for tunnel %s", name)
+				goto rollback
+			}
+			if !s.targetAllowed(identifier, t.Target) {
+				err = fmt.Errorf("target not allowed for tunnel %s: %q", name, t.Target)
+				goto rollback
+			}
+
+			var (
+				sl     *sniListener
+				opened bool
+			)
+			sl, opened, err = s.sni.add(t.Addr, t.Host, t.Target, name, identifier)
+			if err != nil {
+				err = fmt.Errorf("tunnel %s: %s", name, err)
+				goto rollback
+			}
+
+			s.logger.Log(
+				"level", 2,
+				"action", "add server name",
+				"identifier", identifier,
+				"addr", sl.l.Addr(),
+				"host", t.Host,
+			)
+
+			if opened {
+				sniListeners = append(sniListeners, sl)
+			}
+		default:
+			err = fmt.Errorf("unsupported protocol for tunnel %s: %s", name, t.Protocol)
 			goto rollback
 		}
 	}
@@ -399,38 +1520,205 @@ func (s *Server) addTunnels(tunnels map[string]*proto.Tunnel, identifier id.ID)
 	}
 
 	for _, l := range i.Listeners {
-		go s.listen(l, identifier)
+		if l.Protocol == proto.HTTP {
+			go s.listenHTTP(l, identifier, i.closed)
+		} else {
+			go s.listen(l, identifier, i.closed)
+		}
+	}
+	for n, pc := range i.PacketListeners {
+		go s.listenPacket(pc, packetTunnels[n], identifier, i.closed)
 	}
+	for _, sl := range sniListeners {
+		go s.listenSNI(sl)
+	}
+
+	s.register(identifier, i)
 
 	return nil
 
 rollback:
 	for _, l := range i.Listeners {
-		l.Close()
+		l.Listener.Close()
 	}
+	for _, pc := range i.PacketListeners {
+		pc.Close()
+	}
+	s.sni.remove(identifier)
 
 	return err
 }
 
+// targetAllowed returns true if client may forward TCP tunnel to target.
+func (s *Server) targetAllowed(identifier id.ID, target string) bool {
+	c, ok := s.clients[identifier]
+	if !ok || len(c.config.AllowedTargets) == 0 {
+		return true
+	}
+	for _, v := range c.config.AllowedTargets {
+		if v == target {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedClient returns AllowedClient of client, if client is not configured
+// AllowedClient with only ID set is returned.
+func (s *Server) allowedClient(identifier id.ID) *AllowedClient {
+	if c, ok := s.clients[identifier]; ok {
+		return c.config
+	}
+	return &AllowedClient{ID: identifier}
+}
+
+// clientLabels returns name and copy of labels of allowed client, if client is
+// not configured or has no labels they're empty.
+func (s *Server) clientLabels(identifier id.ID) (string, map[string]string) {
+	c, ok := s.clients[identifier]
+	if !ok {
+		return "", nil
+	}
+
+	var labels map[string]string
+	if len(c.config.Labels) > 0 {
+		labels = make(map[string]string, len(c.config.Labels))
+		for k, v := range c.config.Labels {
+			labels[k] = v
+		}
+	}
+	return c.config.Name, labels
+}
+
+// forwardAllowed returns true if client may forward connections to target.
+func (s *Server) forwardAllowed(identifier id.ID, target string) bool {
+	c, ok := s.clients[identifier]
+	if !ok {
+		return false
+	}
+	for _, v := range c.config.ForwardTargets {
+		if v == target {
+			return true
+		}
+	}
+	return false
+}
+
+// listenerClosed returns true if accept or read error err is caused by
+// closing the listener rather than a failure.
+func listenerClosed(closed <-chan struct{}, err error) bool {
+	select {
+	case <-closed:
+		return true
+	default:
+	}
+	return errors.Is(err, net.ErrClosed)
+}
+
 // Unsubscribe removes client from registry, disconnects client if already
 // connected and returns it's RegistryItem.
 func (s *Server) Unsubscribe(identifier id.ID) *RegistryItem {
+	s.auditRemove(AuditUnsubscribe, identifier)
 	s.connPool.DeleteConn(identifier)
 	return s.registry.Unsubscribe(identifier)
 }
 
-// Ping measures the RTT response time.
+// Clients returns status of all subscribed clients ordered by identifier.
+func (s *Server) Clients() []ClientStatus {
+	var clients []ClientStatus
+	for identifier, i := range s.Subscribers() {
+		c := ClientStatus{
+			ID: identifier,
+		}
+		c.Name, c.Labels = s.clientLabels(identifier)
+		for _, h := range i.Hosts {
+			c.Hosts = append(c.Hosts, h.Host)
+		}
+		c.RemoteAddr, c.ConnectedAt, c.Connected = s.connPool.Status(identifier)
+		if conn := s.connPool.Conn(identifier); conn != nil {
+			c.TLS = connectionState(conn)
+		}
+
+		clients = append(clients, c)
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ID.Compare(clients[j].ID) < 0
+	})
+
+	return clients
+}
+
+// Revoke rejects all future connections of a client and closes connections
+// of the client if it's connected.
+func (s *Server) Revoke(identifier id.ID) {
+	s.revokedMu.Lock()
+	s.revoked[identifier] = true
+	s.revokedMu.Unlock()
+
+	s.logger.Log(
+		"level", 1,
+		"action", "revoke",
+		"identifier", identifier,
+	)
+	s.auditRemove(AuditRevoke, identifier)
+
+	s.connPool.DeleteConn(identifier)
+}
+
+// Unrevoke allows a revoked client to connect again.
+func (s *Server) Unrevoke(identifier id.ID) {
+	s.revokedMu.Lock()
+	delete(s.revoked, identifier)
+	s.revokedMu.Unlock()
+}
+
+// IsRevoked returns true if client is revoked.
+func (s *Server) IsRevoked(identifier id.ID) bool {
+	s.revokedMu.RLock()
+	defer s.revokedMu.RUnlock()
+	return s.revoked[identifier]
+}
+
+// Ping measures the RTT response time, it sends ping control message to the
+// client and waits for the response.
 func (s *Server) Ping(identifier id.ID) (time.Duration, error) {
-	return s.connPool.Ping(identifier)
+	msg := &proto.ControlMessage{
+		Action: proto.ActionPing,
+	}
+
+	req, err := s.connectRequest(identifier, msg, nil)
+	if err != nil {
+		return 0, fmt.Errorf("ping request error: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.pingTimeout)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := s.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, fmt.Errorf("ping failed: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("ping failed: status %s", resp.Status)
+	}
+
+	return time.Since(start), nil
 }
 
-func (s *Server) listen(l net.Listener, identifier id.ID) {
+// listen accepts connections on spec listener until closed is closed or the
+// listener is closed otherwise.
+func (s *Server) listen(spec *ListenerSpec, identifier id.ID, closed <-chan struct{}) {
+	l := spec.Listener
 	addr := l.Addr().String()
 
 	for {
 		conn, err := l.Accept()
 		if err != nil {
-			if strings.Contains(err.Error(), "use of closed network connection") {
+			if listenerClosed(closed, err) {
 				s.logger.Log(
 					"level", 2,
 					"action", "listener closed",
@@ -452,11 +1740,26 @@ func (s *Server) listen(l net.Listener, identifier id.ID) {
 
 		msg := &proto.ControlMessage{
 			Action:         proto.ActionProxy,
+			ForwardedFor:   conn.RemoteAddr().String(),
 			ForwardedHost:  l.Addr().String(),
-			ForwardedProto: l.Addr().Network(),
+			ForwardedProto: spec.protocol(),
+			RequestID:      newRequestID(),
+			Target:         spec.target(),
+			Tunnel:         spec.Tunnel,
+		}
+
+		if s.shedLoad() {
+			s.logger.Log(
+				"level", 1,
+				"action", "rejected connection, server is overloaded",
+				"identifier", identifier,
+				"addr", addr,
+			)
+			conn.Close()
+			continue
 		}
 
-		if err := keepAlive(conn); err != nil {
+		if err := s.keepAlive(conn); err != nil {
 			s.logger.Log(
 				"level", 1,
 				"msg", "TCP keepalive for tunneled connection failed",
@@ -465,12 +1768,35 @@ func (s *Server) listen(l net.Listener, identifier id.ID) {
 				"err", err,
 			)
 		}
+		if err := s.noDelay(conn); err != nil {
+			s.logger.Log(
+				"level", 1,
+				"msg", "TCP_NODELAY for tunneled connection failed",
+				"identifier", identifier,
+				"ctrlMsg", msg,
+				"err", err,
+			)
+		}
+
+		if !s.startSession() {
+			s.logger.Log(
+				"level", 2,
+				"action", "rejected connection, server is shutting down",
+				"identifier", identifier,
+				"addr", addr,
+			)
+			conn.Close()
+			continue
+		}
 
 		go func() {
+			defer s.endSession()
 			if err := s.proxyConn(identifier, conn, msg); err != nil {
+				atomic.AddInt64(&s.failedSessions, 1)
 				s.logger.Log(
 					"level", 0,
 					"msg", "proxy error",
+					"requestID", msg.RequestID,
 					"identifier", identifier,
 					"ctrlMsg", msg,
 					"err", err,
@@ -480,163 +1806,942 @@ func (s *Server) listen(l net.Listener, identifier id.ID) {
 	}
 }
 
-// ServeHTTP proxies http connection to the client.
-func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	resp, err := s.RoundTrip(r)
-	if err == errUnauthorised {
-		w.Header().Set("WWW-Authenticate", "Basic realm=\"User Visible Realm\"")
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
+// listenHTTP serves connections accepted on spec listener as HTTP requests,
+// they are handled as requests to HTTP hosts except that they are always sent
+// to the client owning the listener.
+func (s *Server) listenHTTP(spec *ListenerSpec, identifier id.ID, closed <-chan struct{}) {
+	l := spec.Listener
+	addr := l.Addr().String()
+
+	route := &listenerRoute{
+		host: &hostInfo{
+			identifier: identifier,
+			tunnel:     spec.Tunnel,
+		},
+		addr: addr,
 	}
-	if err != nil {
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.ServeHTTP(w, r.WithContext(withListenerRoute(r.Context(), route)))
+		}),
+		ReadHeaderTimeout: DefaultTimeout,
+	}
+
+	err := srv.Serve(l)
+	if listenerClosed(closed, err) {
+		s.logger.Log(
+			"level", 2,
+			"action", "listener closed",
+			"identifier", identifier,
+			"addr", addr,
+		)
+	} else {
 		s.logger.Log(
 			"level", 0,
-			"action", "round trip failed",
-			"addr", r.RemoteAddr,
-			"host", r.Host,
-			"url", r.URL,
+			"msg", "serving HTTP listener failed",
+			"identifier", identifier,
+			"addr", addr,
 			"err", err,
 		)
-
-		http.Error(w, err.Error(), http.StatusBadGateway)
-		return
 	}
-	defer resp.Body.Close()
+	srv.Close()
+}
 
-	copyHeader(w.Header(), resp.Header)
-	w.WriteHeader(resp.StatusCode)
+// listenerRoute pins requests accepted by HTTP listener to the client owning
+// the listener.
+type listenerRoute struct {
+	host *hostInfo
+	addr string
+}
 
-	transfer(w, resp.Body, log.NewContext(s.logger).With(
-		"dir", "client to user",
-		"dst", r.RemoteAddr,
-		"src", r.Host,
-	))
+type listenerRouteKey struct{}
+
+func withListenerRoute(ctx context.Context, route *listenerRoute) context.Context {
+	return context.WithValue(ctx, listenerRouteKey{}, route)
 }
 
-// RoundTrip is http.RoundTriper implementation.
-func (s *Server) RoundTrip(r *http.Request) (*http.Response, error) {
-	identifier, auth, ok := s.Subscriber(r.Host)
-	if !ok {
-		return nil, errClientNotSubscribed
-	}
+// listenerRouteFrom returns listener route of request context or nil.
+func listenerRouteFrom(ctx context.Context) *listenerRoute {
+	route, _ := ctx.Value(listenerRouteKey{}).(*listenerRoute)
+	return route
+}
 
-	outr := r.WithContext(r.Context())
-	if r.ContentLength == 0 {
-		outr.Body = nil // Issue 16036: nil Body for http.Transport retries
-	}
-	outr.Header = cloneHeader(r.Header)
+// listenPacket reads datagrams from pc and proxies them to the client, each
+// source address gets a separate proxy session that is closed after
+// DefaultUDPIdleTimeout of inactivity.
+func (s *Server) listenPacket(pc net.PacketConn, tunnel string, identifier id.ID, closed <-chan struct{}) {
+	addr := pc.LocalAddr().String()
 
-	if auth != nil {
-		user, password, _ := r.BasicAuth()
-		if auth.User != user || auth.Password != password {
-			return nil, errUnauthorised
+	var (
+		sessions   = make(map[string]chan []byte)
+		sessionsMu sync.Mutex
+	)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			if listenerClosed(closed, err) {
+				s.logger.Log(
+					"level", 2,
+					"action", "packet listener closed",
+					"identifier", identifier,
+					"addr", addr,
+				)
+				return
+			}
+
+			s.logger.Log(
+				"level", 0,
+				"msg", "read of datagram failed",
+				"identifier", identifier,
+				"addr", addr,
+				"err", err,
+			)
+			continue
 		}
-		outr.Header.Del("Authorization")
-	}
 
-	setXForwardedFor(outr.Header, r.RemoteAddr)
+		p := make([]byte, n)
+		copy(p, buf[:n])
 
-	scheme := r.URL.Scheme
-	if scheme == "" {
-		if r.TLS != nil {
-			scheme = proto.HTTPS
-		} else {
-			scheme = proto.HTTP
+		key := src.String()
+
+		sessionsMu.Lock()
+		in, ok := sessions[key]
+		if !ok {
+			if s.shedLoad() || !s.startSession() {
+				sessionsMu.Unlock()
+				continue
+			}
+
+			in = make(chan []byte, 64)
+			sessions[key] = in
+
+			msg := &proto.ControlMessage{
+				Action:         proto.ActionProxy,
+				ForwardedFor:   key,
+				ForwardedHost:  addr,
+				ForwardedProto: proto.UDP,
+				RequestID:      newRequestID(),
+				Tunnel:         tunnel,
+			}
+
+			go func() {
+				defer s.endSession()
+				if err := s.proxyPacket(identifier, pc, src, in, msg); err != nil {
+					atomic.AddInt64(&s.failedSessions, 1)
+					s.logger.Log(
+						"level", 0,
+						"msg", "proxy error",
+						"requestID", msg.RequestID,
+						"identifier", identifier,
+						"ctrlMsg", msg,
+						"err", err,
+					)
+				}
+
+				sessionsMu.Lock()
+				delete(sessions, key)
+				sessionsMu.Unlock()
+			}()
 		}
+
+		// drop datagram if session is congested
+		select {
+		case in <- p:
+		default:
+		}
+		sessionsMu.Unlock()
 	}
-	if r.Header.Get("X-Forwarded-Host") == "" {
-		outr.Header.Set("X-Forwarded-Host", r.Host)
-		outr.Header.Set("X-Forwarded-Proto", scheme)
-	}
+}
 
-	msg := &proto.ControlMessage{
-		Action:         proto.ActionProxy,
-		ForwardedHost:  r.Host,
-		ForwardedProto: scheme,
+// ServeHTTP proxies http connection to the client.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.shedLoad() {
+		w.Header().Set("Retry-After", loadShedRetryAfter)
+		http.Error(w, errOverloaded.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if !s.startSession() {
+		http.Error(w, errServerShutdown.Error(), http.StatusServiceUnavailable)
+		return
 	}
+	defer s.endSession()
 
-	return s.proxyHTTP(identifier, outr, msg)
-}
+	requestID := requestIDFrom(r.Context())
+	r = r.WithContext(WithRequestID(r.Context(), requestID))
 
-func (s *Server) proxyConn(identifier id.ID, conn net.Conn, msg *proto.ControlMessage) error {
-	s.logger.Log(
-		"level", 2,
-		"action", "proxy conn",
-		"identifier", identifier,
-		"ctrlMsg", msg,
-	)
+	if s.config.MaxHeaderBytes > 0 && headerSize(r) > s.config.MaxHeaderBytes {
+		s.writeError(w, r, errRequestTooLarge)
+		return
+	}
 
-	defer conn.Close()
+	if r.Method == http.MethodConnect {
+		s.serveConnect(w, r)
+		return
+	}
 
-	pr, pw := io.Pipe()
-	defer pr.Close()
-	defer pw.Close()
+	if isUpgrade(r.Header) {
+		s.serveUpgrade(w, r)
+		return
+	}
 
-	req, err := s.connectRequest(identifier, msg, pr)
-	if err != nil {
-		return err
+	if s.accessLog != nil {
+		sw := &statusWriter{ResponseWriter: w}
+		defer s.accessLog.log(r, sw, time.Now())
+		w = sw
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	req = req.WithContext(ctx)
+	var body *maxBytesBody
+	if max := s.config.MaxRequestBytes; max > 0 && r.Body != nil && r.Body != http.NoBody {
+		if r.ContentLength > max {
+			s.writeError(w, r, errRequestTooLarge)
+			return
+		}
+		body = &maxBytesBody{ReadCloser: http.MaxBytesReader(w, r.Body, max)}
+		r.Body = body
+	}
 
-	done := make(chan struct{})
-	go func() {
-		transfer(pw, conn, log.NewContext(s.logger).With(
-			"dir", "user to client",
-			"dst", identifier,
-			"src", conn.RemoteAddr(),
-		))
-		cancel()
-		close(done)
-	}()
+	st := &sessionStats{start: time.Now(), parent: traceParent(r)}
+	r = r.WithContext(withSessionStats(r.Context(), st))
 
-	resp, err := s.httpClient.Do(req)
+	resp, err := s.RoundTrip(r)
+	if body.isExceeded() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		err = errRequestTooLarge
+	}
+	var recompress bool
+	if err == nil && s.config.DecompressResponses && r.Method != http.MethodHead {
+		recompress = decompressResponse(resp) && s.config.RecompressResponses
+	}
+	if err == nil && s.config.ModifyResponse != nil {
+		resp.Request = r
+		if err = s.config.ModifyResponse(resp); err != nil {
+			resp.Body.Close()
+			err = &ProxyError{Op: OpModifyResponse, Phase: PhaseRoundTrip, Err: err}
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("io error: %s", err)
+		s.sessionDone(st, err)
+		s.writeError(w, r, err)
+		return
 	}
 	defer resp.Body.Close()
 
-	transfer(conn, resp.Body, log.NewContext(s.logger).With(
-		"dir", "client to user",
-		"dst", conn.RemoteAddr(),
-		"src", identifier,
-	))
+	if recompress {
+		recompress = recompressResponse(resp)
+	}
 
-	<-done
+	copyHeader(w.Header(), resp.Header)
+	announced := announceTrailers(w.Header(), resp)
+	w.WriteHeader(resp.StatusCode)
+	// send headers before the body so that the response is chunked
+	if len(resp.Trailer) > 0 {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
 
-	s.logger.Log(
+	var (
+		dst io.Writer = w
+		gz  *gzip.Writer
+	)
+	if recompress {
+		gz = gzip.NewWriter(w)
+		dst = gzipFlushWriter{gz, w}
+	}
+	dst, stop := s.flushingWriter(dst, resp)
+	dst, stopStall := s.stallWriter(dst, w, st)
+	n, err := s.transfer(dst, resp.Body, log.NewContext(s.logger).With(
+		"requestID", requestID,
+		"dir", DirClientToUser,
+		"dst", r.RemoteAddr,
+		"src", r.Host,
+	))
+	stopStall()
+	stop()
+	// closed after flushing is stopped, flush timer must not use it
+	if gz != nil {
+		if cerr := gz.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		err = &ProxyError{Op: OpCopy, Phase: PhaseCopyRemoteToLocal, Dir: DirClientToUser, Err: err}
+	} else {
+		copyTrailers(w.Header(), resp, announced)
+	}
+	st.addOut(n)
+	s.metrics.BytesTransferred(trimPort(r.Host), DirClientToUser, n)
+	s.sessionDone(st, err)
+}
+
+// notFound handles requests to hosts not served by any client.
+func (s *Server) notFound(w http.ResponseWriter, r *http.Request) {
+	requestID, _ := RequestID(r.Context())
+
+	s.logger.Log(
+		"level", 2,
+		"action", "tunnel not found",
+		"requestID", requestID,
+		"addr", r.RemoteAddr,
+		"host", r.Host,
+		"url", r.URL,
+	)
+
+	if s.config.NotFoundHandler != nil {
+		s.config.NotFoundHandler.ServeHTTP(w, r)
+		return
+	}
+	http.Error(w, errTunnelNotFound.Error(), http.StatusNotFound)
+}
+
+// connectionEstablishedResponse is written to hijacked CONNECT connection.
+const connectionEstablishedResponse = "HTTP/1.1 200 Connection established\r\n\r\n"
+
+// serviceUnavailableResponse is written instead of upgrade response if local
+// service is unhealthy.
+const serviceUnavailableResponse = "HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+
+// serveConnect handles CONNECT requests making the server usable as HTTP proxy
+// for TCP tunnels, request authority port selects the tunnel listening on that
+// port. After responding 200 the connection is hijacked and proxied the same
+// way as connections accepted by the tunnel listener.
+func (s *Server) serveConnect(w http.ResponseWriter, r *http.Request) {
+	_, p, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	spec, identifier, ok := s.tcpListener(port)
+	if !ok {
+		s.writeError(w, r, errClientNotSubscribed)
+		return
+	}
+	if !s.connPool.IsConnected(identifier) {
+		s.writeError(w, r, errClientNotConnected)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		s.writeError(w, r, errConnectNotSupported)
+		return
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		s.logger.Log(
+			"level", 0,
+			"msg", "hijack failed",
+			"addr", r.RemoteAddr,
+			"host", r.Host,
+			"err", err,
+		)
+		return
+	}
+
+	if _, err := io.WriteString(conn, connectionEstablishedResponse); err != nil {
+		conn.Close()
+		return
+	}
+
+	// client may send data before reading the response
+	if brw.Reader.Buffered() > 0 {
+		conn = bufferedConn{conn, brw.Reader}
+	}
+
+	l := spec.Listener
+	requestID, _ := RequestID(r.Context())
+	msg := &proto.ControlMessage{
+		Action:         proto.ActionProxy,
+		ForwardedFor:   r.RemoteAddr,
+		ForwardedHost:  l.Addr().String(),
+		ForwardedProto: l.Addr().Network(),
+		RequestID:      requestID,
+		Target:         spec.target(),
+		Tunnel:         spec.Tunnel,
+	}
+
+	if err := s.proxyConn(identifier, conn, msg); err != nil {
+		atomic.AddInt64(&s.failedSessions, 1)
+		s.logger.Log(
+			"level", 0,
+			"msg", "proxy error",
+			"requestID", msg.RequestID,
+			"identifier", identifier,
+			"ctrlMsg", msg,
+			"err", err,
+		)
+	}
+}
+
+// serveUpgrade proxies protocol upgrade requests i.e. WebSocket, the
+// connection is hijacked and after the request is sent raw stream is
+// transferred in both directions until either side closes.
+func (s *Server) serveUpgrade(w http.ResponseWriter, r *http.Request) {
+	identifier, _, outr, msg, err := s.outRequest(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		s.writeError(w, r, errUpgradeNotSupported)
+		return
+	}
+
+	release, err := s.acquireConn(identifier)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	defer release()
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		s.logger.Log(
+			"level", 0,
+			"msg", "hijack failed",
+			"addr", r.RemoteAddr,
+			"host", r.Host,
+			"err", err,
+		)
+		return
+	}
+	defer conn.Close()
+
+	if err := s.proxyUpgrade(identifier, outr, conn, brw.Reader, msg); err != nil {
+		atomic.AddInt64(&s.failedSessions, 1)
+		s.logger.Log(
+			"level", 0,
+			"msg", "proxy error",
+			"requestID", msg.RequestID,
+			"identifier", identifier,
+			"ctrlMsg", msg,
+			"err", err,
+		)
+	}
+}
+
+// writeError writes HTTP error response for err returned by RoundTrip.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == errTunnelNotFound {
+		s.notFound(w, r)
+		return
+	}
+	if ee, ok := err.(*elsewhereError); ok {
+		s.serveElsewhere(w, r, ee.reg)
+		return
+	}
+	if err == errUnauthorised {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"User Visible Realm\"")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err == errRequestTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	atomic.AddInt64(&s.failedSessions, 1)
+
+	requestID, _ := RequestID(r.Context())
+
+	s.logger.Log(
+		"level", 0,
+		"action", "round trip failed",
+		"requestID", requestID,
+		"addr", r.RemoteAddr,
+		"host", r.Host,
+		"url", r.URL,
+		"err", err,
+	)
+
+	http.Error(w, err.Error(), errorStatus(err))
+}
+
+// RoundTrip is http.RoundTriper implementation.
+func (s *Server) RoundTrip(r *http.Request) (*http.Response, error) {
+	identifier, matched, outr, msg, err := s.outRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.proxyHTTP(identifier, outr, msg)
+
+	// requests of HTTP listeners are always sent to the listener owner
+	if listenerRouteFrom(r.Context()) != nil {
+		return resp, err
+	}
+
+	// fail over to other client if request can be safely resent
+	if outr.Body == nil && errors.Is(err, errClientNotConnected) {
+		failed := identifier
+		h, prefix, ok := s.route(r.Host, r.URL.Path, func(identifier id.ID) bool {
+			return identifier != failed && s.routable(identifier)
+		})
+		if ok && prefix == matched {
+			identifier = h.identifier
+			msg.Tunnel = h.tunnel
+			resp, err = s.proxyHTTP(identifier, outr, msg)
+		}
+	}
+
+	// retry once if control connection went away in the middle of request
+	// that can be safely resent, client may reconnect within DialWait or
+	// have other pooled connections
+	if outr.Body == nil && isIdempotent(r) && connLost(err) {
+		s.logger.Log(
+			"level", 1,
+			"msg", "retrying request",
+			"requestID", msg.RequestID,
+			"identifier", identifier,
+			"err", err,
+		)
+		if h, prefix, ok := s.waitRoute(r); ok && prefix == matched {
+			identifier = h.identifier
+			msg.Tunnel = h.tunnel
+			resp, err = s.proxyHTTP(identifier, outr, msg)
+		}
+	}
+
+	if err == nil {
+		s.setStickyCookie(resp, r, identifier)
+	}
+
+	return resp, err
+}
+
+// setStickyCookie pins user to client serving the request if client uses
+// StickyCookie affinity and the user is not pinned to it already.
+func (s *Server) setStickyCookie(resp *http.Response, r *http.Request, identifier id.ID) {
+	c, ok := s.clients[identifier]
+	if !ok {
+		return
+	}
+	config := c.hostConfig(r.Host)
+	if config == nil || config.Sticky != StickyCookie {
+		return
+	}
+
+	name := config.StickyCookie
+	if name == "" {
+		name = DefaultStickyCookie
+	}
+	if v, err := r.Cookie(name); err == nil && v.Value == identifier.String() {
+		return
+	}
+
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    identifier.String(),
+		Path:     "/",
+		HttpOnly: true,
+	}
+	resp.Header.Add("Set-Cookie", cookie.String())
+}
+
+// waitRoute selects connected client serving request r honouring session
+// affinity, if there is no such client it waits up to DialWait for one to
+// connect.
+func (s *Server) waitRoute(r *http.Request) (*hostInfo, string, bool) {
+	h, prefix, ok := s.routeRequest(r.Host, r.URL.Path, r, s.routable)
+	if ok || s.config.DialWait <= 0 {
+		return h, prefix, ok
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.config.DialWait)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		s.connectedMu.Lock()
+		s.connected.Broadcast()
+		s.connectedMu.Unlock()
+	})
+	defer stop()
+
+	s.connectedMu.Lock()
+	defer s.connectedMu.Unlock()
+
+	for {
+		h, prefix, ok = s.routeRequest(r.Host, r.URL.Path, r, s.routable)
+		if ok || ctx.Err() != nil {
+			return h, prefix, ok
+		}
+		s.connected.Wait()
+	}
+}
+
+// notifyConnected wakes up requests waiting for a client to connect.
+func (s *Server) notifyConnected() {
+	s.connectedMu.Lock()
+	s.connected.Broadcast()
+	s.connectedMu.Unlock()
+}
+
+// outRequest selects client for request r, checks authentication and
+// returns the client, matched path prefix, and request and control message to
+// be sent to the client.
+func (s *Server) outRequest(r *http.Request) (identifier id.ID, prefix string, outr *http.Request, msg *proto.ControlMessage, err error) {
+	route := listenerRouteFrom(r.Context())
+
+	var (
+		h  *hostInfo
+		ok bool
+	)
+	if route != nil {
+		h, ok = route.host, s.connPool.IsConnected(route.host.identifier)
+		if !ok {
+			err = errClientNotConnected
+			return
+		}
+	} else {
+		h, prefix, ok = s.waitRoute(r)
+	}
+	if !ok {
+		if reg := s.elsewhere(r.Host); reg != nil {
+			err = &elsewhereError{reg}
+		} else if _, _, ok := s.route(r.Host, r.URL.Path, nil); ok {
+			err = errClientNotSubscribed
+		} else {
+			err = errTunnelNotFound
+		}
+		return
+	}
+	identifier = h.identifier
+
+	outr = r.WithContext(r.Context())
+	if r.ContentLength == 0 {
+		outr.Body = nil // Issue 16036: nil Body for http.Transport retries
+	}
+	outr.Header = cloneHeader(r.Header)
+	outr.Header.Del(headerPeer)
+
+	if h.auth != nil {
+		user, password, _ := r.BasicAuth()
+		if h.auth.User != user || h.auth.Password != password {
+			err = errUnauthorised
+			return
+		}
+		outr.Header.Del("Authorization")
+	}
+
+	if h.stripPrefix && prefix != "" {
+		u := *r.URL
+		u.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(u.Path, prefix), "/")
+		u.RawPath = ""
+		outr.URL = &u
+		outr.Header.Set("X-Forwarded-Prefix", prefix)
+	}
+
+	setXForwardedFor(outr.Header, r.RemoteAddr)
+
+	scheme := r.URL.Scheme
+	if scheme == "" {
+		if r.TLS != nil {
+			scheme = proto.HTTPS
+		} else {
+			scheme = proto.HTTP
+		}
+	}
+	if r.Header.Get("X-Forwarded-Host") == "" {
+		outr.Header.Set("X-Forwarded-Host", r.Host)
+		outr.Header.Set("X-Forwarded-Proto", scheme)
+	}
+
+	if s.config.ModifyRequest != nil {
+		s.config.ModifyRequest(outr)
+	}
+
+	msg = &proto.ControlMessage{
+		Action:         proto.ActionProxy,
+		ForwardedFor:   r.RemoteAddr,
+		ForwardedHost:  r.Host,
+		ForwardedProto: scheme,
+		RequestID:      requestIDFrom(r.Context()),
+		Tunnel:         h.tunnel,
+	}
+	// client selects local service by listener address like for TCP
+	if route != nil {
+		msg.ForwardedHost = route.addr
+	}
+
+	return
+}
+
+func (s *Server) proxyConn(identifier id.ID, conn net.Conn, msg *proto.ControlMessage) (err error) {
+	logger := log.NewContext(s.logger).With("requestID", msg.RequestID)
+
+	st := newSessionStats(identifier, msg)
+	s.traceSession(st)
+	defer func() {
+		s.sessionDone(st, err)
+	}()
+
+	logger.Log(
+		"level", 2,
+		"action", "proxy conn",
+		"identifier", identifier,
+		"ctrlMsg", msg,
+	)
+
+	defer conn.Close()
+
+	release, err := s.acquireConn(identifier)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	pr, pw := s.pipe()
+	defer pr.Close()
+	defer pw.Close()
+
+	req, err := s.connectRequest(identifier, msg, pr)
+	if err != nil {
+		return &ProxyError{Op: OpRequest, Phase: PhaseRequestCreate, Err: err}
+	}
+
+	// ctx is canceled when either side closes, this unwinds both directions
+	ctx, cancel := s.sessionContext(context.Background())
+	defer cancel()
+	req = req.WithContext(ctx)
+	go closeOnDone(ctx, conn)
+
+	l := s.limiters(identifier)
+
+	// Directions are half-closed, when user closes writing side the request
+	// body is closed and client half-closes local connection, the other
+	// direction goes on until client closes the stream. Copy errors cancel
+	// ctx and close both directions, errors caused by closing the other
+	// direction are ignored.
+	var upErr error
+	done := make(chan struct{})
+	go func() {
+		n, err := s.transfer(pw, l.reader(ctx, conn), logger.With(
+			"dir", DirUserToClient,
+			"dst", identifier,
+			"src", conn.RemoteAddr(),
+		))
+		// request body is closed by transport when client ends the stream
+		if err != nil && ctx.Err() == nil && !errors.Is(err, io.ErrClosedPipe) {
+			upErr = &ProxyError{Op: OpCopy, Phase: PhaseCopyLocalToRemote, Dir: DirUserToClient, Err: err}
+		}
+		st.addIn(n)
+		s.metrics.BytesTransferred(msg.ForwardedHost, DirUserToClient, n)
+		if err != nil {
+			cancel()
+		} else {
+			pw.Close()
+		}
+		close(done)
+	}()
+
+	resp, err := s.do(req)
+	if err != nil {
+		cancel()
+		<-done
+		return roundTripError(err)
+	}
+	defer resp.Body.Close()
+
+	if err := unhealthy(resp); err != nil {
+		cancel()
+		<-done
+		return err
+	}
+
+	dst, stopStall := s.stallWriter(conn, conn, st)
+	n, copyErr := s.transfer(dst, l.readCloser(ctx, resp.Body), logger.With(
+		"dir", DirClientToUser,
+		"dst", conn.RemoteAddr(),
+		"src", identifier,
+	))
+	stopStall()
+	if copyErr != nil && ctx.Err() == nil {
+		err = &ProxyError{Op: OpCopy, Phase: PhaseCopyRemoteToLocal, Dir: DirClientToUser, Err: copyErr}
+	} else {
+		err = timedOut(ctx)
+	}
+	st.addOut(n)
+	s.metrics.BytesTransferred(msg.ForwardedHost, DirClientToUser, n)
+	if copyErr != nil {
+		cancel()
+	} else if err := closeWrite(conn); err != nil {
+		cancel()
+	}
+
+	<-done
+	cancel()
+	if err == nil {
+		err = timedOut(ctx)
+	}
+
+	if err == nil {
+		err = upErr
+	}
+
+	logger.Log(
+		"level", 2,
+		"action", "proxy conn done",
+		"identifier", identifier,
+		"ctrlMsg", msg,
+	)
+
+	return err
+}
+
+func (s *Server) proxyPacket(identifier id.ID, pc net.PacketConn, src net.Addr, in <-chan []byte, msg *proto.ControlMessage) (err error) {
+	logger := log.NewContext(s.logger).With("requestID", msg.RequestID)
+
+	st := newSessionStats(identifier, msg)
+	s.traceSession(st)
+	defer func() {
+		s.sessionDone(st, err)
+	}()
+
+	logger.Log(
+		"level", 2,
+		"action", "proxy packet",
+		"identifier", identifier,
+		"ctrlMsg", msg,
+	)
+
+	release, err := s.acquireConn(identifier)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	pr, pw := s.pipe()
+	defer pr.Close()
+	defer pw.Close()
+
+	req, err := s.connectRequest(identifier, msg, pr)
+	if err != nil {
+		return &ProxyError{Op: OpRequest, Phase: PhaseRequestCreate, Err: err}
+	}
+
+	ctx, cancel := s.sessionContext(context.Background())
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	idle := time.AfterFunc(DefaultUDPIdleTimeout, cancel)
+	defer idle.Stop()
+
+	go func() {
+		for {
+			select {
+			case p := <-in:
+				idle.Reset(DefaultUDPIdleTimeout)
+				if err := writeDatagram(pw, p); err != nil {
+					return
+				}
+				st.addIn(int64(len(p)))
+			case <-ctx.Done():
+				pw.Close()
+				return
+			}
+		}
+	}()
+
+	resp, err := s.do(req)
+	if err != nil {
+		return roundTripError(err)
+	}
+	defer resp.Body.Close()
+
+	if err := unhealthy(resp); err != nil {
+		return err
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		p, err := readDatagram(resp.Body, buf)
+		if err != nil {
+			break
+		}
+		idle.Reset(DefaultUDPIdleTimeout)
+		st.addOut(int64(len(p)))
+		if _, err := pc.WriteTo(p, src); err != nil {
+			logger.Log(
+				"level", 2,
+				"msg", "write of datagram failed",
+				"identifier", identifier,
+				"ctrlMsg", msg,
+				"err", err,
+			)
+		}
+	}
+
+	logger.Log(
 		"level", 2,
-		"action", "proxy conn done",
+		"action", "proxy packet done",
 		"identifier", identifier,
 		"ctrlMsg", msg,
 	)
 
-	return nil
+	return timedOut(ctx)
 }
 
 func (s *Server) proxyHTTP(identifier id.ID, r *http.Request, msg *proto.ControlMessage) (*http.Response, error) {
-	s.logger.Log(
+	logger := log.NewContext(s.logger).With("requestID", msg.RequestID)
+
+	logger.Log(
 		"level", 2,
 		"action", "proxy HTTP",
 		"identifier", identifier,
 		"ctrlMsg", msg,
 	)
 
-	pr, pw := io.Pipe()
+	release, err := s.acquireConn(identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.config.Compression {
+		msg.Compression = proto.CompressionGzip
+	}
+
+	pr, pw := s.pipe()
 	defer pr.Close()
 	defer pw.Close()
 
+	st := sessionStatsFrom(r.Context())
+	st.set(identifier, msg)
+	s.traceSession(st)
+
 	req, err := s.connectRequest(identifier, msg, pr)
 	if err != nil {
-		return nil, fmt.Errorf("proxy request error: %s", err)
+		release()
+		return nil, &ProxyError{Op: OpRequest, Phase: PhaseRequestCreate, Err: err}
+	}
+	// abandon the request if user disconnects
+	ctx, cancel := s.sessionContext(r.Context())
+	req = req.WithContext(ctx)
+	done := func() {
+		release()
+		cancel()
 	}
 
+	l := s.limiters(identifier)
+
 	go func() {
-		cw := &countWriter{pw, 0}
+		cw := &countWriter{l.writer(ctx, pw), 0}
 		err := r.Write(cw)
 		if err != nil {
-			s.logger.Log(
+			// abort the request stream rather than wait for more data
+			pw.CloseWithError(err)
+			logger.Log(
 				"level", 0,
 				"msg", "proxy error",
 				"identifier", identifier,
@@ -645,27 +2750,43 @@ func (s *Server) proxyHTTP(identifier id.ID, r *http.Request, msg *proto.Control
 			)
 		}
 
-		s.logger.Log(
+		logger.Log(
 			"level", 3,
 			"action", "transferred",
 			"identifier", identifier,
 			"bytes", cw.count,
-			"dir", "user to client",
+			"dir", DirUserToClient,
 			"dst", r.Host,
 			"src", r.RemoteAddr,
 		)
+		st.addIn(cw.count)
+		s.metrics.BytesTransferred(trimPort(r.Host), DirUserToClient, cw.count)
 
 		if r.Body != nil {
 			r.Body.Close()
 		}
 	}()
 
-	resp, err := s.httpClient.Do(req)
+	resp, err := s.do(req)
 	if err != nil {
-		return nil, fmt.Errorf("io error: %s", err)
+		done()
+		return nil, roundTripError(err)
+	}
+	if err := unhealthy(resp); err != nil {
+		resp.Body.Close()
+		done()
+		return nil, err
 	}
+	// only responses to requests offering compression are decompressed,
+	// otherwise the header is untrusted and the body is passed through
+	if resp.Header.Get(proto.HeaderCompression) == proto.CompressionGzip && msg.Compression == proto.CompressionGzip {
+		resp.Body = &gzipReadCloser{body: resp.Body}
+		resp.ContentLength = -1
+	}
+	resp.Header.Del(proto.HeaderCompression)
+	resp.Body = releaseCloser{l.readCloser(ctx, resp.Body), done}
 
-	s.logger.Log(
+	logger.Log(
 		"level", 2,
 		"action", "proxy HTTP done",
 		"identifier", identifier,
@@ -676,6 +2797,219 @@ func (s *Server) proxyHTTP(identifier id.ID, r *http.Request, msg *proto.Control
 	return resp, nil
 }
 
+// sessionDone ends span of the session and invokes OnSessionEnd callback,
+// sessions that did not reach a client are not reported.
+func (s *Server) sessionDone(st *sessionStats, err error) {
+	if st.msg == nil || s.config.OnSessionEnd == nil && st.end == nil {
+		return
+	}
+	stats := st.stats(err)
+	stats.ClientName, stats.ClientLabels = s.clientLabels(stats.Identifier)
+	if st.end != nil {
+		st.end(stats)
+	}
+	if s.config.OnSessionEnd != nil {
+		go s.config.OnSessionEnd(stats)
+	}
+}
+
+// transfer is like package transfer but it uses server buffer pool and returns
+// copy error.
+func (s *Server) transfer(dst io.Writer, src io.Reader, logger log.Logger) (int64, error) {
+	return transferBuffer(s.bufferPool, dst, src, logger)
+}
+
+// acquireConn registers a proxied connection of a client, it fails with
+// errTooManyConns if client has MaxConns connections. The returned function
+// must be called when the connection is done, it can be called many times.
+func (s *Server) acquireConn(identifier id.ID) (func(), error) {
+	c, ok := s.clients[identifier]
+	if !ok || c.config.MaxConns <= 0 {
+		return func() {}, nil
+	}
+
+	if atomic.AddInt64(&c.active, 1) > int64(c.config.MaxConns) {
+		atomic.AddInt64(&c.active, -1)
+		return nil, errTooManyConns
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			atomic.AddInt64(&c.active, -1)
+		})
+	}, nil
+}
+
+// limiters returns rate limiters of a client or nil if client is not limited.
+func (s *Server) limiters(identifier id.ID) *clientLimiters {
+	c, ok := s.clients[identifier]
+	if !ok {
+		return nil
+	}
+	return c.limiters
+}
+
+func (s *Server) proxyUpgrade(identifier id.ID, r *http.Request, conn net.Conn, br io.Reader, msg *proto.ControlMessage) (err error) {
+	logger := log.NewContext(s.logger).With("requestID", msg.RequestID)
+
+	st := newSessionStats(identifier, msg)
+	st.parent = traceParent(r)
+	s.traceSession(st)
+	defer func() {
+		s.sessionDone(st, err)
+	}()
+
+	logger.Log(
+		"level", 2,
+		"action", "proxy upgrade",
+		"identifier", identifier,
+		"ctrlMsg", msg,
+	)
+
+	pr, pw := s.pipe()
+	defer pr.Close()
+	defer pw.Close()
+
+	req, err := s.connectRequest(identifier, msg, pr)
+	if err != nil {
+		io.WriteString(conn, badGatewayResponse)
+		return &ProxyError{Op: OpRequest, Phase: PhaseRequestCreate, Err: err}
+	}
+
+	// ctx is canceled when either side closes, this unwinds both directions
+	ctx, cancel := s.sessionContext(r.Context())
+	defer cancel()
+	req = req.WithContext(ctx)
+	go closeOnDone(ctx, conn)
+
+	l := s.limiters(identifier)
+
+	go func() {
+		defer cancel()
+
+		if err := r.Write(pw); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		n, _ := s.transfer(l.writer(ctx, pw), br, logger.With(
+			"dir", DirUserToClient,
+			"dst", identifier,
+			"src", r.RemoteAddr,
+		))
+		st.addIn(n)
+		s.metrics.BytesTransferred(trimPort(r.Host), DirUserToClient, n)
+		pw.Close()
+	}()
+
+	resp, err := s.do(req)
+	if err != nil {
+		io.WriteString(conn, badGatewayResponse)
+		return roundTripError(err)
+	}
+	defer resp.Body.Close()
+
+	if err := unhealthy(resp); err != nil {
+		io.WriteString(conn, serviceUnavailableResponse)
+		return err
+	}
+
+	dst, stopStall := s.stallWriter(conn, conn, st)
+	n, err := s.transfer(dst, l.readCloser(ctx, resp.Body), logger.With(
+		"dir", DirClientToUser,
+		"dst", r.RemoteAddr,
+		"src", identifier,
+	))
+	stopStall()
+	if err != nil && ctx.Err() == nil {
+		err = &ProxyError{Op: OpCopy, Phase: PhaseCopyRemoteToLocal, Dir: DirClientToUser, Err: err}
+	} else {
+		err = timedOut(ctx)
+	}
+	st.addOut(n)
+	s.metrics.BytesTransferred(trimPort(r.Host), DirClientToUser, n)
+
+	logger.Log(
+		"level", 2,
+		"action", "proxy upgrade done",
+		"identifier", identifier,
+		"ctrlMsg", msg,
+	)
+
+	return err
+}
+
+// sessionContext returns context of a proxied session, the context is
+// canceled after ProxyTimeout.
+func (s *Server) sessionContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if s.config.ProxyTimeout > 0 {
+		return context.WithTimeout(parent, s.config.ProxyTimeout)
+	}
+	return context.WithCancel(parent)
+}
+
+// timedOut returns error if session context ctx expired.
+func timedOut(ctx context.Context) error {
+	if ctx.Err() != context.DeadlineExceeded {
+		return nil
+	}
+	return &ProxyError{Op: OpCopy, Phase: PhaseCopyRemoteToLocal, Err: errProxyTimeout}
+}
+
+// do sends request to client over the least loaded connection of the client,
+// the connection counts the request as active until response body is closed.
+func (s *Server) do(req *http.Request) (*http.Response, error) {
+	req, lease := withConnLease(req)
+	resp, err := s.roundTrip(req)
+	if err != nil {
+		lease.release()
+		return nil, err
+	}
+	resp.Body = releaseCloser{resp.Body, lease.release}
+
+	return resp, nil
+}
+
+// roundTrip sends request to client, it fails with errResponseHeaderTimeout
+// if response headers are not received within ResponseHeaderTimeout.
+func (s *Server) roundTrip(req *http.Request) (*http.Response, error) {
+	if s.config.ResponseHeaderTimeout <= 0 {
+		return s.httpClient.Do(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(s.config.ResponseHeaderTimeout, cancel)
+	resp, err := s.httpClient.Do(req.WithContext(ctx))
+	if !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, errResponseHeaderTimeout
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = releaseCloser{resp.Body, cancel}
+
+	return resp, nil
+}
+
+// unhealthy returns error if client rejected session because local service
+// health check failed.
+func unhealthy(resp *http.Response) error {
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get(proto.HeaderError) == "" {
+		return nil
+	}
+	return &ProxyError{
+		Op:    OpHealthCheck,
+		Phase: PhaseRoundTrip,
+		Err:   fmt.Errorf("%w: %s", errUnhealthy, resp.Header.Get(proto.HeaderError)),
+	}
+}
+
 // connectRequest creates HTTP request to client with a given identifier having
 // control message and data input stream, output data stream results from
 // response the created request.
@@ -697,14 +3031,271 @@ func (s *Server) Addr() string {
 	return s.listener.Addr().String()
 }
 
-// Stop closes the server.
+// Port returns TCP port clients connect to, it's useful when server listens
+// on ":0". If server is not listening on TCP address 0 is returned.
+func (s *Server) Port() int {
+	if s.listener == nil {
+		return 0
+	}
+	addr, ok := s.listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return 0
+	}
+	return addr.Port
+}
+
+// ClientURL returns URL of requests sent to client identifier over its control
+// connections, the host identifies client connections in HTTP/2 transport
+// and the path is TransportPath.
+func (s *Server) ClientURL(identifier id.ID) string {
+	return s.connPool.URL(identifier)
+}
+
+// Stop closes the server, it may be called many times and concurrently with
+// Start, calls after the first one only end Wait if Shutdown is in progress.
 func (s *Server) Stop() {
+	s.stop()
+	s.terminate(nil)
+}
+
+// stop closes the listener, unlike Stop it does not end Wait.
+func (s *Server) stop() {
+	s.stopOnce.Do(func() {
+		s.logger.Log(
+			"level", 1,
+			"action", "stop",
+		)
+
+		// let accept loop know that close is deliberate
+		close(s.done)
+
+		if s.listener != nil {
+			s.listener.Close()
+		}
+	})
+}
+
+// Done returns a channel that's closed when the server is stopped with Stop or
+// Shutdown or when the control connection listener is closed. Unlike Wait it
+// does not wait for Shutdown and background goroutines to finish.
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// evictIdle periodically pings control connections and closes the ones that
+// do not respond, it runs until server is stopped.
+func (s *Server) evictIdle() {
+	t := time.NewTicker(s.config.IdleTimeout)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			for _, identifier := range s.connPool.PingAll(s.pingTimeout) {
+				s.logger.Log(
+					"level", 1,
+					"action", "evicted idle connection",
+					"identifier", identifier,
+				)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// expireConns periodically drains clients with control connections older than
+// MaxConnLifetime.
+func (s *Server) expireConns() {
+	interval := s.config.MaxConnLifetime / 10
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			for _, identifier := range s.connPool.Expired(s.config.MaxConnLifetime) {
+				go s.expire(identifier, s.connPool.Drain(identifier))
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// expire drains connections of client with expired control connection, if
+// drain fails the connections are closed.
+func (s *Server) expire(identifier id.ID, conns []*http2.ClientConn) {
 	s.logger.Log(
 		"level", 1,
-		"action", "stop",
+		"action", "connection expired",
+		"identifier", identifier,
+	)
+
+	if err := s.drain(identifier, conns); err != nil {
+		s.logger.Log(
+			"level", 0,
+			"msg", "drain of expired connection failed",
+			"identifier", identifier,
+			"err", err,
+		)
+		for _, c := range conns {
+			s.connPool.MarkDead(c)
+		}
+	}
+}
+
+// keepAlive enables TCP keepalive on conn using TCPKeepAlive idle time, TLS
+// connections are unwrapped, non TCP connections are ignored.
+func (s *Server) keepAlive(conn net.Conn) error {
+	if c, ok := conn.(*tls.Conn); ok {
+		conn = c.NetConn()
+	}
+	if _, ok := conn.(*net.TCPConn); !ok {
+		return nil
+	}
+	if s.config.TCPKeepAlive == 0 {
+		return keepAlive(conn)
+	}
+	return keepAliveIdle(conn, s.config.TCPKeepAlive)
+}
+
+// noDelay sets TCP_NODELAY of tunneled conn unless DisableNoDelay is set.
+func (s *Server) noDelay(conn net.Conn) error {
+	return setNoDelay(conn, !s.config.DisableNoDelay)
+}
+
+// healthCheck periodically pings control connections that did not receive any
+// frames for ReadIdleTimeout and closes the ones that do not respond, it runs
+// until server is stopped.
+func (s *Server) healthCheck() {
+	t := time.NewTicker(s.config.ReadIdleTimeout)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			for _, identifier := range s.connPool.PingIdle(s.config.ReadIdleTimeout, s.pingTimeout) {
+				s.logger.Log(
+					"level", 1,
+					"action", "evicted dead connection",
+					"identifier", identifier,
+				)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Shutdown gracefully shuts down the server, it stops accepting new
+// connections and waits for running proxy sessions to finish. When all
+// sessions are done, or ctx is done, client connections are closed. If ctx is
+// done before sessions finish ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.logger.Log(
+		"level", 1,
+		"action", "shutdown",
 	)
 
-	if s.listener != nil {
-		s.listener.Close()
+	s.sessionsMu.Lock()
+	s.shutdown = true
+	s.sessionsMu.Unlock()
+
+	s.stop()
+
+	done := make(chan struct{})
+	go func() {
+		s.sessions.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.connPool.DeleteAll()
+
+	s.terminate(err)
+
+	return err
+}
+
+// terminate records terminal error returned by Wait, only the first call has
+// effect.
+func (s *Server) terminate(err error) {
+	s.terminateOnce.Do(func() {
+		s.terminalErr = err
+		close(s.terminated)
+	})
+}
+
+// Wait blocks until server is terminated and the control connection listener
+// and background goroutines exit. Server is terminated by the first of Stop,
+// Shutdown returning or closing of the listener by its owner to finish, Wait
+// returns error of that path: nil for Stop and listener close, Shutdown error
+// i.e. when sessions did not finish in time. Wait may be called many times
+// and it always returns the same error.
+func (s *Server) Wait() error {
+	<-s.terminated
+	s.routines.Wait()
+	return s.terminalErr
+}
+
+// loadShedRetryAfter is Retry-After header value, in seconds, of HTTP requests
+// rejected by ServerConfig.LoadShedder.
+const loadShedRetryAfter = "1"
+
+// shedLoad returns true if new session should be rejected because
+// ServerConfig.LoadShedder reports that the server is overloaded.
+func (s *Server) shedLoad() bool {
+	return s.config.LoadShedder != nil && s.config.LoadShedder()
+}
+
+// startSession registers a new proxy session, it returns false if server is
+// shutting down.
+func (s *Server) startSession() bool {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	if s.shutdown {
+		return false
 	}
+	s.sessions.Add(1)
+	atomic.AddInt64(&s.activeSessions, 1)
+	atomic.AddInt64(&s.totalSessions, 1)
+	s.metrics.SessionStarted()
+
+	return true
+}
+
+// endSession marks end of a session registered with startSession.
+func (s *Server) endSession() {
+	atomic.AddInt64(&s.activeSessions, -1)
+	s.metrics.SessionEnded()
+	s.sessions.Done()
+}
+
+// ActiveConnections returns number of currently proxied HTTP requests and TCP
+// connections.
+func (s *Server) ActiveConnections() int64 {
+	return atomic.LoadInt64(&s.activeSessions)
+}
+
+// TotalConnections returns number of HTTP requests and TCP connections
+// proxied since the server was created.
+func (s *Server) TotalConnections() int64 {
+	return atomic.LoadInt64(&s.totalSessions)
+}
+
+// FailedConnections returns number of HTTP requests and TCP connections that
+// failed to be proxied since the server was created, see ProxyError.
+func (s *Server) FailedConnections() int64 {
+	return atomic.LoadInt64(&s.failedSessions)
 }
@@ -0,0 +1,973 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+func TestServerConfig_Validate(t *testing.T) {
+	t.Parallel()
+
+	a := id.New([]byte("a"))
+
+	table := []struct {
+		config *ServerConfig
+		err    string
+	}{
+		{
+			&ServerConfig{},
+			"missing TLSConfig",
+		},
+		{
+			&ServerConfig{
+				TLSConfig:       &tls.Config{},
+				AcceptEarlyData: true,
+			},
+			"TLS early data not supported",
+		},
+		{
+			&ServerConfig{
+				TLSConfig:     &tls.Config{},
+				MinTLSVersion: 0x0999,
+			},
+			"unknown MinTLSVersion 0x0999",
+		},
+		{
+			&ServerConfig{
+				TLSConfig:           &tls.Config{},
+				AllowedCipherSuites: []uint16{tls.TLS_AES_128_GCM_SHA256, 0xffff},
+			},
+			"unknown cipher suite 0xFFFF in AllowedCipherSuites",
+		},
+		{
+			&ServerConfig{
+				TLSConfig:      &tls.Config{},
+				AllowedClients: []*AllowedClient{{ID: a}, {ID: a}},
+			},
+			"allowed client " + a.String() + ": duplicate ID",
+		},
+		{
+			&ServerConfig{
+				TLSConfig:     &tls.Config{},
+				TransportPath: "tunnel",
+			},
+			"TransportPath \"tunnel\" must start with /",
+		},
+		{
+			&ServerConfig{
+				TLSConfig:     &tls.Config{},
+				TransportPath: "/tunnel?a=b",
+			},
+			"invalid TransportPath \"/tunnel?a=b\"",
+		},
+		{
+			&ServerConfig{
+				TLSConfig:      &tls.Config{},
+				AllowedClients: []*AllowedClient{{}},
+			},
+			"allowed client 0: missing ID",
+		},
+		{
+			&ServerConfig{
+				TLSConfig:      &tls.Config{},
+				AllowedClients: []*AllowedClient{{ID: a}, {Identity: "a"}},
+			},
+			"allowed client " + a.String() + ": duplicate ID",
+		},
+		{
+			&ServerConfig{
+				TLSConfig:      &tls.Config{},
+				AllowedClients: []*AllowedClient{{ID: a, Identity: "b"}},
+			},
+			"allowed client " + a.String() + ": ID does not match Identity \"b\"",
+		},
+		{
+			&ServerConfig{
+				TLSConfig:      &tls.Config{},
+				AllowedClients: []*AllowedClient{{ID: a, PathPrefixes: []string{"api"}}},
+			},
+			"allowed client " + a.String() + ": path prefix \"api\" must start with /",
+		},
+		{
+			&ServerConfig{
+				TLSConfig:      &tls.Config{},
+				AllowedClients: []*AllowedClient{{ID: a, AllowedTargets: []string{":22"}}},
+			},
+			"allowed client " + a.String() + ": invalid target \":22\": missing host",
+		},
+		{
+			&ServerConfig{
+				TLSConfig:      &tls.Config{},
+				AllowedClients: []*AllowedClient{{ID: a, Sticky: 3}},
+			},
+			"allowed client " + a.String() + ": unknown Sticky 3",
+		},
+		{
+			&ServerConfig{
+				TLSConfig:      &tls.Config{},
+				AllowedClients: []*AllowedClient{{ID: a, Weight: -1}},
+			},
+			"allowed client " + a.String() + ": negative Weight",
+		},
+		{
+			&ServerConfig{
+				TLSConfig:      &tls.Config{},
+				AllowedClients: []*AllowedClient{{ID: a, Port: 8443}},
+			},
+			"",
+		},
+		{
+			&ServerConfig{
+				TLSConfig:      &tls.Config{},
+				AllowedClients: []*AllowedClient{{ID: a, Hosts: []string{"a.example.com"}}, {ID: a, Hosts: []string{"b.example.com"}}, {ID: a}},
+			},
+			"",
+		},
+		{
+			&ServerConfig{
+				TLSConfig:      &tls.Config{},
+				AllowedClients: []*AllowedClient{{ID: a, Hosts: []string{"a.example.com"}}, {ID: a, Hosts: []string{"a.example.com:443"}}},
+			},
+			"allowed client " + a.String() + ": duplicate host \"a.example.com:443\"",
+		},
+		{
+			&ServerConfig{
+				TLSConfig:      &tls.Config{},
+				AllowedClients: []*AllowedClient{{ID: a, Hosts: []string{"a.example.com"}}, {ID: a}, {ID: a}},
+			},
+			"allowed client " + a.String() + ": duplicate ID",
+		},
+	}
+
+	for i, tt := range table {
+		err := tt.config.Validate()
+		if tt.err == "" {
+			if err != nil {
+				t.Error(i, "unexpected error", err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.err {
+			t.Error(i, "expected", tt.err, "got", err)
+		}
+	}
+}
+
+func TestProxyError(t *testing.T) {
+	t.Parallel()
+
+	err := error(&ProxyError{Op: OpRoundTrip, Err: errClientNotConnected})
+	if !errors.Is(err, errClientNotConnected) {
+		t.Fatal("expected errClientNotConnected")
+	}
+	if err.Error() != "io error: client not connected" {
+		t.Fatal("unexpected message", err)
+	}
+
+	err = &ProxyError{Op: OpCopy, Dir: DirClientToUser, Err: errors.New("reset")}
+	if err.Error() != "copy error (client to user): reset" {
+		t.Fatal("unexpected message", err)
+	}
+
+	tests := []struct {
+		err   error
+		phase Phase
+	}{
+		{roundTripError(errClientNotConnected), PhaseDial},
+		{roundTripError(errResponseHeaderTimeout), PhaseRoundTrip},
+		{fmt.Errorf("proxy: %w", roundTripError(errClientNotConnected)), PhaseDial},
+	}
+	for i, tt := range tests {
+		var pe *ProxyError
+		if !errors.As(tt.err, &pe) {
+			t.Fatal(i, "expected ProxyError, got", tt.err)
+		}
+		if pe.Phase != tt.phase {
+			t.Error(i, "expected phase", tt.phase, "got", pe.Phase)
+		}
+	}
+	if s := PhaseCopyLocalToRemote.String(); s != "copy local to remote" {
+		t.Fatal("unexpected phase string", s)
+	}
+}
+
+func TestServer_AcquireConn(t *testing.T) {
+	t.Parallel()
+
+	a, b := id.New([]byte("a")), id.New([]byte("b"))
+
+	s, err := NewServer(&ServerConfig{
+		TLSConfig:      &tls.Config{},
+		AllowedClients: []*AllowedClient{{ID: a, MaxConns: 1}, {ID: b}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	release, err := s.acquireConn(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.acquireConn(a); err != errTooManyConns {
+		t.Fatal("expected", errTooManyConns, "got", err)
+	}
+	if _, err := s.acquireConn(b); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	release()
+	release()
+
+	if _, err := s.acquireConn(a); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if _, err := s.acquireConn(a); err != errTooManyConns {
+		t.Fatal("expected", errTooManyConns, "got", err)
+	}
+}
+
+func TestServer_TransportOptions(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewServer(&ServerConfig{
+		TLSConfig: &tls.Config{},
+		TransportOptions: func(t *http2.Transport) {
+			t.MaxHeaderListSize = 1 << 20
+			t.ConnPool = nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	tr := s.httpClient.Transport.(*http2.Transport)
+	if tr.MaxHeaderListSize != 1<<20 {
+		t.Fatal("options not applied")
+	}
+	if tr.ConnPool != s.connPool {
+		t.Fatal("connection pool replaced")
+	}
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestServer_HTTPClient(t *testing.T) {
+	t.Parallel()
+
+	a := id.New([]byte("a"))
+
+	var got *http.Request
+	s, err := NewServer(&ServerConfig{
+		TLSConfig: &tls.Config{},
+		HTTPClient: &http.Client{
+			Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				got = req
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       http.NoBody,
+				}, nil
+			}),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	if _, err := s.Ping(a); err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.URL.String() != s.connPool.URL(a) {
+		t.Fatal("request not sent with custom transport", got)
+	}
+	if s.httpClient.CheckRedirect == nil {
+		t.Fatal("redirects followed")
+	}
+
+	tr := &http2.Transport{}
+	s, err = NewServer(&ServerConfig{
+		TLSConfig:  &tls.Config{},
+		HTTPClient: &http.Client{Transport: tr},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	if tr.ConnPool != s.connPool {
+		t.Fatal("connection pool not installed")
+	}
+}
+
+func TestServer_TransportPath(t *testing.T) {
+	t.Parallel()
+
+	a := id.New([]byte("a"))
+
+	var got *http.Request
+	s, err := NewServer(&ServerConfig{
+		TLSConfig:     &tls.Config{},
+		TransportPath: "/tunnel",
+		HTTPClient: &http.Client{
+			Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				got = req
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       http.NoBody,
+				}, nil
+			}),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	if u := s.ClientURL(a); u != "https://"+a.String()+":443/tunnel" {
+		t.Fatal("unexpected URL", u)
+	}
+	if _, err := s.Ping(a); err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.URL.Path != "/tunnel" {
+		t.Fatal("request not sent to TransportPath", got)
+	}
+}
+
+func TestServer_NotFound(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewServer(&ServerConfig{
+		TLSConfig: &tls.Config{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), errTunnelNotFound.Error()) {
+		t.Fatal("unexpected response", w.Code, w.Body)
+	}
+
+	s.config.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if w.Code != http.StatusTeapot {
+		t.Fatal("handler not called", w.Code)
+	}
+}
+
+func TestClientInfo_hostConfig(t *testing.T) {
+	t.Parallel()
+
+	a := &AllowedClient{Hosts: []string{"a.example.com", "*.a.example.com"}}
+	b := &AllowedClient{Hosts: []string{"b.example.com:8080"}}
+	c := &clientInfo{hosts: []*AllowedClient{a, b}}
+
+	table := []struct {
+		host   string
+		config *AllowedClient
+	}{
+		{"a.example.com", a},
+		{"a.example.com:80", a},
+		{"x.a.example.com", a},
+		{"b.example.com", b},
+		{"c.example.com", nil},
+	}
+	for _, tt := range table {
+		if config := c.hostConfig(tt.host); config != tt.config {
+			t.Error(tt.host, "expected", tt.config, "got", config)
+		}
+	}
+
+	d := &AllowedClient{}
+	c.hosts = append(c.hosts, d)
+	if config := c.hostConfig("c.example.com"); config != d {
+		t.Error("expected fallback got", config)
+	}
+}
+
+func TestServer_HealthHandler(t *testing.T) {
+	t.Parallel()
+
+	a := id.New([]byte("a"))
+
+	s, err := NewServer(&ServerConfig{
+		TLSConfig: &tls.Config{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Subscribe(a)
+
+	w := httptest.NewRecorder()
+	s.HealthHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal("unexpected status", w.Code)
+	}
+	var h Health
+	if err := json.NewDecoder(w.Body).Decode(&h); err != nil {
+		t.Fatal(err)
+	}
+	if h.Connected != 0 || h.TotalClients != 1 {
+		t.Fatal("unexpected health", h)
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	s.HealthHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatal("unexpected status", w.Code)
+	}
+}
+
+// closeCountListener counts Close calls, after close Accept fails with
+// a generic error.
+type closeCountListener struct {
+	net.Listener
+	closes int32
+}
+
+func (l *closeCountListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil && atomic.LoadInt32(&l.closes) > 0 {
+		return nil, errors.New("accept failed")
+	}
+	return conn, err
+}
+
+func (l *closeCountListener) Close() error {
+	atomic.AddInt32(&l.closes, 1)
+	return l.Listener.Close()
+}
+
+func TestServer_Addr(t *testing.T) {
+	t.Parallel()
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	table := []struct {
+		addr string
+		err  string
+	}{
+		{"", ""},
+		{"127.0.0.1:0", ""},
+		{"127.0.0.1", `invalid Addr "127.0.0.1"`},
+		{busy.Addr().String(), fmt.Sprintf("bind to %q failed", busy.Addr())},
+	}
+
+	for _, tt := range table {
+		s, err := NewServer(&ServerConfig{
+			Addr:      tt.addr,
+			TLSConfig: &tls.Config{},
+		})
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Error(tt.addr, "expected error", tt.err, "got", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(tt.addr, err)
+			continue
+		}
+		if _, port, _ := net.SplitHostPort(s.Addr()); port == "0" {
+			t.Error(tt.addr, "expected random port, got", s.Addr())
+		}
+		s.Stop()
+	}
+}
+
+// logFunc is log.Logger calling the function.
+type logFunc func(keyvals ...interface{}) error
+
+func (f logFunc) Log(keyvals ...interface{}) error {
+	return f(keyvals...)
+}
+
+func TestServer_listenClosed(t *testing.T) {
+	t.Parallel()
+
+	for _, deliberate := range []bool{true, false} {
+		var failed int32
+		s, err := NewServer(&ServerConfig{
+			Addr:      "127.0.0.1:0",
+			TLSConfig: &tls.Config{},
+			Logger: logFunc(func(keyvals ...interface{}) error {
+				if len(keyvals) > 1 && keyvals[0] == "level" && keyvals[1] == 0 {
+					atomic.AddInt32(&failed, 1)
+				}
+				return nil
+			}),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		closed := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			s.listen(&ListenerSpec{Listener: l}, id.ID{}, closed)
+			close(done)
+		}()
+
+		if deliberate {
+			close(closed)
+		}
+		l.Close()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("accept loop not stopped, deliberate", deliberate)
+		}
+		if atomic.LoadInt32(&failed) != 0 {
+			t.Error("unexpected failure logged, deliberate", deliberate)
+		}
+		s.Stop()
+	}
+}
+
+func TestServer_Stop(t *testing.T) {
+	t.Parallel()
+
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &closeCountListener{Listener: tl}
+
+	s, err := NewServer(&ServerConfig{
+		TLSConfig: &tls.Config{},
+		Listener:  l,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Stop()
+	s.Stop()
+	if n := atomic.LoadInt32(&l.closes); n != 1 {
+		t.Fatal("expected listener to be closed once, got", n)
+	}
+
+	// accept loop exits if started after stop
+	done := make(chan struct{})
+	go func() {
+		s.Start()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Start did not return after Stop")
+	}
+}
+
+func TestServer_Wait(t *testing.T) {
+	t.Parallel()
+
+	start := func(t *testing.T) (*Server, <-chan error) {
+		s, err := NewServer(&ServerConfig{
+			TLSConfig:       &tls.Config{},
+			IdleTimeout:     time.Hour,
+			ReadIdleTimeout: time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Start()
+
+		waitErr := make(chan error, 1)
+		go func() {
+			waitErr <- s.Wait()
+		}()
+
+		select {
+		case err := <-waitErr:
+			t.Fatal("Wait returned before stop", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		return s, waitErr
+	}
+
+	t.Run("stop", func(t *testing.T) {
+		t.Parallel()
+
+		s, waitErr := start(t)
+		s.Stop()
+		if err := <-waitErr; err != nil {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("shutdown timeout", func(t *testing.T) {
+		t.Parallel()
+
+		s, waitErr := start(t)
+		if !s.startSession() {
+			t.Fatal("session not started")
+		}
+		defer s.endSession()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+			t.Fatal("expected", context.DeadlineExceeded, "got", err)
+		}
+		if err := <-waitErr; err != context.DeadlineExceeded {
+			t.Fatal("expected", context.DeadlineExceeded, "got", err)
+		}
+		if err := s.Wait(); err != context.DeadlineExceeded {
+			t.Fatal("expected", context.DeadlineExceeded, "got", err)
+		}
+	})
+
+	t.Run("listener closed", func(t *testing.T) {
+		t.Parallel()
+
+		s, waitErr := start(t)
+		s.listener.Close()
+		select {
+		case err := <-waitErr:
+			if err != nil {
+				t.Fatal("unexpected error", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Wait did not return after listener close")
+		}
+	})
+
+	t.Run("stop during shutdown", func(t *testing.T) {
+		t.Parallel()
+
+		s, waitErr := start(t)
+		if !s.startSession() {
+			t.Fatal("session not started")
+		}
+		defer s.endSession()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go s.Shutdown(ctx)
+
+		// Stop is the first terminal path to finish
+		time.Sleep(50 * time.Millisecond)
+		s.Stop()
+		select {
+		case err := <-waitErr:
+			if err != nil {
+				t.Fatal("unexpected error", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Wait did not return after Stop")
+		}
+	})
+
+	t.Run("shutdown after stop", func(t *testing.T) {
+		t.Parallel()
+
+		s, waitErr := start(t)
+		s.Stop()
+
+		// late Shutdown fails but Stop already terminated the server
+		if !s.startSession() {
+			t.Fatal("session not started")
+		}
+		defer s.endSession()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := s.Shutdown(ctx); err != context.Canceled {
+			t.Fatal("expected", context.Canceled, "got", err)
+		}
+		if err := <-waitErr; err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		if err := s.Wait(); err != nil {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
+
+func TestServer_MaxHandshakesPerSecondPerIP(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewServer(&ServerConfig{
+		Addr:                        "127.0.0.1:0",
+		TLSConfig:                   &tls.Config{},
+		MaxHandshakesPerSecondPerIP: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Stop()
+
+	accepted, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+
+	limited, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer limited.Close()
+
+	// connection over the limit is closed without TLS handshake
+	limited.SetDeadline(time.Now().Add(time.Second))
+	if _, err := limited.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected connection to be closed, got", err)
+	}
+
+	// accepted connection waits for TLS handshake
+	accepted.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := accepted.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected connection to stay open, got", err)
+	}
+}
+
+// failWriteConn is a connection where every write fails.
+type failWriteConn struct {
+	net.Conn
+}
+
+func (failWriteConn) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestServer_InsecureControlUpgradeFailed(t *testing.T) {
+	t.Parallel()
+
+	var (
+		reason RejectReason
+		cause  error
+	)
+	s, err := NewServer(&ServerConfig{
+		Addr:            "127.0.0.1:0",
+		InsecureControl: true,
+		AllowedClients:  []*AllowedClient{{ID: TokenID("secret")}},
+		OnReject: func(_ string, r RejectReason) {
+			reason = r
+		},
+		AuditLog: func(e AuditEvent) {
+			cause = e.Cause
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	c, sc := net.Pipe()
+	defer c.Close()
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, "http://server/", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", controlUpgrade)
+		msg := &proto.ControlMessage{Action: proto.ActionConnect, Token: "secret"}
+		msg.WriteToHeader(req.Header)
+		req.Write(c)
+	}()
+
+	s.handleClient(failWriteConn{sc})
+	if reason != RejectHandshake {
+		t.Fatal("expected handshake rejection, got", reason)
+	}
+	var pe *ProxyError
+	if !errors.As(cause, &pe) || pe.Phase != PhaseHandshake {
+		t.Fatal("expected handshake ProxyError, got", cause)
+	}
+}
+
+// earlyDataConn writes data right after the first write i.e. ClientHello
+// as a client sending TLS 1.3 0-RTT early data would.
+type earlyDataConn struct {
+	net.Conn
+	data []byte
+}
+
+func (c *earlyDataConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err == nil && c.data != nil {
+		_, err = c.Conn.Write(c.data)
+		c.data = nil
+	}
+	return n, err
+}
+
+func TestServer_EarlyDataNotTrusted(t *testing.T) {
+	t.Parallel()
+
+	cert, err := tls.LoadX509KeyPair("./testdata/selfsigned.crt", "./testdata/selfsigned.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reason RejectReason
+	s, err := NewServer(&ServerConfig{
+		TLSConfig:     &tls.Config{Certificates: []tls.Certificate{cert}},
+		Listener:      l,
+		AutoSubscribe: true,
+		OnReject: func(_ string, r RejectReason) {
+			reason = r
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// control connection preface is sent before TLS handshake completes
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		tc := tls.Client(&earlyDataConn{Conn: c, data: []byte(http2.ClientPreface)}, &tls.Config{
+			InsecureSkipVerify: true,
+		})
+		tc.Handshake()
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.handleClient(tls.Server(conn, s.config.TLSConfig))
+
+	if reason != RejectTLSHandshake {
+		t.Fatal("expected TLS handshake rejection, got", reason)
+	}
+	if clients := s.Clients(); len(clients) != 0 {
+		t.Fatal("unexpected clients", clients)
+	}
+}
+
+func TestServer_Done(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewServer(&ServerConfig{
+		TLSConfig: &tls.Config{},
+		Listener:  l,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+
+	select {
+	case <-s.Done():
+		t.Fatal("Done closed before stop")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// closing listener stops the server
+	l.Close()
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Done not closed after listener close")
+	}
+	if err := s.Wait(); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	s.Stop()
+}
+
+func TestServer_ClientFlapping(t *testing.T) {
+	t.Parallel()
+
+	a := id.New([]byte("a"))
+
+	flapping := make(chan int, 1)
+	s, err := NewServer(&ServerConfig{
+		TLSConfig:     &tls.Config{},
+		FlapThreshold: 3,
+		FlapWindow:    100 * time.Millisecond,
+		OnClientFlapping: func(identifier id.ID, connects int) {
+			flapping <- connects
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	for i := 0; i < 2; i++ {
+		s.recordConnect(a)
+	}
+	if s.ClientFlapping(a) {
+		t.Fatal("unexpected flapping")
+	}
+
+	s.recordConnect(a)
+	if !s.ClientFlapping(a) {
+		t.Fatal("expected flapping")
+	}
+	select {
+	case n := <-flapping:
+		if n != 3 {
+			t.Fatal("expected 3 connects, got", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected OnClientFlapping call")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if s.ClientFlapping(a) {
+		t.Fatal("expected flapping to end after window")
+	}
+}
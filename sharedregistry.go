@@ -0,0 +1,274 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"sync"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+// Registration describes client connected to a server instance.
+type Registration struct {
+	// ID is the client identifier.
+	ID id.ID
+	// Hosts are HTTP hosts served by the client.
+	Hosts []string
+	// Instance identifies server instance the client is connected to, see
+	// ServerConfig.Instance.
+	Instance string
+}
+
+// Registry stores registrations of connected clients, a store shared by
+// server instances behind a load balancer lets an instance find clients
+// connected to other instances. Connections cannot be shared between
+// processes, server uses registrations of other instances only to pass
+// requests to ServerConfig.ElsewhereHandler or proxy them to the instance
+// with ServerConfig.PeerDialer. Implementations must be safe for concurrent
+// use.
+type Registry interface {
+	// Register stores registration of a client that connected, it replaces
+	// previous registration of the client.
+	Register(reg *Registration) error
+	// Lookup returns registration of a client serving host, host may be a
+	// wildcard i.e. "*.example.com". If there is none nil is returned.
+	Lookup(host string) (*Registration, error)
+	// Delete removes registration of client that went away from instance,
+	// registration with other instance is left intact.
+	Delete(identifier id.ID, instance string) error
+	// List returns all registrations.
+	List() ([]*Registration, error)
+}
+
+// memoryRegistry is in process Registry used by default.
+type memoryRegistry struct {
+	regs  map[id.ID]*Registration
+	hosts map[string][]id.ID
+	mu    sync.RWMutex
+}
+
+// NewMemoryRegistry creates a new Registry keeping registrations in memory of
+// a single process, it's the default ServerConfig.Registry.
+func NewMemoryRegistry() Registry {
+	return &memoryRegistry{
+		regs:  make(map[id.ID]*Registration),
+		hosts: make(map[string][]id.ID),
+	}
+}
+
+func (m *memoryRegistry) Register(reg *Registration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.delete(reg.ID)
+
+	r := *reg
+	r.Hosts = append([]string(nil), reg.Hosts...)
+	m.regs[r.ID] = &r
+	for _, host := range r.Hosts {
+		m.hosts[host] = append(m.hosts[host], r.ID)
+	}
+
+	return nil
+}
+
+func (m *memoryRegistry) Lookup(host string) (*Registration, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ids := m.hosts[host]
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	r := *m.regs[ids[0]]
+	return &r, nil
+}
+
+func (m *memoryRegistry) Delete(identifier id.ID, instance string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r, ok := m.regs[identifier]; ok && r.Instance == instance {
+		m.delete(identifier)
+	}
+
+	return nil
+}
+
+// delete removes registration of client, it must be called with mu held.
+func (m *memoryRegistry) delete(identifier id.ID) {
+	r, ok := m.regs[identifier]
+	if !ok {
+		return
+	}
+	delete(m.regs, identifier)
+
+	for _, host := range r.Hosts {
+		ids := m.hosts[host]
+		for i, v := range ids {
+			if v == identifier {
+				ids = append(ids[:i], ids[i+1:]...)
+				break
+			}
+		}
+		if len(ids) == 0 {
+			delete(m.hosts, host)
+		} else {
+			m.hosts[host] = ids
+		}
+	}
+}
+
+func (m *memoryRegistry) List() ([]*Registration, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	regs := make([]*Registration, 0, len(m.regs))
+	for _, r := range m.regs {
+		c := *r
+		regs = append(regs, &c)
+	}
+
+	return regs, nil
+}
+
+// elsewhereError is returned if host is served by a client connected to other
+// server instance.
+type elsewhereError struct {
+	reg *Registration
+}
+
+func (e *elsewhereError) Error() string {
+	return errClientElsewhere.Error()
+}
+
+func (e *elsewhereError) Unwrap() error {
+	return errClientElsewhere
+}
+
+// register stores registration of client connected to this instance.
+func (s *Server) register(identifier id.ID, i *RegistryItem) {
+	reg := &Registration{
+		ID:       identifier,
+		Instance: s.instance,
+	}
+	for _, h := range i.Hosts {
+		reg.Hosts = append(reg.Hosts, h.Host)
+	}
+
+	if err := s.sharedRegistry.Register(reg); err != nil {
+		s.logger.Log(
+			"level", 0,
+			"msg", "registration failed",
+			"identifier", identifier,
+			"err", err,
+		)
+	}
+}
+
+// unregister removes registration of client connected to this instance.
+func (s *Server) unregister(identifier id.ID) {
+	if err := s.sharedRegistry.Delete(identifier, s.instance); err != nil {
+		s.logger.Log(
+			"level", 0,
+			"msg", "deleting registration failed",
+			"identifier", identifier,
+			"err", err,
+		)
+	}
+}
+
+// elsewhere returns registration of client connected to other instance
+// serving host with port hostPort, if there is none nil is returned.
+func (s *Server) elsewhere(hostPort string) *Registration {
+	for _, host := range hostPatterns(trimPort(hostPort)) {
+		reg, err := s.sharedRegistry.Lookup(host)
+		if err != nil {
+			s.logger.Log(
+				"level", 0,
+				"msg", "registration lookup failed",
+				"host", host,
+				"err", err,
+			)
+			return nil
+		}
+		if reg != nil && reg.Instance != s.instance {
+			return reg
+		}
+	}
+	return nil
+}
+
+// serveElsewhere handles request to host served by client connected to other
+// instance.
+func (s *Server) serveElsewhere(w http.ResponseWriter, r *http.Request, reg *Registration) {
+	requestID, _ := RequestID(r.Context())
+
+	s.logger.Log(
+		"level", 2,
+		"action", "client elsewhere",
+		"requestID", requestID,
+		"host", r.Host,
+		"identifier", reg.ID,
+		"instance", reg.Instance,
+	)
+
+	if s.config.ElsewhereHandler != nil {
+		s.config.ElsewhereHandler(w, r, reg)
+		return
+	}
+	if s.peerProxy != nil {
+		s.proxyPeer(w, r, reg)
+		return
+	}
+	http.Error(w, errClientElsewhere.Error(), http.StatusBadGateway)
+}
+
+// headerPeer is set on requests proxied to other instance to their original
+// instance, it prevents proxy loops.
+const headerPeer = "X-Tunnel-Peer"
+
+// newPeerProxy creates reverse proxy of requests to other instances using
+// ServerConfig.PeerDialer, requests must have URL set to the instance.
+func (s *Server) newPeerProxy() *httputil.ReverseProxy {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = s.config.PeerDialer
+
+	return &httputil.ReverseProxy{
+		Director:  func(r *http.Request) {},
+		Transport: t,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			requestID, _ := RequestID(r.Context())
+			s.logger.Log(
+				"level", 0,
+				"msg", "peer proxy error",
+				"requestID", requestID,
+				"host", r.Host,
+				"instance", r.URL.Host,
+				"err", err,
+			)
+			http.Error(w, err.Error(), errorStatus(err))
+		},
+	}
+}
+
+// proxyPeer proxies request to instance of client reg, requests already
+// proxied by other instance get 502 Bad Gateway.
+func (s *Server) proxyPeer(w http.ResponseWriter, r *http.Request, reg *Registration) {
+	if r.Header.Get(headerPeer) != "" {
+		http.Error(w, errPeerLoop.Error(), http.StatusBadGateway)
+		return
+	}
+
+	outr := r.Clone(r.Context())
+	outr.URL.Scheme = "http"
+	outr.URL.Host = reg.Instance
+	outr.Header.Set(headerPeer, s.instance)
+
+	s.peerProxy.ServeHTTP(w, outr)
+}
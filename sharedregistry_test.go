@@ -0,0 +1,43 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"testing"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+func TestMemoryRegistry(t *testing.T) {
+	t.Parallel()
+
+	a, b := id.New([]byte("a")), id.New([]byte("b"))
+
+	r := NewMemoryRegistry()
+	r.Register(&Registration{ID: a, Hosts: []string{"a.example.com", "*.example.com"}, Instance: "1"})
+	r.Register(&Registration{ID: b, Hosts: []string{"b.example.com"}, Instance: "2"})
+
+	if reg, _ := r.Lookup("*.example.com"); reg == nil || reg.ID != a {
+		t.Fatal("unexpected registration", reg)
+	}
+	if reg, _ := r.Lookup("c.example.com"); reg != nil {
+		t.Fatal("unexpected registration", reg)
+	}
+
+	// client reconnected to other instance
+	r.Register(&Registration{ID: a, Hosts: []string{"a.example.com"}, Instance: "2"})
+	if reg, _ := r.Lookup("*.example.com"); reg != nil {
+		t.Fatal("expected old hosts to be removed", reg)
+	}
+	r.Delete(a, "1")
+	if reg, _ := r.Lookup("a.example.com"); reg == nil || reg.Instance != "2" {
+		t.Fatal("unexpected registration", reg)
+	}
+
+	r.Delete(a, "2")
+	if regs, _ := r.List(); len(regs) != 1 || regs[0].ID != b {
+		t.Fatal("unexpected registrations", regs)
+	}
+}
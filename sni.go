@@ -0,0 +1,431 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+var errNotClientHello = errors.New("not a TLS ClientHello")
+
+// maxTLSRecordSize is maximal size of TLS record including header.
+const maxTLSRecordSize = 5 + 16384 + 2048
+
+// clientHello holds TLS ClientHello fields used for routing.
+type clientHello struct {
+	// serverName is the lower case server_name extension value.
+	serverName string
+	// alpn are protocols offered in application_layer_protocol_negotiation
+	// extension.
+	alpn []string
+}
+
+// peekClientHello parses TLS ClientHello without consuming it from br, ALPN
+// protocols are parsed only if alpn is set. ClientHello must fit in a single
+// TLS record.
+func peekClientHello(br *bufio.Reader, alpn bool) (*clientHello, error) {
+	hdr, err := br.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	// handshake record
+	if hdr[0] != 0x16 {
+		return nil, errNotClientHello
+	}
+	n := int(binary.BigEndian.Uint16(hdr[3:5]))
+	if 5+n > maxTLSRecordSize {
+		return nil, errNotClientHello
+	}
+	rec, err := br.Peek(5 + n)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseClientHello(rec[5:], alpn)
+}
+
+// parseClientHello parses ClientHello handshake message b, ALPN protocols are
+// parsed only if alpn is set.
+func parseClientHello(b []byte, alpn bool) (*clientHello, error) {
+	s := tlsReader(b)
+
+	// handshake type client_hello
+	if t, ok := s.uint8(); !ok || t != 0x01 {
+		return nil, errNotClientHello
+	}
+	body, ok := s.bytes(3)
+	if !ok {
+		return nil, errNotClientHello
+	}
+
+	s = tlsReader(body)
+	// legacy_version and random
+	if _, ok := s.skip(2 + 32); !ok {
+		return nil, errNotClientHello
+	}
+	// legacy_session_id, cipher_suites, legacy_compression_methods
+	for _, size := range []int{1, 2, 1} {
+		if _, ok := s.bytes(size); !ok {
+			return nil, errNotClientHello
+		}
+	}
+
+	hello := &clientHello{}
+	if len(s) == 0 {
+		// no extensions
+		return hello, nil
+	}
+	exts, ok := s.bytes(2)
+	if !ok {
+		return nil, errNotClientHello
+	}
+
+	s = tlsReader(exts)
+	for len(s) > 0 {
+		typ, ok1 := s.uint16()
+		data, ok2 := s.bytes(2)
+		if !ok1 || !ok2 {
+			return nil, errNotClientHello
+		}
+
+		var err error
+		switch {
+		// server_name
+		case typ == 0x0000:
+			hello.serverName, err = parseServerName(data)
+		// application_layer_protocol_negotiation
+		case typ == 0x0010 && alpn:
+			hello.alpn, err = parseALPN(data)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return hello, nil
+}
+
+// parseServerName returns host_name from server_name extension data.
+func parseServerName(data []byte) (string, error) {
+	d := tlsReader(data)
+	list, ok := d.bytes(2)
+	if !ok {
+		return "", errNotClientHello
+	}
+	l := tlsReader(list)
+	for len(l) > 0 {
+		nameType, ok1 := l.uint8()
+		name, ok2 := l.bytes(2)
+		if !ok1 || !ok2 {
+			return "", errNotClientHello
+		}
+		// host_name
+		if nameType == 0 {
+			return strings.ToLower(string(name)), nil
+		}
+	}
+	return "", nil
+}
+
+// parseALPN returns protocols from application_layer_protocol_negotiation
+// extension data.
+func parseALPN(data []byte) ([]string, error) {
+	d := tlsReader(data)
+	list, ok := d.bytes(2)
+	if !ok {
+		return nil, errNotClientHello
+	}
+	var protos []string
+	l := tlsReader(list)
+	for len(l) > 0 {
+		p, ok := l.bytes(1)
+		if !ok || len(p) == 0 {
+			return nil, errNotClientHello
+		}
+		protos = append(protos, string(p))
+	}
+	return protos, nil
+}
+
+// tlsReader reads TLS presentation language vectors.
+type tlsReader []byte
+
+func (s *tlsReader) skip(n int) ([]byte, bool) {
+	if len(*s) < n {
+		return nil, false
+	}
+	v := (*s)[:n]
+	*s = (*s)[n:]
+	return v, true
+}
+
+func (s *tlsReader) uint8() (uint8, bool) {
+	v, ok := s.skip(1)
+	if !ok {
+		return 0, false
+	}
+	return v[0], true
+}
+
+func (s *tlsReader) uint16() (uint16, bool) {
+	v, ok := s.skip(2)
+	if !ok {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(v), true
+}
+
+// bytes reads vector with length prefix of size bytes.
+func (s *tlsReader) bytes(size int) ([]byte, bool) {
+	l, ok := s.skip(size)
+	if !ok {
+		return nil, false
+	}
+	n := 0
+	for _, b := range l {
+		n = n<<8 | int(b)
+	}
+	return s.skip(n)
+}
+
+// sniRouter holds listeners of TLS passthrough tunnels, a listener may be
+// shared by many clients serving different server names.
+type sniRouter struct {
+	listeners map[string]*sniListener // key is listen address
+	wrap      func(net.Listener) net.Listener
+	mu        sync.RWMutex
+}
+
+type sniListener struct {
+	l      net.Listener
+	routes []*sniRoute
+	closed chan struct{}
+}
+
+type sniRoute struct {
+	host       string
+	target     string
+	tunnel     string
+	identifier id.ID
+}
+
+// newSNIRouter creates a new sniRouter, listeners are wrapped with wrap if
+// not nil, see ServerConfig.DataListener.
+func newSNIRouter(wrap func(net.Listener) net.Listener) *sniRouter {
+	return &sniRouter{
+		listeners: make(map[string]*sniListener),
+		wrap:      wrap,
+	}
+}
+
+// add registers client serving host on listener with address addr, the
+// listener is opened if needed and the returned listener is not nil. The first
+// client registered on a listener is the default one serving connections
+// without server name.
+func (r *sniRouter) add(addr, host, target, tunnel string, identifier id.ID) (sl *sniListener, opened bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	host = strings.ToLower(host)
+
+	sl, ok := r.listeners[addr]
+	if ok {
+		for _, route := range sl.routes {
+			if route.host == host {
+				return nil, false, fmt.Errorf("server name %q is occupied", host)
+			}
+		}
+	} else {
+		l, err := listenData("tcp", addr, r.wrap)
+		if err != nil {
+			return nil, false, err
+		}
+		sl = &sniListener{
+			l:      l,
+			closed: make(chan struct{}),
+		}
+		r.listeners[addr] = sl
+		opened = true
+	}
+
+	sl.routes = append(sl.routes, &sniRoute{
+		host:       host,
+		target:     target,
+		tunnel:     tunnel,
+		identifier: identifier,
+	})
+
+	return sl, opened, nil
+}
+
+// remove unregisters client from all listeners, listeners without clients
+// are closed.
+func (r *sniRouter) remove(identifier id.ID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for addr, sl := range r.listeners {
+		routes := make([]*sniRoute, 0, len(sl.routes))
+		for _, route := range sl.routes {
+			if route.identifier != identifier {
+				routes = append(routes, route)
+			}
+		}
+		sl.routes = routes
+
+		if len(sl.routes) == 0 {
+			close(sl.closed)
+			sl.l.Close()
+			delete(r.listeners, addr)
+		}
+	}
+}
+
+// route selects client serving server name host on listener sl, wildcard
+// names i.e. "*.example.com" are supported. If host is empty the default
+// client is selected.
+func (r *sniRouter) route(sl *sniListener, host string) (*sniRoute, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(sl.routes) == 0 {
+		return nil, false
+	}
+	if host == "" {
+		return sl.routes[0], true
+	}
+
+	for _, pattern := range hostPatterns(host) {
+		for _, route := range sl.routes {
+			if route.host == pattern {
+				return route, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// listenSNI accepts connections on TLS passthrough listener and routes them
+// to clients by server name.
+func (s *Server) listenSNI(sl *sniListener) {
+	addr := sl.l.Addr().String()
+
+	for {
+		conn, err := sl.l.Accept()
+		if err != nil {
+			if listenerClosed(sl.closed, err) {
+				s.logger.Log(
+					"level", 2,
+					"action", "listener closed",
+					"addr", addr,
+				)
+				return
+			}
+
+			s.logger.Log(
+				"level", 0,
+				"msg", "accept of connection failed",
+				"addr", addr,
+				"err", err,
+			)
+			continue
+		}
+
+		go s.serveSNI(sl, conn)
+	}
+}
+
+func (s *Server) serveSNI(sl *sniListener, conn net.Conn) {
+	br := bufio.NewReaderSize(conn, maxTLSRecordSize)
+
+	conn.SetReadDeadline(time.Now().Add(s.handshakeTimeout))
+	hello, err := peekClientHello(br, s.config.ForwardALPN)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		s.logger.Log(
+			"level", 1,
+			"msg", "reading server name failed",
+			"addr", conn.RemoteAddr(),
+			"err", err,
+		)
+		conn.Close()
+		return
+	}
+
+	host := hello.serverName
+	route, ok := s.sni.route(sl, host)
+	if !ok {
+		s.logger.Log(
+			"level", 1,
+			"msg", "unknown server name",
+			"addr", conn.RemoteAddr(),
+			"host", host,
+		)
+		conn.Close()
+		return
+	}
+
+	// forwarded host is the tunnel host so that client can find local
+	// address also for wildcard names and connections without server name
+	msg := &proto.ControlMessage{
+		Action:         proto.ActionProxy,
+		ForwardedFor:   conn.RemoteAddr().String(),
+		ForwardedHost:  route.host,
+		ForwardedProto: proto.SNI,
+		RequestID:      newRequestID(),
+		Target:         route.target,
+		Tunnel:         route.tunnel,
+		ALPN:           strings.Join(hello.alpn, ","),
+	}
+
+	if err := s.keepAlive(conn); err != nil {
+		s.logger.Log(
+			"level", 1,
+			"msg", "TCP keepalive for tunneled connection failed",
+			"identifier", route.identifier,
+			"ctrlMsg", msg,
+			"err", err,
+		)
+	}
+	if err := s.noDelay(conn); err != nil {
+		s.logger.Log(
+			"level", 1,
+			"msg", "TCP_NODELAY for tunneled connection failed",
+			"identifier", route.identifier,
+			"ctrlMsg", msg,
+			"err", err,
+		)
+	}
+
+	if s.shedLoad() || !s.startSession() {
+		conn.Close()
+		return
+	}
+	defer s.endSession()
+
+	if err := s.proxyConn(route.identifier, bufferedConn{conn, br}, msg); err != nil {
+		atomic.AddInt64(&s.failedSessions, 1)
+		s.logger.Log(
+			"level", 0,
+			"msg", "proxy error",
+			"requestID", msg.RequestID,
+			"identifier", route.identifier,
+			"ctrlMsg", msg,
+			"err", err,
+		)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPeekClientHello(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		hello func(conn net.Conn)
+		host  string
+		alpn  []string
+		err   error
+	}{
+		{
+			name: "server name",
+			hello: func(conn net.Conn) {
+				tls.Client(conn, &tls.Config{ServerName: "Foo.Example.com"}).Handshake()
+			},
+			host: "foo.example.com",
+		},
+		{
+			name: "ALPN",
+			hello: func(conn net.Conn) {
+				tls.Client(conn, &tls.Config{ServerName: "foo.example.com", NextProtos: []string{"h2", "http/1.1"}}).Handshake()
+			},
+			host: "foo.example.com",
+			alpn: []string{"h2", "http/1.1"},
+		},
+		{
+			name: "no server name",
+			hello: func(conn net.Conn) {
+				tls.Client(conn, &tls.Config{InsecureSkipVerify: true}).Handshake()
+			},
+		},
+		{
+			name: "not TLS",
+			hello: func(conn net.Conn) {
+				io.WriteString(conn, "GET / HTTP/1.1\r\nHost: foo.example.com\r\n\r\n")
+			},
+			err: errNotClientHello,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+			c1.SetDeadline(time.Now().Add(5 * time.Second))
+			c2.SetDeadline(time.Now().Add(5 * time.Second))
+
+			go tt.hello(c1)
+
+			br := bufio.NewReaderSize(c2, maxTLSRecordSize)
+			hello, err := peekClientHello(br, true)
+			if err != tt.err {
+				t.Fatalf("expected error %v got %v", tt.err, err)
+			}
+			if err != nil {
+				return
+			}
+			if hello.serverName != tt.host {
+				t.Fatalf("expected host %q got %q", tt.host, hello.serverName)
+			}
+			if !reflect.DeepEqual(hello.alpn, tt.alpn) {
+				t.Fatalf("expected ALPN %q got %q", tt.alpn, hello.alpn)
+			}
+			if br.Buffered() == 0 {
+				t.Fatal("ClientHello consumed")
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// slowConsumerStall is how long a write to the user must block for the
+// session to be reported by Server.SlowConsumers.
+const slowConsumerStall = time.Second
+
+// stallWriter times writes to the user, it reports slow consumers and aborts
+// writes blocked for longer than ServerConfig.MaxStall.
+type stallWriter struct {
+	w        io.Writer
+	deadline func(time.Time) error
+	max      time.Duration
+	slow     *int64
+	st       *sessionStats
+	isSlow   bool
+}
+
+// stallWriter returns writer of session data to user connection conn, conn is
+// http.ResponseWriter or net.Conn the data is eventually written to and w
+// writes to it possibly through flushing or compressing writers. Stop must
+// be called when the copy is done.
+func (s *Server) stallWriter(w io.Writer, conn interface{}, st *sessionStats) (io.Writer, func()) {
+	sw := &stallWriter{
+		w:    w,
+		max:  s.config.MaxStall,
+		slow: &s.slowConsumers,
+		st:   st,
+	}
+	if sw.max > 0 {
+		switch c := conn.(type) {
+		case http.ResponseWriter:
+			sw.deadline = http.NewResponseController(c).SetWriteDeadline
+		case interface{ SetWriteDeadline(time.Time) error }:
+			sw.deadline = c.SetWriteDeadline
+		}
+	}
+	return sw, sw.stop
+}
+
+func (sw *stallWriter) Write(p []byte) (int, error) {
+	if sw.deadline != nil {
+		sw.deadline(time.Now().Add(sw.max))
+	}
+
+	start := time.Now()
+	n, err := sw.w.Write(p)
+	d := time.Since(start)
+
+	sw.st.addStall(d)
+	sw.setSlow(d >= slowConsumerStall)
+	if err != nil && sw.deadline != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		err = errSlowConsumer
+	}
+	return n, err
+}
+
+func (sw *stallWriter) setSlow(slow bool) {
+	if slow == sw.isSlow {
+		return
+	}
+	sw.isSlow = slow
+	if slow {
+		atomic.AddInt64(sw.slow, 1)
+	} else {
+		atomic.AddInt64(sw.slow, -1)
+	}
+}
+
+// stop clears the write deadline and the slow consumer mark.
+func (sw *stallWriter) stop() {
+	sw.setSlow(false)
+	if sw.deadline != nil {
+		sw.deadline(time.Time{})
+	}
+}
+
+// SlowConsumers returns number of sessions which last write to the user
+// blocked for at least a second, that is users reading data slower than
+// clients send it.
+func (s *Server) SlowConsumers() int64 {
+	return atomic.LoadInt64(&s.slowConsumers)
+}
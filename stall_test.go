@@ -0,0 +1,57 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+)
+
+func TestServer_StallWriter(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewServer(&ServerConfig{
+		TLSConfig: &tls.Config{},
+		MaxStall:  50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, conn := net.Pipe()
+	defer user.Close()
+	defer conn.Close()
+
+	st := newSessionStats(id.New([]byte("a")), nil)
+	dst, stop := s.stallWriter(conn, conn, st)
+
+	// user reads late
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		io.CopyN(ioutil.Discard, user, 4)
+	}()
+	if _, err := dst.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if stall := time.Duration(st.stall); stall < 20*time.Millisecond {
+		t.Fatal("expected stall of at least 20ms got", stall)
+	}
+
+	// user does not read
+	if _, err := dst.Write([]byte("data")); err != errSlowConsumer {
+		t.Fatal("expected", errSlowConsumer, "got", err)
+	}
+
+	stop()
+	if n := s.SlowConsumers(); n != 0 {
+		t.Fatal("expected no slow consumers got", n)
+	}
+}
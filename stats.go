@@ -0,0 +1,126 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// SessionStats describes a finished proxy session, that is a single HTTP
+// request, TCP connection or UDP session.
+type SessionStats struct {
+	// RequestID is the request ID of the session.
+	RequestID string
+	// Identifier is the client identifier.
+	Identifier id.ID
+	// ClientName is AllowedClient.Name of the client.
+	ClientName string
+	// ClientLabels are AllowedClient.Labels of the client.
+	ClientLabels map[string]string
+	// Proto is the forwarded protocol.
+	Proto string
+	// Host is the HTTP host or address of the listener.
+	Host string
+	// BytesIn is number of bytes transferred from user to client.
+	BytesIn int64
+	// BytesOut is number of bytes transferred from client to user.
+	BytesOut int64
+	// Start is the time the session started.
+	Start time.Time
+	// Duration is how long the session lasted.
+	Duration time.Duration
+	// Stall is how long writes to the user blocked in total, it's high for
+	// users reading slower than the client sends data, see
+	// ServerConfig.MaxStall.
+	Stall time.Duration
+	// Err is the error the session failed with or nil.
+	Err error
+}
+
+// sessionStats accumulates SessionStats of a running session, methods are
+// safe to call on nil.
+type sessionStats struct {
+	identifier id.ID
+	msg        *proto.ControlMessage
+	start      time.Time
+	in, out    int64
+	stall      int64
+
+	// trace context, see Server.traceSession
+	parent      string
+	traced      bool
+	traceParent string
+	end         func(stats *SessionStats)
+}
+
+func newSessionStats(identifier id.ID, msg *proto.ControlMessage) *sessionStats {
+	return &sessionStats{
+		identifier: identifier,
+		msg:        msg,
+		start:      time.Now(),
+	}
+}
+
+// set sets client the session is proxied to.
+func (st *sessionStats) set(identifier id.ID, msg *proto.ControlMessage) {
+	if st == nil {
+		return
+	}
+	st.identifier = identifier
+	st.msg = msg
+}
+
+func (st *sessionStats) addIn(n int64) {
+	if st == nil {
+		return
+	}
+	atomic.AddInt64(&st.in, n)
+}
+
+func (st *sessionStats) addOut(n int64) {
+	if st == nil {
+		return
+	}
+	atomic.AddInt64(&st.out, n)
+}
+
+func (st *sessionStats) addStall(d time.Duration) {
+	if st == nil {
+		return
+	}
+	atomic.AddInt64(&st.stall, int64(d))
+}
+
+func (st *sessionStats) stats(err error) *SessionStats {
+	return &SessionStats{
+		RequestID:  st.msg.RequestID,
+		Identifier: st.identifier,
+		Proto:      st.msg.ForwardedProto,
+		Host:       st.msg.ForwardedHost,
+		BytesIn:    atomic.LoadInt64(&st.in),
+		BytesOut:   atomic.LoadInt64(&st.out),
+		Start:      st.start,
+		Duration:   time.Since(st.start),
+		Stall:      time.Duration(atomic.LoadInt64(&st.stall)),
+		Err:        err,
+	}
+}
+
+type sessionStatsKey struct{}
+
+func withSessionStats(ctx context.Context, st *sessionStats) context.Context {
+	return context.WithValue(ctx, sessionStatsKey{}, st)
+}
+
+// sessionStatsFrom returns sessionStats stored in ctx or nil.
+func sessionStatsFrom(ctx context.Context) *sessionStats {
+	st, _ := ctx.Value(sessionStatsKey{}).(*sessionStats)
+	return st
+}
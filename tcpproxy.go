@@ -5,15 +5,16 @@
 package tunnel
 
 import (
-	"fmt"
 	"io"
 	"net"
+	"strings"
 
 	"github.com/mmatczuk/go-http-tunnel/log"
 	"github.com/mmatczuk/go-http-tunnel/proto"
 )
 
-// TCPProxy forwards TCP streams.
+// TCPProxy forwards TCP streams. Local server addresses prefixed with "unix:"
+// i.e. "unix:/var/run/docker.sock" are Unix domain sockets.
 type TCPProxy struct {
 	// localAddr specifies default TCP address of the local server.
 	localAddr string
@@ -24,6 +25,11 @@ type TCPProxy struct {
 	// * port
 	// * host
 	localAddrMap map[string]string
+	// ProxyProtocol maps local server address to PROXY protocol version
+	// (proto.ProxyProtocolV1 or proto.ProxyProtocolV2). If set for a local
+	// server, PROXY protocol header describing the original connection is
+	// sent before relaying data.
+	ProxyProtocol map[string]string
 	// logger is the proxy logger.
 	logger log.Logger
 }
@@ -57,7 +63,7 @@ func NewMultiTCPProxy(localAddrMap map[string]string, logger log.Logger) *TCPPro
 // Proxy is a ProxyFunc.
 func (p *TCPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
 	switch msg.ForwardedProto {
-	case proto.TCP, proto.TCP4, proto.TCP6, proto.UNIX:
+	case proto.TCP, proto.TCP4, proto.TCP6, proto.UNIX, proto.SNI:
 		// ok
 	default:
 		p.logger.Log(
@@ -68,7 +74,7 @@ func (p *TCPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage
 		return
 	}
 
-	target := p.localAddrFor(msg.ForwardedHost)
+	target := localAddrFor(p.localAddrMap, p.localAddr, msg.ForwardedHost)
 	if target == "" {
 		p.logger.Log(
 			"level", 1,
@@ -77,72 +83,116 @@ func (p *TCPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage
 		)
 		return
 	}
-
-	local, err := net.DialTimeout("tcp", target, DefaultTimeout)
-	if err != nil {
+	if msg.Target != "" && msg.Target != target {
 		p.logger.Log(
 			"level", 0,
-			"msg", "dial failed",
+			"msg", "target mismatch",
 			"target", target,
 			"ctrlMsg", msg,
-			"err", err,
 		)
 		return
 	}
-	defer local.Close()
 
-	if err := keepAlive(local); err != nil {
+	network, addr := localNetwork(target)
+	local, err := localDial(r, network, addr)
+	if err != nil {
 		p.logger.Log(
-			"level", 1,
-			"msg", "TCP keepalive for tunneled connection failed",
+			"level", 0,
+			"msg", "dial failed",
 			"target", target,
 			"ctrlMsg", msg,
 			"err", err,
 		)
+		return
+	}
+	defer local.Close()
+
+	if network == "tcp" {
+		if err := keepAlive(local); err != nil {
+			p.logger.Log(
+				"level", 1,
+				"msg", "TCP keepalive for tunneled connection failed",
+				"target", target,
+				"ctrlMsg", msg,
+				"err", err,
+			)
+		}
+	}
+
+	if v := p.ProxyProtocol[target]; v != "" {
+		if err := writeProxyProtocol(local, v, msg.ForwardedFor, msg.ForwardedHost); err != nil {
+			p.logger.Log(
+				"level", 0,
+				"msg", "PROXY protocol header write failed",
+				"target", target,
+				"ctrlMsg", msg,
+				"err", err,
+			)
+			return
+		}
 	}
 
+	// When server closes the stream writing side of local connection is
+	// closed and the other direction goes on until local server closes.
+	// Response cannot be half-closed, when local server closes the whole
+	// stream is closed.
 	done := make(chan struct{})
 	go func() {
 		transfer(flushWriter{w}, local, log.NewContext(p.logger).With(
 			"dst", msg.ForwardedHost,
 			"src", target,
 		))
+		r.Close()
 		close(done)
 	}()
 
-	transfer(local, r, log.NewContext(p.logger).With(
+	if _, err := transferBuffer(defaultBufferPool, local, r, log.NewContext(p.logger).With(
 		"dst", target,
 		"src", msg.ForwardedHost,
-	))
+	)); err != nil {
+		local.Close()
+	} else {
+		closeWrite(local)
+	}
 
 	<-done
 }
 
-func (p *TCPProxy) localAddrFor(hostPort string) string {
-	if len(p.localAddrMap) == 0 {
-		return p.localAddr
+// localNetwork returns network and address of local server address target.
+func localNetwork(target string) (network, addr string) {
+	if strings.HasPrefix(target, "unix:") {
+		return "unix", strings.TrimPrefix(target, "unix:")
+	}
+	return "tcp", target
+}
+
+// localAddrFor returns local address from localAddrMap matching hostPort, if
+// there is no match localAddr is returned.
+func localAddrFor(localAddrMap map[string]string, localAddr, hostPort string) string {
+	if len(localAddrMap) == 0 {
+		return localAddr
 	}
 
 	// try hostPort
-	if addr := p.localAddrMap[hostPort]; addr != "" {
+	if addr := localAddrMap[hostPort]; addr != "" {
 		return addr
 	}
 
 	// try port
-	host, port, _ := net.SplitHostPort(hostPort)
-	if addr := p.localAddrMap[port]; addr != "" {
+	_, port, _ := net.SplitHostPort(hostPort)
+	if addr := localAddrMap[port]; addr != "" {
 		return addr
 	}
 
 	// try 0.0.0.0:port
-	if addr := p.localAddrMap[fmt.Sprintf("0.0.0.0:%s", port)]; addr != "" {
+	if addr := localAddrMap[net.JoinHostPort("0.0.0.0", port)]; addr != "" {
 		return addr
 	}
 
 	// try host
-	if addr := p.localAddrMap[host]; addr != "" {
+	if addr := localAddrMap[trimPort(hostPort)]; addr != "" {
 		return addr
 	}
 
-	return p.localAddr
+	return localAddr
 }
@@ -0,0 +1,74 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// connectionState returns state of TLS connection underlying conn, it returns
+// nil if conn is not a TLS connection or the handshake is not complete.
+func connectionState(conn net.Conn) *tls.ConnectionState {
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			state := c.ConnectionState()
+			if !state.HandshakeComplete {
+				return nil
+			}
+			return &state
+		case bufferedConn:
+			conn = c.Conn
+		case *activityConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// checkTLSPolicy returns error if TLS version or cipher suite of state are not
+// allowed by ServerConfig.MinTLSVersion and ServerConfig.AllowedCipherSuites.
+func (s *Server) checkTLSPolicy(state *tls.ConnectionState) error {
+	if state.Version < s.config.MinTLSVersion {
+		return fmt.Errorf("TLS version %s not allowed", tls.VersionName(state.Version))
+	}
+
+	if len(s.config.AllowedCipherSuites) == 0 {
+		return nil
+	}
+	for _, c := range s.config.AllowedCipherSuites {
+		if c == state.CipherSuite {
+			return nil
+		}
+	}
+	return fmt.Errorf("cipher suite %s not allowed", tls.CipherSuiteName(state.CipherSuite))
+}
+
+// validateTLSPolicy checks MinTLSVersion and AllowedCipherSuites of c.
+func (c *ServerConfig) validateTLSPolicy() error {
+	switch c.MinTLSVersion {
+	case 0, tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13:
+	default:
+		return fmt.Errorf("unknown MinTLSVersion 0x%04X", c.MinTLSVersion)
+	}
+
+	known := make(map[uint16]bool)
+	for _, cs := range tls.CipherSuites() {
+		known[cs.ID] = true
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		known[cs.ID] = true
+	}
+	for _, id := range c.AllowedCipherSuites {
+		if !known[id] {
+			return fmt.Errorf("unknown cipher suite 0x%04X in AllowedCipherSuites", id)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mmatczuk/go-http-tunnel/id"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// Plain TCP control connections are meant for trusted networks where TLS is
+// terminated by a load balancer, see ServerConfig.InsecureControl. Client
+// starts every connection with HTTP/1.1 upgrade request carrying
+// ActionConnect control message with the token, server responds 101
+// Switching Protocols and from then on the connection is handled the same way
+// as TLS connections.
+
+// controlUpgrade is the Upgrade header value of plain TCP connections.
+const controlUpgrade = "tunnel"
+
+// TokenID returns identifier of client authenticating with token, it's used
+// in AllowedClients and RevokedIDs of servers with InsecureControl.
+func TokenID(token string) id.ID {
+	return IdentityID(token)
+}
+
+// readUpgrade reads upgrade request of plain TCP connection, it returns
+// identifier derived from the token and connection to use instead of conn.
+func readUpgrade(conn net.Conn) (id.ID, net.Conn, error) {
+	var identifier id.ID
+
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return identifier, nil, err
+	}
+	req.RemoteAddr = conn.RemoteAddr().String()
+
+	if !strings.EqualFold(req.Header.Get("Upgrade"), controlUpgrade) {
+		return identifier, nil, fmt.Errorf("unexpected upgrade %q", req.Header.Get("Upgrade"))
+	}
+	msg, err := proto.ReadControlMessage(req)
+	if err == nil && msg.Action != proto.ActionConnect {
+		err = fmt.Errorf("unexpected action %q", msg.Action)
+	}
+	if err != nil {
+		return identifier, nil, err
+	}
+	if msg.Token == "" {
+		return identifier, nil, errMissingToken
+	}
+
+	return TokenID(msg.Token), bufferedConn{conn, br}, nil
+}
+
+// acceptUpgrade responds to upgrade request with 101 Switching Protocols.
+func acceptUpgrade(conn net.Conn) error {
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", controlUpgrade)
+	return err
+}
+
+// rejectUpgrade responds to upgrade request with 403 Forbidden.
+func rejectUpgrade(conn net.Conn, reason RejectReason) {
+	code := http.StatusForbidden
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%s: %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+		code, http.StatusText(code), proto.HeaderError, reason)
+}
+
+// upgrade authenticates connection to the server with ClientConfig.Token, it
+// returns connection to use instead of conn.
+func (c *Client) upgrade(conn net.Conn) (net.Conn, error) {
+	if err := conn.SetDeadline(time.Now().Add(DefaultTimeout)); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprint("http://", c.config.ServerAddr, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", controlUpgrade)
+	msg := &proto.ControlMessage{
+		Action: proto.ActionConnect,
+		Token:  c.config.Token,
+	}
+	msg.WriteToHeader(req.Header)
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("%s: %s", resp.Status, resp.Header.Get(proto.HeaderError))
+	}
+
+	return bufferedConn{conn, br}, conn.SetDeadline(time.Time{})
+}
@@ -0,0 +1,50 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"net/http"
+
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// Tracer creates spans of proxied sessions for distributed tracing, it's meant
+// to be implemented by adapters of tracing libraries i.e. OpenTelemetry, see
+// package otel, so that the package does not depend on any of them.
+type Tracer interface {
+	// StartSession is called before session msg is sent to the client,
+	// parent is W3C traceparent of the user HTTP request or empty. It
+	// returns traceparent of the session span, sent to the client in
+	// ControlMessage.TraceParent unless it's empty, and function called
+	// with stats of the session when it ends. Span attributes i.e. bytes
+	// transferred and outcome are meant to be taken from the stats.
+	StartSession(parent string, msg *proto.ControlMessage) (traceParent string, end func(stats *SessionStats))
+}
+
+// traceSession starts span of session st with ServerConfig.Tracer and
+// propagates its trace context to the client, it must be called before the
+// session message is sent. Retries of the session reuse the span.
+func (s *Server) traceSession(st *sessionStats) {
+	if s.config.Tracer == nil || st == nil || st.msg == nil {
+		return
+	}
+	if !st.traced {
+		st.traced = true
+		st.traceParent, st.end = s.config.Tracer.StartSession(st.parent, st.msg)
+	}
+	if proto.ValidTraceParent(st.traceParent) {
+		st.msg.TraceParent = st.traceParent
+	}
+}
+
+// traceParent returns traceparent header of r or empty string if the header is
+// missing or malformed.
+func traceParent(r *http.Request) string {
+	v := r.Header.Get(proto.HeaderTraceParent)
+	if !proto.ValidTraceParent(v) {
+		return ""
+	}
+	return v
+}
@@ -11,4 +11,19 @@ var (
 	DefaultTimeout = 10 * time.Second
 	// DefaultPingTimeout specifies a ping timeout.
 	DefaultPingTimeout = 500 * time.Millisecond
+	// DefaultUDPIdleTimeout specifies how long UDP proxy session can be
+	// idle before it's closed.
+	DefaultUDPIdleTimeout = 60 * time.Second
+	// DefaultTransferBufferSize specifies size of buffers used for copying
+	// data between connections.
+	DefaultTransferBufferSize = 32 * 1024
+	// DefaultCompressionMinSize specifies minimal size of HTTP response body
+	// of known length that is compressed.
+	DefaultCompressionMinSize int64 = 1024
+	// DefaultStickyCookie specifies name of the cookie used for StickyCookie
+	// session affinity.
+	DefaultStickyCookie = "tunnel_sticky"
+	// DefaultFlapWindow specifies window in which client connections are
+	// counted to detect flapping clients.
+	DefaultFlapWindow = time.Minute
 )
@@ -0,0 +1,159 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/mmatczuk/go-http-tunnel/log"
+	"github.com/mmatczuk/go-http-tunnel/proto"
+)
+
+// maxDatagramSize is the maximal size of UDP datagram payload.
+const maxDatagramSize = 65535
+
+// writeDatagram writes datagram to a stream prefixed by its length so that
+// packet boundaries are preserved.
+func writeDatagram(w io.Writer, p []byte) error {
+	if len(p) > maxDatagramSize {
+		return fmt.Errorf("datagram too large: %d", len(p))
+	}
+
+	b := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(b, uint16(len(p)))
+	copy(b[2:], p)
+
+	_, err := w.Write(b)
+	return err
+}
+
+// readDatagram reads datagram written with writeDatagram to buf, buf must be
+// at least maxDatagramSize long.
+func readDatagram(r io.Reader, buf []byte) ([]byte, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(h[:]))
+
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+// UDPProxy forwards UDP datagrams.
+type UDPProxy struct {
+	// localAddr specifies default UDP address of the local server.
+	localAddr string
+	// localAddrMap specifies mapping from ControlMessage.ForwardedHost to
+	// local server address, keys may contain host and port, only host or
+	// only port. The order of precedence is the same as in TCPProxy.
+	localAddrMap map[string]string
+	// logger is the proxy logger.
+	logger log.Logger
+}
+
+// NewUDPProxy creates new direct UDPProxy, everything will be proxied to
+// localAddr.
+func NewUDPProxy(localAddr string, logger log.Logger) *UDPProxy {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	return &UDPProxy{
+		localAddr: localAddr,
+		logger:    logger,
+	}
+}
+
+// NewMultiUDPProxy creates a new dispatching UDPProxy, datagrams may go to
+// different backends based on localAddrMap.
+func NewMultiUDPProxy(localAddrMap map[string]string, logger log.Logger) *UDPProxy {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	return &UDPProxy{
+		localAddrMap: localAddrMap,
+		logger:       logger,
+	}
+}
+
+// Proxy is a ProxyFunc.
+func (p *UDPProxy) Proxy(w io.Writer, r io.ReadCloser, msg *proto.ControlMessage) {
+	switch msg.ForwardedProto {
+	case proto.UDP:
+		// ok
+	default:
+		p.logger.Log(
+			"level", 0,
+			"msg", "unsupported protocol",
+			"ctrlMsg", msg,
+		)
+		return
+	}
+
+	target := localAddrFor(p.localAddrMap, p.localAddr, msg.ForwardedHost)
+	if target == "" {
+		p.logger.Log(
+			"level", 1,
+			"msg", "no target",
+			"ctrlMsg", msg,
+		)
+		return
+	}
+
+	local, err := localDial(r, "udp", target)
+	if err != nil {
+		p.logger.Log(
+			"level", 0,
+			"msg", "dial failed",
+			"target", target,
+			"ctrlMsg", msg,
+			"err", err,
+		)
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		fw := flushWriter{w}
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := local.Read(buf)
+			if err != nil {
+				break
+			}
+			if err := writeDatagram(fw, buf[:n]); err != nil {
+				break
+			}
+		}
+		close(done)
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		b, err := readDatagram(r, buf)
+		if err != nil {
+			break
+		}
+		if _, err := local.Write(b); err != nil {
+			p.logger.Log(
+				"level", 2,
+				"msg", "write failed",
+				"target", target,
+				"ctrlMsg", msg,
+				"err", err,
+			)
+		}
+	}
+
+	local.Close()
+	<-done
+}
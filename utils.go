@@ -5,16 +5,73 @@
 package tunnel
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/net/http2"
 
 	"github.com/mmatczuk/go-http-tunnel/log"
 )
 
-func transfer(dst io.Writer, src io.Reader, logger log.Logger) {
-	n, err := io.Copy(dst, src)
+// bufferPool is a pool of equally sized buffers used by transfer.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	if size <= 0 {
+		size = DefaultTransferBufferSize
+	}
+
+	p := &bufferPool{
+		size: size,
+	}
+	p.pool.New = func() interface{} {
+		b := make([]byte, p.size)
+		return &b
+	}
+
+	return p
+}
+
+func (p *bufferPool) get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+func (p *bufferPool) put(b *[]byte) {
+	p.pool.Put(b)
+}
+
+// defaultBufferPool is used by transfer, it holds buffers of
+// DefaultTransferBufferSize.
+var defaultBufferPool = newBufferPool(DefaultTransferBufferSize)
+
+func transfer(dst io.Writer, src io.Reader, logger log.Logger) int64 {
+	n, _ := transferBuffer(defaultBufferPool, dst, src, logger)
+	return n
+}
+
+// transferBuffer is like transfer but it takes copy buffer from pool p and
+// returns copy error.
+func transferBuffer(p *bufferPool, dst io.Writer, src io.Reader, logger log.Logger) (int64, error) {
+	buf := p.get()
+	defer p.put(buf)
+
+	// src io.WriterTo is hidden so that the pooled buffer is used, it also
+	// avoids concurrent WriteTo calls on global empty body of HTTP/2
+	// responses without body
+	n, err := io.CopyBuffer(dst, struct{ io.Reader }{src}, *buf)
 	if err != nil {
 		if !strings.Contains(err.Error(), "context canceled") && !strings.Contains(err.Error(), "CANCEL") {
 			logger.Log(
@@ -30,6 +87,8 @@ func transfer(dst io.Writer, src io.Reader, logger log.Logger) {
 		"action", "transferred",
 		"bytes", n,
 	)
+
+	return n, err
 }
 
 func setXForwardedFor(h http.Header, remoteAddr string) {
@@ -45,6 +104,124 @@ func setXForwardedFor(h http.Header, remoteAddr string) {
 	}
 }
 
+// setNoDelay sets TCP_NODELAY option of conn, TLS connections are unwrapped,
+// non TCP connections are ignored.
+func setNoDelay(conn net.Conn, noDelay bool) error {
+	if c, ok := conn.(*tls.Conn); ok {
+		conn = c.NetConn()
+	}
+	c, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	return c.SetNoDelay(noDelay)
+}
+
+// closeWrite shuts down the writing side of c so that peer reads EOF, if c
+// does not support half-close it's closed.
+func closeWrite(c net.Conn) error {
+	if bc, ok := c.(bufferedConn); ok {
+		c = bc.Conn
+	}
+	if cw, ok := c.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// closeOnDone closes c when ctx is done, it's used to interrupt blocking
+// reads and writes on c.
+func closeOnDone(ctx context.Context, c io.Closer) {
+	<-ctx.Done()
+	c.Close()
+}
+
+// errorStatus returns HTTP status code of a proxy error, 503 Service
+// Unavailable if client is not connected, has too many connections or local
+// service is unhealthy, 504 Gateway Timeout for timeouts and 502 Bad Gateway
+// otherwise i.e. if connected client failed to proxy the request.
+// ModifyResponse errors are always 502 Bad Gateway.
+func errorStatus(err error) int {
+	var pe *ProxyError
+	if errors.As(err, &pe) && pe.Op == OpModifyResponse {
+		return http.StatusBadGateway
+	}
+	if errors.Is(err, errTooManyConns) || errors.Is(err, errUnhealthy) || errors.Is(err, errClientNotConnected) {
+		return http.StatusServiceUnavailable
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// connLost returns true if err is caused by control connection going away
+// during round trip i.e. client sent GOAWAY or closed the connection.
+func connLost(err error) bool {
+	if err == nil {
+		return false
+	}
+	var ge http2.GoAwayError
+	if errors.As(err, &ge) {
+		return true
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	return strings.Contains(err.Error(), "http2: client conn is closed")
+}
+
+// isIdempotent returns true if request r can be safely resent, requests with
+// Idempotency-Key header are considered idempotent as in net/http.
+func isIdempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	_, ok := r.Header["Idempotency-Key"]
+	if !ok {
+		_, ok = r.Header["X-Idempotency-Key"]
+	}
+	return ok
+}
+
+// splitTarget splits target address in form host:port.
+func splitTarget(target string) (string, int, error) {
+	host, p, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", 0, err
+	}
+	if host == "" {
+		return "", 0, errors.New("missing host")
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port %q", p)
+	}
+	return host, port, nil
+}
+
+// isUpgrade returns true if header requests protocol upgrade i.e. WebSocket.
+func isUpgrade(h http.Header) bool {
+	if h.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range h["Connection"] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func cloneHeader(h http.Header) http.Header {
 	h2 := make(http.Header, len(h))
 	for k, vv := range h {
@@ -63,6 +240,36 @@ func copyHeader(dst, src http.Header) {
 	}
 }
 
+// announceTrailers declares trailers of resp in Trailer header of h, it
+// returns number of declared trailers to pass to copyTrailers.
+func announceTrailers(h http.Header, resp *http.Response) int {
+	if len(resp.Trailer) == 0 {
+		return 0
+	}
+	keys := make([]string, 0, len(resp.Trailer))
+	for k := range resp.Trailer {
+		keys = append(keys, k)
+	}
+	h.Add("Trailer", strings.Join(keys, ", "))
+	return len(keys)
+}
+
+// copyTrailers copies trailers of resp to h after the body is read,
+// trailers that were not declared with announceTrailers are sent with
+// http.TrailerPrefix.
+func copyTrailers(h http.Header, resp *http.Response, announced int) {
+	if len(resp.Trailer) == announced {
+		copyHeader(h, resp.Trailer)
+		return
+	}
+	for k, vv := range resp.Trailer {
+		k = http.TrailerPrefix + k
+		for _, v := range vv {
+			h.Add(k, v)
+		}
+	}
+}
+
 type countWriter struct {
 	w     io.Writer
 	count int64
@@ -74,6 +281,59 @@ func (cw *countWriter) Write(p []byte) (n int, err error) {
 	return
 }
 
+// headerSize returns size of request line and headers of r.
+func headerSize(r *http.Request) int {
+	n := len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4
+	for k, vv := range r.Header {
+		for _, v := range vv {
+			n += len(k) + len(v) + 4
+		}
+	}
+	return n
+}
+
+// maxBytesBody records if request body read with http.MaxBytesReader
+// exceeded the limit, methods are safe to call on nil.
+type maxBytesBody struct {
+	io.ReadCloser
+	exceeded int32
+}
+
+func (b *maxBytesBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		atomic.StoreInt32(&b.exceeded, 1)
+	}
+	return n, err
+}
+
+func (b *maxBytesBody) isExceeded() bool {
+	return b != nil && atomic.LoadInt32(&b.exceeded) == 1
+}
+
+// releaseCloser calls release after closing the underlying ReadCloser.
+type releaseCloser struct {
+	io.ReadCloser
+	release func()
+}
+
+func (rc releaseCloser) Close() error {
+	err := rc.ReadCloser.Close()
+	rc.release()
+	return err
+}
+
+// bufferedConn reads from r data buffered before the connection was hijacked.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
 type flushWriter struct {
 	w io.Writer
 }
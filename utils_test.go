@@ -0,0 +1,147 @@
+// Copyright (C) 2017 Michał Matczuk
+// Use of this source code is governed by an AGPL-style
+// license that can be found in the LICENSE file.
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/http2"
+
+	"github.com/mmatczuk/go-http-tunnel/log"
+)
+
+// onlyReader hides io.WriterTo so that copy buffer is used.
+type onlyReader struct {
+	io.Reader
+}
+
+// onlyWriter hides io.ReaderFrom so that copy buffer is used.
+type onlyWriter struct {
+	io.Writer
+}
+
+func TestTransfer(t *testing.T) {
+	t.Parallel()
+
+	p := newBufferPool(16)
+	src := bytes.Repeat([]byte("tunnel"), 100)
+
+	var dst bytes.Buffer
+	n, _ := transferBuffer(p, &dst, onlyReader{bytes.NewReader(src)}, log.NewNopLogger())
+	if n != int64(len(src)) || !bytes.Equal(dst.Bytes(), src) {
+		t.Fatal("transfer mismatch", n, len(src))
+	}
+	if b := p.get(); len(*b) != 16 {
+		t.Fatal("unexpected buffer size", len(*b))
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	t.Parallel()
+
+	table := []struct {
+		err    error
+		status int
+	}{
+		{errors.New("foobar"), http.StatusBadGateway},
+		{fmt.Errorf("io error: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{&net.OpError{Op: "dial", Err: timeoutError{}}, http.StatusGatewayTimeout},
+		{errTooManyConns, http.StatusServiceUnavailable},
+		{roundTripError(&url.Error{Op: "Post", Err: errClientNotConnected}), http.StatusServiceUnavailable},
+		{roundTripError(io.ErrUnexpectedEOF), http.StatusBadGateway},
+		{&ProxyError{Op: OpModifyResponse, Err: context.DeadlineExceeded}, http.StatusBadGateway},
+	}
+
+	for _, tt := range table {
+		if status := errorStatus(tt.err); status != tt.status {
+			t.Error(tt.err, "expected", tt.status, "got", status)
+		}
+	}
+}
+
+func TestConnLost(t *testing.T) {
+	t.Parallel()
+
+	table := []struct {
+		err  error
+		lost bool
+	}{
+		{nil, false},
+		{errors.New("foobar"), false},
+		{errClientNotConnected, false},
+		{&ProxyError{Op: OpRoundTrip, Err: io.ErrUnexpectedEOF}, true},
+		{&ProxyError{Op: OpRoundTrip, Err: http2.GoAwayError{ErrCode: http2.ErrCodeNo}}, true},
+		{errors.New("http2: client conn is closed"), true},
+	}
+
+	for _, tt := range table {
+		if lost := connLost(tt.err); lost != tt.lost {
+			t.Error(tt.err, "expected", tt.lost, "got", lost)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func BenchmarkTransfer(b *testing.B) {
+	data := make([]byte, 4*1024)
+	logger := log.NewNopLogger()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		transfer(onlyWriter{ioutil.Discard}, onlyReader{bytes.NewReader(data)}, logger)
+	}
+}
+
+func BenchmarkTransferNoPool(b *testing.B) {
+	data := make([]byte, 4*1024)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		io.Copy(onlyWriter{ioutil.Discard}, onlyReader{bytes.NewReader(data)})
+	}
+}
+
+func TestSetNoDelay(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	for _, c := range []net.Conn{conn, tls.Client(conn, &tls.Config{}), p1} {
+		if err := setNoDelay(c, false); err != nil {
+			t.Errorf("%T: %s", c, err)
+		}
+	}
+}